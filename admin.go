@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var (
+	// Command line flags
+	adminFlag = flag.String("admin", "",
+		"peers allowed to call admin methods: all, none, local, unix, token, IP or CIDR")
+	adminTokenFlag = flag.String("admin-token", "", "token of cellaserv.authenticate")
+
+	// Default admin policy: clients on this host and authenticated clients
+	adminAllow = "local,unix,token"
+	adminToken string
+
+	// Connections that successfully called cellaserv.authenticate
+	connAdmins map[net.Conn]bool
+
+	// Methods of the cellaserv service restricted to admin clients
+	adminMethods = map[string]bool{
+		"archive-session": true,
+		"delete-session":  true,
+		"dump-start":      true,
+		"dump-stop":       true,
+		"log-rotate":      true,
+		"shutdown":        true,
+		"spy":             true,
+	}
+)
+
+func setAdminAllowFromString(allow string) {
+	if allow != "" {
+		adminAllow = allow
+	}
+}
+
+func setAdminTokenFromString(token string) {
+	if token != "" {
+		adminToken = token
+	}
+}
+
+// adminCheckRule returns an error if the rule of the admin policy is unknown
+func adminCheckRule(rule string) error {
+	switch rule {
+	case "all", "none", "local", "unix", "token":
+		return nil
+	}
+	if _, _, err := net.ParseCIDR(rule); err == nil {
+		return nil
+	}
+	if net.ParseIP(rule) == nil {
+		return fmt.Errorf("Unknown admin rule: %s", rule)
+	}
+	return nil
+}
+
+// adminSetup checks the admin policy, must be called after settingsSetup()
+func adminSetup() {
+	for _, rule := range strings.Split(adminAllow, ",") {
+		rule = strings.TrimSpace(rule)
+		if err := adminCheckRule(rule); err != nil {
+			log.Warning("[Admin] %s", err)
+		}
+		if rule == "token" && adminToken == "" {
+			log.Debug("[Admin] Token authentication allowed but no token is set")
+		}
+	}
+	log.Debug("[Admin] Admin methods allowed for: %s", adminAllow)
+}
+
+// isAdminMethod returns true if the method of the cellaserv service requires admin rights
+func isAdminMethod(method string) bool {
+	return adminMethods[strings.Replace(method, "_", "-", -1)]
+}
+
+// connIsAdmin returns true if the admin policy allows the connection to call admin methods
+func connIsAdmin(conn net.Conn) bool {
+	var ip net.IP
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		ip = net.ParseIP(host)
+	}
+
+	for _, rule := range strings.Split(adminAllow, ",") {
+		rule = strings.TrimSpace(rule)
+		switch rule {
+		case "all":
+			return true
+		case "none":
+		case "local":
+			if ip != nil && ip.IsLoopback() {
+				return true
+			}
+		case "unix":
+			if conn.LocalAddr().Network() == "unix" {
+				return true
+			}
+		case "token":
+			if connAdmins[conn] {
+				return true
+			}
+		default:
+			if ip == nil {
+				continue
+			}
+			if _, ipNet, err := net.ParseCIDR(rule); err == nil {
+				if ipNet.Contains(ip) {
+					return true
+				}
+			} else if ip.Equal(net.ParseIP(rule)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleAuthenticate gives admin rights to the connection if it knows the admin token
+func handleAuthenticate(conn net.Conn, req *cellaserv.Request) {
+	var data struct {
+		Token string
+	}
+
+	if err := json.Unmarshal(req.Data, &data); err != nil {
+		log.Warning("[Admin] Could not unmarshal authenticate: %s, %s", req.Data, err)
+		sendReplyError(conn, req, cellaserv.Reply_Error_BadArguments)
+		return
+	}
+
+	if adminToken == "" ||
+		subtle.ConstantTimeCompare([]byte(data.Token), []byte(adminToken)) != 1 {
+		log.Warning("[Admin] Authentication failed for %s", connDescribe(conn))
+		sendReplyCustomError(conn, req, "authentication failed")
+		return
+	}
+
+	log.Info("[Admin] %s is authenticated as admin", connDescribe(conn))
+	connAdmins[conn] = true
+
+	sendReply(conn, req, nil)
+}
+
+// vim: set nowrap tw=100 noet sw=8:
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// A connection with the given addresses
+type testAddrConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *testAddrConn) LocalAddr() net.Addr  { return c.local }
+func (c *testAddrConn) RemoteAddr() net.Addr { return c.remote }
+
+// testTCPConn returns a TCP connection from the address
+func testTCPConn(t *testing.T, addr string) net.Conn {
+	remote, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testAddrConn{local: &net.TCPAddr{Port: 4200}, remote: remote}
+}
+
+func TestAdminCheckRule(t *testing.T) {
+	tests := []struct {
+		rule    string
+		wantErr bool
+	}{
+		{"all", false},
+		{"none", false},
+		{"local", false},
+		{"unix", false},
+		{"token", false},
+		{"10.0.0.0/8", false},
+		{"fd00::/8", false},
+		{"192.168.1.5", false},
+		{"::1", false},
+		{"", true},
+		{"localhost", true},
+		{"Local", true},
+		{"10.0.0.0/33", true},
+		{"192.168.1.256", true},
+	}
+	for _, test := range tests {
+		err := adminCheckRule(test.rule)
+		if (err != nil) != test.wantErr {
+			t.Errorf("adminCheckRule(%q) = %v, want error %t", test.rule, err, test.wantErr)
+		}
+		if err != nil && !strings.Contains(err.Error(), "Unknown admin rule") {
+			t.Errorf("adminCheckRule(%q) = %q", test.rule, err)
+		}
+	}
+}
+
+func TestConnIsAdmin(t *testing.T) {
+	defer func(allow string) { adminAllow = allow }(adminAllow)
+	connAdmins = make(map[net.Conn]bool)
+	defer func() { connAdmins = nil }()
+
+	loopback := testTCPConn(t, "127.0.0.1:5000")
+	loopback6 := testTCPConn(t, "[::1]:5000")
+	lan := testTCPConn(t, "10.1.2.3:5000")
+	robot := testTCPConn(t, "192.168.1.5:5000")
+	other := testTCPConn(t, "192.168.1.6:5000")
+	unix := &testAddrConn{
+		local:  &net.UnixAddr{Name: "/run/cellaserv.sock", Net: "unix"},
+		remote: &net.UnixAddr{Name: "@", Net: "unix"},
+	}
+	authenticated := testTCPConn(t, "10.9.9.9:5000")
+	connAdmins[authenticated] = true
+
+	tests := []struct {
+		allow string
+		conn  net.Conn
+		want  bool
+	}{
+		{"all", lan, true},
+		{"all", unix, true},
+		{"none", loopback, false},
+		{"none", authenticated, false},
+
+		{"local", loopback, true},
+		{"local", loopback6, true},
+		{"local", lan, false},
+		{"local", unix, false},
+
+		{"unix", unix, true},
+		{"unix", loopback, false},
+
+		{"token", authenticated, true},
+		{"token", lan, false},
+		{"token", loopback, false},
+
+		{"10.0.0.0/8", lan, true},
+		{"10.0.0.0/8", robot, false},
+		{"10.0.0.0/8", unix, false},
+		{"192.168.1.5", robot, true},
+		{"192.168.1.5", other, false},
+		{"192.168.1.5", unix, false},
+
+		// The connection is admin if any rule allows it
+		{"local,unix,token", loopback, true},
+		{"local,unix,token", unix, true},
+		{"local,unix,token", authenticated, true},
+		{"local,unix,token", lan, false},
+		{" local , 192.168.1.5 ", robot, true},
+		{"none,192.168.1.5", robot, true},
+
+		// Unknown rules allow nothing
+		{"localhost", loopback, false},
+		{"10.0.0.0/33", lan, false},
+		{"", loopback, false},
+	}
+	for _, test := range tests {
+		adminAllow = test.allow
+		if got := connIsAdmin(test.conn); got != test.want {
+			t.Errorf("connIsAdmin(%s) with %q = %t, want %t",
+				test.conn.RemoteAddr(), test.allow, got, test.want)
+		}
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
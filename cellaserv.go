@@ -3,13 +3,15 @@ package main
 import (
 	"bitbucket.org/evolutek/cellaserv2-protobuf"
 	"github.com/golang/protobuf/proto"
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net"
-	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 const (
@@ -24,7 +26,10 @@ const (
 	logNewConnection   = "log.cellaserv.new-connection"
 	logNewService      = "log.cellaserv.new-service"
 	logNewSubscriber   = "log.cellaserv.new-subscriber"
+	logLogPruned       = "log.cellaserv.log-pruned"
 	logNewLogSession   = "log.cellaserv.new-log-session"
+	logShutdown        = "log.cellaserv.shutdown"
+	logSubscribeError  = "log.cellaserv.subscribe-error"
 )
 
 // Send conn data as this struct
@@ -52,6 +57,7 @@ func handleDescribeConn(conn net.Conn, req *cellaserv.Request) {
 
 	connNameMap[conn] = data.Name
 	newName := connDescribe(conn)
+	logSessionAddClient(conn)
 
 	pub_json, _ := json.Marshal(connNameJSON{conn.RemoteAddr().String(), newName})
 	cellaservPublish(logConnRename, pub_json)
@@ -108,8 +114,10 @@ func handleListEvents(conn net.Conn, req *cellaserv.Request) {
 		}
 	}
 
+	pubsubMtx.Lock()
 	fillMap(subscriberMap)
 	fillMap(subscriberMatchMap)
+	pubsubMtx.Unlock()
 
 	data, err := json.Marshal(events)
 	if err != nil {
@@ -134,6 +142,18 @@ Reply format:
 
 	map[string]string
 
+The content of jsonl log files is replied as a list of records instead of a string, see
+logRecordJSON.
+
+The request can also be a JSON query, see logQuery and handleLogQuery:
+
+	{"Event": "robot.*", "Since": 1400000000000000000, "Tail": 10, "MaxBytes": 65536}
+
+Reply format:
+
+	{"Records": [...], "Cursor": "..."}
+
+If Cursor is set, send the same query with this cursor to get the next records.
 */
 func handleGetLogs(conn net.Conn, req *cellaserv.Request) {
 	if req.Data == nil {
@@ -142,22 +162,31 @@ func handleGetLogs(conn net.Conn, req *cellaserv.Request) {
 		return
 	}
 
+	if bytes.HasPrefix(bytes.TrimSpace(req.Data), []byte("{")) {
+		handleLogQuery(conn, req)
+		return
+	}
+
 	event := string(req.Data)
-	pattern := path.Join(*logRootDirectory, logSubDir, event+".log")
+	session := logCurrentSession()
+	pattern := path.Join(*logRootDirectory, session, event)
 
-	if !strings.HasPrefix(pattern, path.Join(*logRootDirectory, logSubDir)) {
+	if !strings.HasPrefix(pattern, path.Join(*logRootDirectory, session)) {
 		log.Warning("[Cellaserv] Don't try to do directory traversal")
 		sendReplyError(conn, req, cellaserv.Reply_Error_BadArguments)
 		return
 	}
 
 	// Globbing is allowed
-	filenames, err := filepath.Glob(pattern)
-
-	if err != nil {
-		log.Warning("[Cellaserv] Invalid log globbing : %s, %s", event, err)
-		sendReplyError(conn, req, cellaserv.Reply_Error_BadArguments)
-		return
+	var filenames []string
+	for _, ext := range []string{".log", ".jsonl"} {
+		matches, err := filepath.Glob(pattern + ext)
+		if err != nil {
+			log.Warning("[Cellaserv] Invalid log globbing : %s, %s", event, err)
+			sendReplyError(conn, req, cellaserv.Reply_Error_BadArguments)
+			return
+		}
+		filenames = append(filenames, matches...)
 	}
 
 	if len(filenames) == 0 {
@@ -166,9 +195,20 @@ func handleGetLogs(conn net.Conn, req *cellaserv.Request) {
 		return
 	}
 
-	logs := make(map[string]string)
+	logs := make(map[string]interface{})
 
 	for _, filename := range filenames {
+		if strings.HasSuffix(filename, ".jsonl") {
+			records, err := logReadRecords(filename)
+			if err != nil {
+				log.Warning("[Cellaserv] Could not read log: %s, %s", filename, err)
+				sendReplyError(conn, req, cellaserv.Reply_Error_BadArguments)
+				return
+			}
+			logs[filename] = records
+			continue
+		}
+
 		data, err := ioutil.ReadFile(filename)
 		if err != nil {
 			log.Warning("[Cellaserv] Could not open log: %s", filename)
@@ -182,14 +222,26 @@ func handleGetLogs(conn net.Conn, req *cellaserv.Request) {
 	sendReply(conn, req, logs_json)
 }
 
-// handleLogRotate changes the current log environment
+/*
+handleLogRotate changes the current log environment
+
+Request format:
+
+	{"Where": "name"}
+	{"Match": 3, "Label": "final"}
+
+Where is the name of the new session. Without Where, the session is named after the current time
+followed by the match number and the label, if given.
+*/
 func handleLogRotate(conn net.Conn, req *cellaserv.Request) {
 	// Default to time
 	if req.Data == nil {
-		logRotateTimeNow()
+		logRotateTimeNow("")
 	} else {
 		var data struct {
 			Where string
+			Match int
+			Label string
 		}
 
 		err := json.Unmarshal(req.Data, &data)
@@ -198,7 +250,31 @@ func handleLogRotate(conn net.Conn, req *cellaserv.Request) {
 			sendReplyError(conn, req, cellaserv.Reply_Error_BadArguments)
 			return
 		}
-		logRotateName(data.Where)
+
+		if data.Where != "" {
+			where, err := logSanitizeName(data.Where)
+			if err != nil {
+				log.Warning("[Cellaserv] Could not rotate log: %s", err)
+				sendReplyError(conn, req, cellaserv.Reply_Error_BadArguments)
+				return
+			}
+			logRotateName(where)
+		} else {
+			var labels []string
+			if data.Match > 0 {
+				labels = append(labels, fmt.Sprintf("match%d", data.Match))
+			}
+			if data.Label != "" {
+				label, err := logSanitizeName(data.Label)
+				if err != nil {
+					log.Warning("[Cellaserv] Could not rotate log: %s", err)
+					sendReplyError(conn, req, cellaserv.Reply_Error_BadArguments)
+					return
+				}
+				labels = append(labels, label)
+			}
+			logRotateTimeNow(strings.Join(labels, "-"))
+		}
 	}
 
 	sendReply(conn, req, nil)
@@ -206,7 +282,7 @@ func handleLogRotate(conn net.Conn, req *cellaserv.Request) {
 
 // handleSession returns the current log sesion
 func handleSession(conn net.Conn, req *cellaserv.Request) {
-	data, err := json.Marshal(logSubDir)
+	data, err := json.Marshal(logCurrentSession())
 	if err != nil {
 		log.Warning("[Cellaserv] Could not marshall log session, json error: %s", err)
 		sendReplyError(conn, req, cellaserv.Reply_Error_BadArguments)
@@ -215,10 +291,19 @@ func handleSession(conn net.Conn, req *cellaserv.Request) {
 	sendReply(conn, req, data)
 }
 
-// handleShutdown quits cellaserv. Used for debug purposes
-func handleShutdown() {
-	stopProfiling()
-	os.Exit(0)
+// handleShutdown replies to the caller then quits cellaserv. Used for debug purposes
+func handleShutdown(conn net.Conn, req *cellaserv.Request) {
+	log.Info("[Cellaserv] Shutdown requested by %s", connDescribe(conn))
+	sendReply(conn, req, nil)
+
+	// The reply may be queued behind messages written by another goroutine, wait for it to be
+	// written before the connection is closed
+	if !waitMessages(conn, time.Now().Add(*shutdownTimeout)) {
+		log.Warning("[Cellaserv] Could not send the shutdown reply to %s", connDescribe(conn))
+	}
+
+	// shutdown() waits for the connection handlers to return, including this one
+	go shutdown("requested by " + connDescribe(conn))
 }
 
 // handleSpy registers the connection as a spy of a service
@@ -264,25 +349,49 @@ func handleVersion(conn net.Conn, req *cellaserv.Request) {
 }
 
 func cellaservRequest(conn net.Conn, req *cellaserv.Request) {
+	if isAdminMethod(*req.Method) && !connIsAdmin(conn) {
+		log.Warning("[Cellaserv] %s is not allowed to call %s", connDescribe(conn), *req.Method)
+		sendReplyCustomError(conn, req, "permission denied")
+		return
+	}
+
 	switch *req.Method {
+	case "authenticate":
+		handleAuthenticate(conn, req)
 	case "describe-conn", "describe_conn":
 		handleDescribeConn(conn, req)
 	case "get-logs", "get_logs":
 		handleGetLogs(conn, req)
+	case "archive-session", "archive_session":
+		handleArchiveSession(conn, req)
+	case "delete-session", "delete_session":
+		handleDeleteSession(conn, req)
+	case "dump-start", "dump_start":
+		handleDumpStart(conn, req)
+	case "dump-stop", "dump_stop":
+		handleDumpStop(conn, req)
+	case "get-retained", "get_retained":
+		handleGetRetained(conn, req)
 	case "list-connections", "list_connections":
 		handleListConnections(conn, req)
 	case "list-events", "list_events":
 		handleListEvents(conn, req)
 	case "list-services", "list_services":
 		handleListServices(conn, req)
+	case "list-sessions", "list_sessions":
+		handleListSessions(conn, req)
 	case "log-rotate", "log_rotate":
 		handleLogRotate(conn, req)
 	case "session":
 		handleSession(conn, req)
 	case "shutdown":
-		handleShutdown()
+		handleShutdown(conn, req)
+	case "subscribe":
+		handleSubscribeRequest(conn, req)
 	case "spy":
 		handleSpy(conn, req)
+	case "stats":
+		handleStats(conn, req)
 	case "version":
 		handleVersion(conn, req)
 	default:
@@ -291,13 +400,9 @@ func cellaservRequest(conn net.Conn, req *cellaserv.Request) {
 }
 
 // cellaservLog logs a publish message to a file
-func cellaservLog(pub *cellaserv.Publish) {
-	var data string
-	if pub.Data != nil {
-		data = string(pub.Data)
-	}
+func cellaservLog(publisher string, pub *cellaserv.Publish) {
 	event := (*pub.Event)[4:] // Strip 'log.'
-	logEvent(event, data)
+	logEvent(event, publisher, pub)
 }
 
 // cellaservPublish sends a publish message from cellaserv
@@ -319,7 +424,7 @@ func cellaservPublish(event string, data []byte) {
 		return
 	}
 
-	doPublish(msgBytes, pub)
+	doPublish("cellaserv", msgBytes, pub)
 }
 
 // vim: set nowrap tw=100 noet sw=8:
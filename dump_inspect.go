@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// A message of a dump, decoded
+type dumpFrameJSON struct {
+	Time time.Time
+	// Address and name of the client
+	Conn string
+	Name string `json:",omitempty"`
+	// "in" if the message was sent by the client to cellaserv, "out" otherwise
+	Direction string
+	Type      string
+	// Service and Method of requests, and of replies when their request is in the dump
+	Service        string  `json:",omitempty"`
+	Identification string  `json:",omitempty"`
+	Method         string  `json:",omitempty"`
+	Event          string  `json:",omitempty"`
+	Id             *uint64 `json:",omitempty"`
+	// Data if it is valid JSON, DataBase64 otherwise
+	Data       json.RawMessage `json:",omitempty"`
+	DataBase64 []byte          `json:",omitempty"`
+	Error      *dumpErrorJSON  `json:",omitempty"`
+	// Stamp of the publishes sent to the subscribers asking for it
+	Seq       uint64 `json:",omitempty"`
+	Publisher string `json:",omitempty"`
+	// Filter of the subscribes
+	Filter string `json:",omitempty"`
+
+	// Size of the encoded message
+	size int
+}
+
+type dumpErrorJSON struct {
+	Type string
+	What string `json:",omitempty"`
+}
+
+// dumpDecoder decodes the messages of a dump, in order
+type dumpDecoder struct {
+	// Requests by ID, to find the service and method of the replies
+	requests map[uint64]*dumpFrameJSON
+}
+
+func newDumpDecoder() *dumpDecoder {
+	return &dumpDecoder{requests: make(map[uint64]*dumpFrameJSON)}
+}
+
+func (dec *dumpDecoder) decode(rec *dumpRecord) (*dumpFrameJSON, error) {
+	frame := &dumpFrameJSON{Time: rec.Time, Conn: rec.Conn, Direction: "out", size: len(rec.Msg)}
+	if rec.Name != rec.Conn {
+		frame.Name = rec.Name
+	}
+	if rec.Incoming {
+		frame.Direction = "in"
+	}
+
+	msg := &cellaserv.Message{}
+	if err := proto.Unmarshal(rec.Msg, msg); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal message: %s", err)
+	}
+	frame.Type = msg.GetType().String()
+
+	var err error
+	switch msg.GetType() {
+	case cellaserv.Message_Register:
+		register := &cellaserv.Register{}
+		if err = proto.Unmarshal(msg.Content, register); err == nil {
+			frame.Service = register.GetName()
+			frame.Identification = register.GetIdentification()
+		}
+	case cellaserv.Message_Request:
+		req := &cellaserv.Request{}
+		if err = proto.Unmarshal(msg.Content, req); err == nil {
+			frame.Service = req.GetServiceName()
+			frame.Identification = req.GetServiceIdentification()
+			frame.Method = req.GetMethod()
+			frame.Id = req.Id
+			frame.Data, frame.DataBase64 = jsonOrBytes(req.Data)
+			dec.requests[req.GetId()] = frame
+		}
+	case cellaserv.Message_Reply:
+		rep := &cellaserv.Reply{}
+		if err = proto.Unmarshal(msg.Content, rep); err == nil {
+			frame.Id = rep.Id
+			frame.Data, frame.DataBase64 = jsonOrBytes(rep.Data)
+			if rep.Error != nil {
+				frame.Error = &dumpErrorJSON{rep.Error.GetType().String(), rep.Error.GetWhat()}
+			}
+			if req, ok := dec.requests[rep.GetId()]; ok {
+				frame.Service = req.Service
+				frame.Identification = req.Identification
+				frame.Method = req.Method
+			}
+		}
+	case cellaserv.Message_Subscribe:
+		sub := &cellaserv.Subscribe{}
+		if err = proto.Unmarshal(msg.Content, sub); err == nil {
+			frame.Event = sub.GetEvent()
+			if exts, _, err := extSplit(msg.Content); err == nil {
+				frame.Filter = string(exts[extFilter])
+			}
+		}
+	case cellaserv.Message_Publish:
+		pub := &cellaserv.Publish{}
+		if err = proto.Unmarshal(msg.Content, pub); err == nil {
+			frame.Event = pub.GetEvent()
+			frame.Data, frame.DataBase64 = jsonOrBytes(pub.Data)
+			if exts, _, err := extSplit(msg.Content); err == nil {
+				if seq, n := binary.Uvarint(exts[extSeq]); n > 0 {
+					frame.Seq = seq
+				}
+				frame.Publisher = string(exts[extPublisher])
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not unmarshal %s: %s", frame.Type, err)
+	}
+
+	return frame, nil
+}
+
+func (frame *dumpFrameJSON) id() uint64 {
+	if frame.Id == nil {
+		return 0
+	}
+	return *frame.Id
+}
+
+// String formats the frame on one line
+func (frame *dumpFrameJSON) String() string {
+	client := frame.Conn
+	if frame.Name != "" {
+		client += " (" + frame.Name + ")"
+	}
+	line := frame.Time.Format("15:04:05.000000") + " "
+	if frame.Direction == "in" {
+		line += client + " -> cellaserv"
+	} else {
+		line += "cellaserv -> " + client
+	}
+	line += " " + frame.Type
+
+	service := frame.Service
+	if frame.Identification != "" {
+		service += "[" + frame.Identification + "]"
+	}
+	switch frame.Type {
+	case "Register":
+		line += " " + service
+	case "Request":
+		line += fmt.Sprintf(" %s.%s id:%d", service, frame.Method, frame.id())
+	case "Reply":
+		line += fmt.Sprintf(" id:%d", frame.id())
+		if frame.Method != "" {
+			line += fmt.Sprintf(" (%s.%s)", service, frame.Method)
+		}
+	case "Subscribe", "Publish":
+		line += " " + frame.Event
+		if frame.Seq != 0 {
+			line += fmt.Sprintf(" seq:%d from:%s", frame.Seq, frame.Publisher)
+		}
+		if frame.Filter != "" {
+			line += fmt.Sprintf(" filter:%q", frame.Filter)
+		}
+	}
+
+	if frame.Error != nil {
+		line += " error:" + frame.Error.Type
+		if frame.Error.What != "" {
+			line += " " + frame.Error.What
+		}
+	}
+	if frame.Data != nil {
+		line += " " + string(frame.Data)
+	} else if frame.DataBase64 != nil {
+		line += fmt.Sprintf(" %q", frame.DataBase64)
+	}
+	return line
+}
+
+// Filters of dump inspect, empty fields match everything
+type dumpInspectFilter struct {
+	Service string
+	Method  string
+	// Glob of the events
+	Event string
+	// Address or name of the client
+	Conn string
+	// Time window, resolved at the first frame
+	since, until string
+	start, end   time.Time
+}
+
+/*
+parseInspectTime parses a time given to -since and -until. It is either a duration from first, the
+time of the first frame, a time of the day of first as 15:04:05, or a RFC 3339 time.
+*/
+func parseInspectTime(s string, first time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return first.Add(d), nil
+	}
+	if t, err := time.ParseInLocation("15:04:05", s, first.Location()); err == nil {
+		y, m, d := first.Date()
+		return time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), 0, first.Location()), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid time: %q", s)
+}
+
+// addFlags adds the flags setting the filter to flags
+func (f *dumpInspectFilter) addFlags(flags *flag.FlagSet) {
+	flags.StringVar(&f.Service, "service", "", "only keep the messages of SERVICE")
+	flags.StringVar(&f.Method, "method", "", "only keep the requests and replies of METHOD")
+	flags.StringVar(&f.Event, "event", "", "only keep the events matching the glob EVENT")
+	flags.StringVar(&f.Conn, "conn", "", "only keep the messages of the client with "+
+		"address or name CONN")
+	flags.StringVar(&f.since, "since", "", "only keep the messages after TIME: a duration "+
+		"from the first message, 15:04:05 or RFC 3339")
+	flags.StringVar(&f.until, "until", "", "only keep the messages before TIME")
+}
+
+// check returns an error if the values of the flags are invalid
+func (f *dumpInspectFilter) check() error {
+	for _, t := range []string{f.since, f.until} {
+		if t == "" {
+			continue
+		}
+		if _, err := parseInspectTime(t, time.Now()); err != nil {
+			return err
+		}
+	}
+	if _, err := filepath.Match(f.Event, ""); err != nil {
+		return fmt.Errorf("Invalid event glob: %q", f.Event)
+	}
+	return nil
+}
+
+func (f *dumpInspectFilter) match(frame *dumpFrameJSON) bool {
+	if f.start.IsZero() && f.end.IsZero() && (f.since != "" || f.until != "") {
+		// First frame, times cannot fail, they were checked before reading
+		if f.since != "" {
+			f.start, _ = parseInspectTime(f.since, frame.Time)
+		}
+		if f.until != "" {
+			f.end, _ = parseInspectTime(f.until, frame.Time)
+		}
+	}
+
+	if f.Service != "" && frame.Service != f.Service {
+		return false
+	}
+	if f.Method != "" && frame.Method != f.Method {
+		return false
+	}
+	if f.Event != "" {
+		if matched, _ := filepath.Match(f.Event, frame.Event); !matched {
+			return false
+		}
+	}
+	if f.Conn != "" && frame.Conn != f.Conn && frame.Name != f.Conn {
+		return false
+	}
+	if !f.start.IsZero() && frame.Time.Before(f.start) {
+		return false
+	}
+	if !f.end.IsZero() && frame.Time.After(f.end) {
+		return false
+	}
+	return true
+}
+
+// Summary of a dump
+type dumpMethodStatsJSON struct {
+	Requests   int
+	Replies    int
+	Errors     int
+	Unanswered int
+	// Latencies between the request and the reply seen by the client, in seconds
+	MeanLatency float64
+	MaxLatency  float64
+
+	latencySum time.Duration
+	latencyMax time.Duration
+}
+
+type dumpTalkerJSON struct {
+	Conn        string
+	Name        string `json:",omitempty"`
+	MessagesIn  int
+	MessagesOut int
+	BytesIn     int
+	BytesOut    int
+}
+
+type dumpStatsJSON struct {
+	Frames  int
+	Start   time.Time
+	End     time.Time
+	Types   map[string]int
+	Methods map[string]*dumpMethodStatsJSON
+	Events  map[string]int
+	// Clients sorted by bytes exchanged
+	Talkers []*dumpTalkerJSON
+
+	talkers map[string]*dumpTalkerJSON
+	// Requests waiting for their reply, by ID
+	pending map[uint64]*dumpFrameJSON
+}
+
+func newDumpStats() *dumpStatsJSON {
+	return &dumpStatsJSON{
+		Types:   make(map[string]int),
+		Methods: make(map[string]*dumpMethodStatsJSON),
+		Events:  make(map[string]int),
+		talkers: make(map[string]*dumpTalkerJSON),
+		pending: make(map[uint64]*dumpFrameJSON),
+	}
+}
+
+func (stats *dumpStatsJSON) method(frame *dumpFrameJSON) *dumpMethodStatsJSON {
+	key := frame.Service + "." + frame.Method
+	if frame.Identification != "" {
+		key = frame.Service + "[" + frame.Identification + "]." + frame.Method
+	}
+	m, ok := stats.Methods[key]
+	if !ok {
+		m = &dumpMethodStatsJSON{}
+		stats.Methods[key] = m
+	}
+	return m
+}
+
+func (stats *dumpStatsJSON) add(frame *dumpFrameJSON) {
+	if stats.Frames == 0 {
+		stats.Start = frame.Time
+	}
+	stats.Frames++
+	stats.End = frame.Time
+	stats.Types[frame.Type]++
+
+	talker, ok := stats.talkers[frame.Conn]
+	if !ok {
+		talker = &dumpTalkerJSON{Conn: frame.Conn}
+		stats.talkers[frame.Conn] = talker
+	}
+	if frame.Name != "" {
+		talker.Name = frame.Name
+	}
+	if frame.Direction == "in" {
+		talker.MessagesIn++
+		talker.BytesIn += frame.size
+	} else {
+		talker.MessagesOut++
+		talker.BytesOut += frame.size
+	}
+
+	// Pair the requests of the clients with the replies sent back to them
+	switch {
+	case frame.Type == "Request" && frame.Direction == "in":
+		stats.method(frame).Requests++
+		stats.pending[frame.id()] = frame
+	case frame.Type == "Reply" && frame.Direction == "out":
+		req, ok := stats.pending[frame.id()]
+		if !ok || req.Conn != frame.Conn {
+			break
+		}
+		delete(stats.pending, frame.id())
+
+		m := stats.method(req)
+		m.Replies++
+		if frame.Error != nil {
+			m.Errors++
+		}
+		latency := frame.Time.Sub(req.Time)
+		m.latencySum += latency
+		if latency > m.latencyMax {
+			m.latencyMax = latency
+		}
+	case frame.Type == "Publish" && frame.Direction == "in":
+		stats.Events[frame.Event]++
+	}
+}
+
+// finish computes the summary once all the frames are added, keeping the top talkers
+func (stats *dumpStatsJSON) finish(top int) {
+	for _, m := range stats.Methods {
+		m.Unanswered = m.Requests - m.Replies
+		if m.Replies > 0 {
+			m.MeanLatency = (m.latencySum / time.Duration(m.Replies)).Seconds()
+		}
+		m.MaxLatency = m.latencyMax.Seconds()
+	}
+
+	stats.Talkers = make([]*dumpTalkerJSON, 0, len(stats.talkers))
+	for _, talker := range stats.talkers {
+		stats.Talkers = append(stats.Talkers, talker)
+	}
+	sort.Slice(stats.Talkers, func(i, j int) bool {
+		a, b := stats.Talkers[i], stats.Talkers[j]
+		return a.BytesIn+a.BytesOut > b.BytesIn+b.BytesOut
+	})
+	if top > 0 && len(stats.Talkers) > top {
+		stats.Talkers = stats.Talkers[:top]
+	}
+}
+
+func sortedCountKeys(m map[string]int) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (stats *dumpStatsJSON) write(w io.Writer) {
+	fmt.Fprintf(w, "%d frames", stats.Frames)
+	if stats.Frames > 0 {
+		fmt.Fprintf(w, " from %s to %s (%s)", stats.Start.Format(time.RFC3339Nano),
+			stats.End.Format(time.RFC3339Nano), stats.End.Sub(stats.Start))
+	}
+	fmt.Fprintln(w)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "\nMessages\tCount")
+	for _, t := range sortedCountKeys(stats.Types) {
+		fmt.Fprintf(tw, "%s\t%d\n", t, stats.Types[t])
+	}
+
+	fmt.Fprintln(tw, "\nRequests\tCount\tReplies\tErrors\tUnanswered\tMean latency\tMax latency")
+	var methods []string
+	for k := range stats.Methods {
+		methods = append(methods, k)
+	}
+	sort.Strings(methods)
+	for _, k := range methods {
+		m := stats.Methods[k]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%.3fms\t%.3fms\n", k, m.Requests, m.Replies,
+			m.Errors, m.Unanswered, m.MeanLatency*1000, m.MaxLatency*1000)
+	}
+
+	fmt.Fprintln(tw, "\nEvents\tPublishes")
+	for _, e := range sortedCountKeys(stats.Events) {
+		fmt.Fprintf(tw, "%s\t%d\n", e, stats.Events[e])
+	}
+
+	fmt.Fprintln(tw, "\nClients\tName\tMessages in\tBytes in\tMessages out\tBytes out")
+	for _, t := range stats.Talkers {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\n", t.Conn, t.Name, t.MessagesIn, t.BytesIn,
+			t.MessagesOut, t.BytesOut)
+	}
+	tw.Flush()
+}
+
+// dumpInspect prints the messages of a dump, or a summary of them
+func dumpInspect(args []string) int {
+	flags := flag.NewFlagSet("dump inspect", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cellaserv2 dump inspect [flags] FILE")
+		flags.PrintDefaults()
+	}
+	var filter dumpInspectFilter
+	filter.addFlags(flags)
+	jsonFlag := flags.Bool("json", false, "print JSON lines")
+	statsFlag := flags.Bool("stats", false, "print a summary instead of the messages")
+	topFlag := flags.Int("top", 10, "number of clients in the summary, 0 for all")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	if err := filter.check(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	dec := newDumpDecoder()
+	stats := newDumpStats()
+	encoder := json.NewEncoder(os.Stdout)
+
+	err := dumpReadFile(flags.Arg(0), func(rec *dumpRecord) error {
+		frame, err := dec.decode(rec)
+		if err != nil {
+			return err
+		}
+		if !filter.match(frame) {
+			if !filter.end.IsZero() && frame.Time.After(filter.end) {
+				return errDumpStop
+			}
+			return nil
+		}
+
+		if *statsFlag {
+			stats.add(frame)
+		} else if *jsonFlag {
+			return encoder.Encode(frame)
+		} else {
+			fmt.Println(frame)
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *statsFlag {
+		stats.finish(*topFlag)
+		if *jsonFlag {
+			encoder.Encode(stats)
+		} else {
+			stats.write(os.Stdout)
+		}
+	}
+	return 0
+}
+
+// dumpCommand runs the dump subcommands
+func dumpCommand(args []string) int {
+	if len(args) > 0 && args[0] == "inspect" {
+		return dumpInspect(args[1:])
+	}
+	if len(args) > 1 && args[0] == "relink" {
+		return dumpRelink(args[1:])
+	}
+	fmt.Fprintln(os.Stderr, "usage: cellaserv2 dump inspect [flags] FILE")
+	fmt.Fprintln(os.Stderr, "       cellaserv2 dump relink FILE...")
+	return 2
+}
+
+// dumpRelink converts pcap dumps written by older versions so that Wireshark can open them
+func dumpRelink(filenames []string) int {
+	status := 0
+	for _, filename := range filenames {
+		changed, err := dumpRelinkFile(filename)
+		switch {
+		case err != nil:
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		case changed:
+			fmt.Printf("%s: link type changed from %d to %d\n", filename,
+				dumpPcapLinkTypeLegacy, dumpPcapLinkType)
+		default:
+			fmt.Printf("%s: already uses link type %d\n", filename, dumpPcapLinkType)
+		}
+	}
+	return status
+}
+
+// vim: set nowrap tw=100 noet sw=8:
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A message of the inspect fixture, sent at a time after the start of the dump
+type testInspectMessage struct {
+	conn     string
+	at       time.Duration
+	msg      []byte
+	incoming bool
+}
+
+// testInspectStart is the time of the first message of the fixture
+var testInspectStart = time.Date(2020, 1, 2, 15, 4, 5, 0, time.Local)
+
+/*
+testInspectMessages returns the messages of the fixture: a client calls date.time three times
+through cellaserv, the second reply is an error and the third request is not answered. A request
+to the other service is answered to another client. Then the client publishes an event to a
+subscriber.
+*/
+func testInspectMessages(t *testing.T) []testInspectMessage {
+	client, service, listener := "127.0.0.1:40001", "127.0.0.1:40002", "127.0.0.1:40003"
+	date, other, method := "date", "other", "time"
+	request := func(name string, id uint64) []byte {
+		return testMessage(t, cellaserv.Message_Request,
+			&cellaserv.Request{ServiceName: &name, Method: &method, Id: &id})
+	}
+	reply := func(id uint64, err *cellaserv.Reply_Error) []byte {
+		return testMessage(t, cellaserv.Message_Reply,
+			&cellaserv.Reply{Id: &id, Error: err})
+	}
+	event, end := "match.start", "match.end"
+	publish := testMessage(t, cellaserv.Message_Publish, &cellaserv.Publish{Event: &event})
+	subscribe := testMessage(t, cellaserv.Message_Subscribe, &cellaserv.Subscribe{Event: &end})
+	errType := cellaserv.Reply_Error_Timeout
+	ms := time.Millisecond
+
+	return []testInspectMessage{
+		{service, 0, testMessage(t, cellaserv.Message_Register,
+			&cellaserv.Register{Name: &date}), true},
+		{client, 1 * ms, request(date, 1), true},
+		{service, 2 * ms, request(date, 1), false},
+		{service, 5 * ms, reply(1, nil), true},
+		{client, 6 * ms, reply(1, nil), false},
+		{client, 10 * ms, request(date, 2), true},
+		{service, 11 * ms, request(date, 2), false},
+		{service, 24 * ms, reply(2, &cellaserv.Reply_Error{Type: &errType}), true},
+		{client, 25 * ms, reply(2, &cellaserv.Reply_Error{Type: &errType}), false},
+		{client, 30 * ms, request(date, 3), true},
+		{client, 31 * ms, request(other, 4), true},
+		{listener, 32 * ms, reply(4, nil), false},
+		{listener, 35 * ms, subscribe, true},
+		{client, 40 * ms, publish, true},
+		{listener, 41 * ms, publish, false},
+	}
+}
+
+// testWritePcapng writes the messages to a pcapng dump, with their times
+func testWritePcapng(t *testing.T, messages []testInspectMessage) string {
+	filename := filepath.Join(t.TempDir(), "fixture.pcapng")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+	d := &dumper{file: w, interfaces: make(map[string]uint32)}
+
+	pcapngWriteSectionHeader(w)
+	for _, m := range messages {
+		id, _ := d.pcapngInterface(&testConn{addr: m.conn})
+		flags := uint32(pcapngFlagOutbound)
+		if m.incoming {
+			flags = pcapngFlagInbound
+		}
+		ts := uint64(testInspectStart.Add(m.at).UnixNano())
+
+		var body []byte
+		body = pcapngAppend32(body, id)
+		body = pcapngAppend32(body, uint32(ts>>32))
+		body = pcapngAppend32(body, uint32(ts))
+		body = pcapngAppend32(body, uint32(len(m.msg)))
+		body = pcapngAppend32(body, uint32(len(m.msg)))
+		body = pcapngPad(append(body, m.msg...))
+		body = pcapngAppendOption(body, pcapngOptEpbFlags, pcapngAppend32(nil, flags))
+		body = pcapngAppendOption(body, pcapngOptEnd, nil)
+		pcapngWriteBlock(w, pcapngBlockEnhancedPacket, body)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// testInspect decodes the dump like dump inspect, and calls fn for each frame kept by the filter
+func testInspect(t *testing.T, filename string, filter *dumpInspectFilter,
+	fn func(*dumpFrameJSON)) {
+	dec := newDumpDecoder()
+	err := dumpReadFile(filename, func(rec *dumpRecord) error {
+		frame, err := dec.decode(rec)
+		if err != nil {
+			return err
+		}
+		if filter.match(frame) {
+			fn(frame)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDumpInspectFilter(t *testing.T) {
+	filename := testWritePcapng(t, testInspectMessages(t))
+
+	tests := []struct {
+		filter dumpInspectFilter
+		want   string
+	}{
+		{dumpInspectFilter{}, "[0 1 2 3 4 5 6 7 8 9 10 11 12 13 14]"},
+		// Replies are matched by the service and method of their request
+		{dumpInspectFilter{Service: "date"}, "[0 1 2 3 4 5 6 7 8 9]"},
+		{dumpInspectFilter{Service: "date", Method: "time"}, "[1 2 3 4 5 6 7 8 9]"},
+		{dumpInspectFilter{Method: "time"}, "[1 2 3 4 5 6 7 8 9 10 11]"},
+		{dumpInspectFilter{Event: "match.*"}, "[12 13 14]"},
+		{dumpInspectFilter{Event: "*.start"}, "[13 14]"},
+		{dumpInspectFilter{Conn: "127.0.0.1:40003"}, "[11 12 14]"},
+		{dumpInspectFilter{Service: "other", Conn: "127.0.0.1:40001"}, "[10]"},
+		// Times relative to the first frame, of the day, or absolute
+		{dumpInspectFilter{since: "30ms"}, "[9 10 11 12 13 14]"},
+		{dumpInspectFilter{until: "6ms"}, "[0 1 2 3 4]"},
+		{dumpInspectFilter{since: "10ms", until: "25ms", Service: "date"}, "[5 6 7 8]"},
+		{dumpInspectFilter{since: "15:04:06"}, "[]"},
+		{dumpInspectFilter{until: "15:04:05"}, "[0]"},
+		{dumpInspectFilter{since: testInspectStart.Add(40 * time.Millisecond).
+			Format(time.RFC3339Nano)}, "[13 14]"},
+	}
+	for _, test := range tests {
+		filter := test.filter
+		if err := filter.check(); err != nil {
+			t.Errorf("Filter %+v: %s", test.filter, err)
+			continue
+		}
+		var kept []int
+		start := testInspectStart
+		testInspect(t, filename, &filter, func(frame *dumpFrameJSON) {
+			kept = append(kept, int(frame.Time.Sub(start)/time.Millisecond))
+		})
+		// Frames are identified by their time
+		var got []int
+		messages := testInspectMessages(t)
+		for _, at := range kept {
+			for i, m := range messages {
+				if m.at == time.Duration(at)*time.Millisecond {
+					got = append(got, i)
+				}
+			}
+		}
+		if fmt.Sprint(got) != test.want {
+			t.Errorf("Filter %+v kept %v, want %s", test.filter, got, test.want)
+		}
+	}
+
+	for _, filter := range []dumpInspectFilter{{Event: "["}, {since: "yesterday"},
+		{until: "25:00:00"}} {
+		if err := filter.check(); err == nil {
+			t.Errorf("Filter %+v: no error", filter)
+		}
+	}
+}
+
+// The requests of the clients are paired with the replies sent back to them
+func TestDumpInspectStats(t *testing.T) {
+	filename := testWritePcapng(t, testInspectMessages(t))
+	stats := newDumpStats()
+	testInspect(t, filename, &dumpInspectFilter{}, stats.add)
+	stats.finish(2)
+
+	date := stats.Methods["date.time"]
+	if date == nil || date.Requests != 3 || date.Replies != 2 || date.Errors != 1 ||
+		date.Unanswered != 1 {
+		t.Fatalf("Stats of date.time %+v, want 3 requests, 2 replies, 1 error", date)
+	}
+	if date.MeanLatency != 0.010 || date.MaxLatency != 0.015 {
+		t.Errorf("Latencies of date.time: mean %g max %g, want 10ms and 15ms",
+			date.MeanLatency, date.MaxLatency)
+	}
+	// The reply to another client does not answer the request
+	other := stats.Methods["other.time"]
+	if other == nil || other.Requests != 1 || other.Replies != 0 || other.Unanswered != 1 {
+		t.Errorf("Stats of other.time %+v, want 1 unanswered request", other)
+	}
+
+	if stats.Frames != 15 || stats.End.Sub(stats.Start) != 41*time.Millisecond {
+		t.Errorf("%d frames over %s, want 15 over 41ms", stats.Frames,
+			stats.End.Sub(stats.Start))
+	}
+	if len(stats.Events) != 1 || stats.Events["match.start"] != 1 {
+		t.Errorf("Events %v, want match.start published once", stats.Events)
+	}
+	if stats.Types["Request"] != 6 || stats.Types["Reply"] != 5 {
+		t.Errorf("Types %v", stats.Types)
+	}
+	if len(stats.Talkers) != 2 || stats.Talkers[0].Conn != "127.0.0.1:40001" ||
+		stats.Talkers[0].MessagesIn != 5 || stats.Talkers[0].MessagesOut != 2 {
+		t.Errorf("Top talkers %+v, want the client first", stats.Talkers)
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
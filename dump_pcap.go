@@ -5,9 +5,13 @@ import (
 	"bufio"
 	"github.com/golang/protobuf/proto"
 	"encoding/binary"
+	"encoding/json"
 	"flag"
+	"io"
 	"net"
 	"os"
+	"path"
+	"sync"
 	"time"
 )
 
@@ -30,59 +34,468 @@ type PacketHeader struct {
 }
 
 var (
-	dumpFile     *bufio.Writer
-	dumpFileFlag = flag.String("dump-file", "", "Dump messages in FILE")
+	dumpFileFlag    = flag.String("dump-file", "", "Dump messages in FILE")
+	dumpSessionFlag = flag.Bool("dump-session", false,
+		"Dump messages in "+dumpSessionFile+".pcap[ng] in the log session directory")
+	dumpFormat = flag.String("dump-format", "pcap", "format of the dumps: pcap or pcapng")
+
+	// Protects the dumpers, messages are also sent by timers
+	dumpMtx sync.Mutex
+	// Dump of -dump-file, nil if disabled
+	dumpAll *dumper
+	// Capture started by cellaserv.dump-start, nil if none is running
+	dumpCapture *dumper
+	// Dump of the current log session, nil if disabled
+	dumpSession *dumper
+)
+
+/*
+Link type of the pcap dumps, their packets hold a cellaserv.LogMessage.
+
+LINKTYPE_USER1 is reserved for private use, so Wireshark lets wireshark/cellaserv.lua dissect it.
+Dumps written before used the unregistered dumpPcapLinkTypeLegacy.
+*/
+const (
+	dumpPcapLinkType       = 148
+	dumpPcapLinkTypeLegacy = 4200
 )
 
+// Name of the dump file of -dump-session, without extension
+const dumpSessionFile = "traffic"
+
+// Requests kept by a filtered dump are forgotten after this delay if their reply was not seen, it
+// is longer than the request timeout
+const dumpRequestExpiry = 10 * time.Second
+
+// dumpFileExt returns the extension of the dump files
+func dumpFileExt() string {
+	if *dumpFormat == "pcapng" {
+		return ".pcapng"
+	}
+	return ".pcap"
+}
+
+/*
+dumpFilter selects the messages of a capture. Empty fields match everything.
+
+A message is kept if it is sent or received on the connection Conn, and if it concerns the service
+Service or an event matching the pattern Event, a pattern of the subscriptions. When both Service
+and Event are set, matching either of them is enough.
+*/
+type dumpFilter struct {
+	// Name of the service of the Register, Request and Reply messages
+	Service string
+	// Pattern of the event of the Publish and Subscribe messages
+	Event string
+	// Address or name of the connection
+	Conn string
+
+	// Compiled Event, see compile()
+	event *topicPattern
+}
+
+// compile compiles the event pattern of the filter, it must be called before matching messages
+func (f *dumpFilter) compile() error {
+	if f.Event == "" {
+		return nil
+	}
+	pattern, err := compileTopic(f.Event)
+	if err != nil {
+		return err
+	}
+	f.event = pattern
+	return nil
+}
+
+// dumper writes messages to a pcap or pcapng file
+type dumper struct {
+	fd     *os.File
+	file   *bufio.Writer
+	filter dumpFilter
+	// Requests kept, to keep their replies
+	reqIds map[uint64]*dumpRequest
+
+	pcapng bool
+	// pcapng interface of each connection, by remote address: the connections are not kept
+	// once closed
+	interfaces map[string]uint32
+
+	packets uint64
+	bytes   uint64
+}
+
+// A request kept by a filtered dump
+type dumpRequest struct {
+	// Number of copies of the request dumped, each one is answered by a copy of the reply: the
+	// request and its reply are forwarded by cellaserv
+	copies int
+	kept   time.Time
+}
+
+// keepRequest keeps the replies of the request, and forgets the old requests without a reply
+func (d *dumper) keepRequest(id uint64) {
+	now := time.Now()
+	r, ok := d.reqIds[id]
+	if !ok {
+		for oldId, old := range d.reqIds {
+			if now.Sub(old.kept) > dumpRequestExpiry {
+				delete(d.reqIds, oldId)
+			}
+		}
+		r = &dumpRequest{}
+		d.reqIds[id] = r
+	}
+	r.copies++
+	r.kept = now
+}
+
+// keepReply returns whether the reply answers a kept request, the request is forgotten once all
+// the copies of its reply are seen
+func (d *dumper) keepReply(id uint64) bool {
+	r, ok := d.reqIds[id]
+	if !ok {
+		return false
+	}
+	r.copies--
+	if r.copies <= 0 {
+		delete(d.reqIds, id)
+	}
+	return true
+}
+
+// newDumper creates the pcap file filename, or appends to it if appendTo is true
+func newDumper(filename string, appendTo bool, filter dumpFilter) (*dumper, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendTo {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	file, err := os.OpenFile(filename, flags, 0666)
+	if err != nil {
+		return nil, err
+	}
+	d := &dumper{fd: file, file: bufio.NewWriter(file), filter: filter,
+		reqIds: make(map[uint64]*dumpRequest), pcapng: *dumpFormat == "pcapng",
+		interfaces: make(map[string]uint32)}
+
+	if d.pcapng {
+		// A pcapng file can hold several sections, each starting with its header
+		pcapngWriteSectionHeader(d.file)
+		return d, nil
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.Size() > 0 {
+		// Already has a header
+		return d, nil
+	}
+
+	// Write PCAP header
+	header := PcapHeader{0xa1b2c3d4, 2, 4, 0, 0, 65535, dumpPcapLinkType}
+	err = binary.Write(d.file, binary.LittleEndian, header)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// close flushes pending messages and closes the dump file
+func (d *dumper) close() {
+	if err := d.file.Flush(); err != nil {
+		log.Error("[Dump] Could not flush dump: %s", err)
+	}
+	d.fd.Close()
+}
+
+// matchConn returns whether the filter selects the connection
+func (f *dumpFilter) matchConn(conn net.Conn) bool {
+	if f.Conn == "" {
+		return true
+	}
+	return f.Conn == conn.RemoteAddr().String() || f.Conn == connDescribe(conn)
+}
+
+// match returns whether the filter selects the message
+func (d *dumper) match(conn net.Conn, msgBytes []byte) bool {
+	f := &d.filter
+	if !f.matchConn(conn) {
+		return false
+	}
+	if f.Service == "" && f.Event == "" {
+		return true
+	}
+
+	msg := &cellaserv.Message{}
+	if err := proto.Unmarshal(msgBytes, msg); err != nil {
+		return false
+	}
+
+	switch msg.GetType() {
+	case cellaserv.Message_Register:
+		register := &cellaserv.Register{}
+		if proto.Unmarshal(msg.Content, register) != nil {
+			return false
+		}
+		return f.Service != "" && register.GetName() == f.Service
+	case cellaserv.Message_Request:
+		req := &cellaserv.Request{}
+		if proto.Unmarshal(msg.Content, req) != nil {
+			return false
+		}
+		if f.Service != "" && req.GetServiceName() == f.Service {
+			d.keepRequest(req.GetId())
+			return true
+		}
+	case cellaserv.Message_Reply:
+		rep := &cellaserv.Reply{}
+		if proto.Unmarshal(msg.Content, rep) != nil {
+			return false
+		}
+		return d.keepReply(rep.GetId())
+	case cellaserv.Message_Publish:
+		pub := &cellaserv.Publish{}
+		if proto.Unmarshal(msg.Content, pub) != nil {
+			return false
+		}
+		return f.matchEvent(pub.GetEvent())
+	case cellaserv.Message_Subscribe:
+		sub := &cellaserv.Subscribe{}
+		if proto.Unmarshal(msg.Content, sub) != nil {
+			return false
+		}
+		return f.matchEvent(sub.GetEvent())
+	}
+	return false
+}
+
+func (f *dumpFilter) matchEvent(event string) bool {
+	return f.event != nil && f.event.match(event)
+}
+
+// dump writes the message if it is selected by the filter, incoming is true if it was received by
+// cellaserv
+func (d *dumper) dump(conn net.Conn, msgBytes []byte, incoming bool) {
+	if !d.match(conn, msgBytes) {
+		return
+	}
+
+	var n int
+	if d.pcapng {
+		n = d.pcapngWritePacket(conn, msgBytes, incoming)
+	} else {
+		addr := conn.RemoteAddr().String()
+		sender, dest := "cellaserv", addr
+		if incoming {
+			sender, dest = addr, "cellaserv"
+		}
+		logMsg := &cellaserv.LogMessage{Sender: &sender, Destination: &dest, Content: msgBytes}
+		n = dumpLogMessage(d.file, logMsg)
+	}
+	d.packets++
+	d.bytes += uint64(n)
+}
+
 func dumpSetup() error {
 	if *dumpFileFlag == "" {
 		// No dump
 		return nil
 	}
 
-	file, err := os.Create(*dumpFileFlag)
+	d, err := newDumper(*dumpFileFlag, false, dumpFilter{})
 	if err != nil {
 		return err
 	}
-	dumpFile = bufio.NewWriter(file)
+	dumpAll = d
+	return nil
+}
 
-	// Write PCAP header
-	header := PcapHeader{0xa1b2c3d4, 2, 4, 0, 0, 65535, 4200}
-	err = binary.Write(dumpFile, binary.LittleEndian, header)
+/*
+dumpSessionRotate closes the dump of the previous log session and opens the one of the current
+session. The dump is appended to if the session directory is reused.
+*/
+func dumpSessionRotate() {
+	if !*dumpSessionFlag {
+		return
+	}
+
+	dumpMtx.Lock()
+	defer dumpMtx.Unlock()
 
-	return err
+	if dumpSession != nil {
+		dumpSession.close()
+		dumpSession = nil
+	}
+
+	filename := path.Join(*logRootDirectory, logCurrentSession(), dumpSessionFile+dumpFileExt())
+	d, err := newDumper(filename, true, dumpFilter{})
+	if err != nil {
+		log.Error("[Dump] Could not open session dump: %s", err)
+		return
+	}
+	dumpSession = d
 }
 
-func dumpOutgoing(conn net.Conn, msg []byte) {
-	if dumpFile != nil {
-		sender := "cellaserv"
-		dest := conn.RemoteAddr().String()
-		logMsg := &cellaserv.LogMessage{Sender: &sender, Destination: &dest, Content: msg}
-		dumpLogMessage(logMsg)
+// dumpClose flushes pending messages and closes the dump files
+func dumpClose() {
+	dumpMtx.Lock()
+	defer dumpMtx.Unlock()
+
+	if dumpAll != nil {
+		dumpAll.close()
+		dumpAll = nil
+	}
+	if dumpCapture != nil {
+		dumpCapture.close()
+		dumpCapture = nil
+	}
+	if dumpSession != nil {
+		dumpSession.close()
+		dumpSession = nil
 	}
 }
 
+func dumpOutgoing(conn net.Conn, msg []byte) {
+	dumpMtx.Lock()
+	defer dumpMtx.Unlock()
+
+	dumpWrite(conn, msg, false)
+}
+
 func dumpIncoming(conn net.Conn, msg []byte) {
-	if dumpFile != nil {
-		addr := conn.RemoteAddr().String()
-		dest := "cellaserv"
-		logMsg := &cellaserv.LogMessage{Sender: &addr, Destination: &dest, Content: msg}
-		dumpLogMessage(logMsg)
+	dumpMtx.Lock()
+	defer dumpMtx.Unlock()
+
+	dumpWrite(conn, msg, true)
+}
+
+// dumpWrite writes the message to the active dumpers, dumpMtx must be held
+func dumpWrite(conn net.Conn, msg []byte, incoming bool) {
+	if dumpAll != nil {
+		dumpAll.dump(conn, msg, incoming)
+	}
+	if dumpCapture != nil {
+		dumpCapture.dump(conn, msg, incoming)
+	}
+	if dumpSession != nil {
+		dumpSession.dump(conn, msg, incoming)
 	}
 }
 
-func dumpLogMessage(msg *cellaserv.LogMessage) {
+// dumpLogMessage writes a packet holding msg to w and returns its size
+func dumpLogMessage(w io.Writer, msg *cellaserv.LogMessage) int {
 	msgBytes, _ := proto.Marshal(msg)
 
 	// Write PCAP packet header
 	now := time.Now()
-	// Could use nanosecond PCAP format, but unsure of actual utility, and support by tools
+	// Nanosecond timestamps are available with -dump-format pcapng
 	msgLen := uint32(len(msgBytes))
-	header := PacketHeader{uint32(now.Unix()), uint32(now.Nanosecond() * 1000), msgLen, msgLen}
-	binary.Write(dumpFile, binary.LittleEndian, header)
+	header := PacketHeader{uint32(now.Unix()), uint32(now.Nanosecond() / 1000), msgLen, msgLen}
+	binary.Write(w, binary.LittleEndian, header)
 
 	// Write actual message
-	dumpFile.Write(msgBytes)
+	w.Write(msgBytes)
+
+	return binary.Size(header) + len(msgBytes)
+}
+
+type dumpStartJSON struct {
+	dumpFilter
+	// Name of the capture file in the current log session, default to the current time
+	Name string
+}
+
+type dumpStatusJSON struct {
+	Path    string
+	Packets uint64
+	Bytes   uint64
+}
+
+/*
+handleDumpStart starts a capture in the current log session directory
+
+Request format, all fields are optional, see dumpFilter:
+
+	{"Service": "name", "Event": "pattern", "Conn": "addr or name", "Name": "capture"}
+
+Only one capture can run at a time.
+*/
+func handleDumpStart(conn net.Conn, req *cellaserv.Request) {
+	var data dumpStartJSON
+	var err error
+	if req.Data != nil {
+		if err = json.Unmarshal(req.Data, &data); err != nil {
+			log.Warning("[Dump] Could not start capture, json error: %s", err)
+			sendReplyError(conn, req, cellaserv.Reply_Error_BadArguments)
+			return
+		}
+	}
+	if err := data.dumpFilter.compile(); err != nil {
+		log.Warning("[Dump] Invalid event pattern: %s", err)
+		sendReplyError(conn, req, cellaserv.Reply_Error_BadArguments)
+		return
+	}
+
+	name := "capture-" + time.Now().Format(*logSessionFormat)
+	if data.Name != "" {
+		safe, err := logSanitizeName(data.Name)
+		if err != nil {
+			log.Warning("[Dump] Could not start capture: %s", err)
+			sendReplyError(conn, req, cellaserv.Reply_Error_BadArguments)
+			return
+		}
+		name = safe
+	}
+	if name == dumpSessionFile {
+		log.Warning("[Dump] Could not start capture, reserved name: %s", name)
+		sendReplyCustomError(conn, req, "reserved capture name: "+name)
+		return
+	}
+	filename := path.Join(*logRootDirectory, logCurrentSession(), name+dumpFileExt())
+
+	// Replying writes to the dumpers, so errors are sent after releasing the lock
+	dumpMtx.Lock()
+	running := dumpCapture
+	if running == nil {
+		dumpCapture, err = newDumper(filename, false, data.dumpFilter)
+	}
+	dumpMtx.Unlock()
+
+	if running != nil {
+		sendReplyCustomError(conn, req, "a capture is already running: "+running.fd.Name())
+		return
+	}
+	if err != nil {
+		log.Error("[Dump] Could not start capture: %s", err)
+		sendReplyCustomError(conn, req, err.Error())
+		return
+	}
+	log.Info("[Dump] Capture started in %s", filename)
+
+	reply, _ := json.Marshal(dumpStatusJSON{Path: filename})
+	sendReply(conn, req, reply)
+}
+
+// handleDumpStop stops the running capture and replies with its path and size
+func handleDumpStop(conn net.Conn, req *cellaserv.Request) {
+	dumpMtx.Lock()
+	d := dumpCapture
+	dumpCapture = nil
+	dumpMtx.Unlock()
+
+	if d == nil {
+		sendReplyCustomError(conn, req, "no capture is running")
+		return
+	}
+	d.close()
+	log.Info("[Dump] Capture stopped, %d packets in %s", d.packets, d.fd.Name())
+
+	reply, _ := json.Marshal(dumpStatusJSON{d.fd.Name(), d.packets, d.bytes})
+	sendReply(conn, req, reply)
 }
 
 // vim: set nowrap tw=100 noet sw=8:
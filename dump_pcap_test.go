@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCaptureMessages returns the messages of a service registering, of two requests forwarded to
+// it and their replies, and of publishes and a subscribe. The first request is replied twice.
+func testCaptureMessages(t *testing.T) []testDumpMessage {
+	client := &testConn{addr: "127.0.0.1:40001"}
+	service := &testConn{addr: "127.0.0.1:40002"}
+	listener := &testConn{addr: "127.0.0.1:40003"}
+
+	date, other, method := "date", "other", "time"
+	id, otherId := uint64(42), uint64(43)
+	register := testMessage(t, cellaserv.Message_Register, &cellaserv.Register{Name: &date})
+	request := testMessage(t, cellaserv.Message_Request,
+		&cellaserv.Request{ServiceName: &date, Method: &method, Id: &id})
+	reply := testMessage(t, cellaserv.Message_Reply, &cellaserv.Reply{Id: &id})
+	otherRequest := testMessage(t, cellaserv.Message_Request,
+		&cellaserv.Request{ServiceName: &other, Method: &method, Id: &otherId})
+	otherReply := testMessage(t, cellaserv.Message_Reply, &cellaserv.Reply{Id: &otherId})
+	publish := func(event string) []byte {
+		return testMessage(t, cellaserv.Message_Publish, &cellaserv.Publish{Event: &event})
+	}
+	end := "match.end"
+	subscribe := testMessage(t, cellaserv.Message_Subscribe, &cellaserv.Subscribe{Event: &end})
+
+	return []testDumpMessage{
+		{service, register, true},                  // 0
+		{client, request, true},                    // 1
+		{service, request, false},                  // 2
+		{service, reply, true},                     // 3
+		{client, reply, false},                     // 4
+		{client, reply, false},                     // 5, both copies were already replied
+		{client, otherRequest, true},               // 6
+		{client, otherReply, false},                // 7
+		{listener, subscribe, true},                // 8
+		{client, publish("match.start"), true},     // 9
+		{listener, publish("match.start"), false},  // 10
+		{client, publish("match.robot.pos"), true}, // 11
+	}
+}
+
+// testCapture dumps the messages with the filter, and returns the indexes of the messages kept
+func testCapture(t *testing.T, filter dumpFilter, messages []testDumpMessage) string {
+	if err := filter.compile(); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "capture.pcap")
+	d, err := newDumper(filename, false, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range messages {
+		d.dump(m.conn, m.msg, m.incoming)
+	}
+	d.close()
+
+	var kept []int
+	i := 0
+	err = dumpReadFile(filename, func(rec *dumpRecord) error {
+		for ; i < len(messages); i++ {
+			m := messages[i]
+			if bytes.Equal(rec.Msg, m.msg) && rec.Conn == m.conn.addr &&
+				rec.Incoming == m.incoming {
+				kept = append(kept, i)
+				i++
+				return nil
+			}
+		}
+		return fmt.Errorf("Unexpected record %+v", rec)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprint(kept)
+}
+
+func TestDumpFilter(t *testing.T) {
+	messages := testCaptureMessages(t)
+	tests := []struct {
+		filter dumpFilter
+		want   string
+	}{
+		{dumpFilter{}, "[0 1 2 3 4 5 6 7 8 9 10 11]"},
+		// The replies are kept for each copy of the request
+		{dumpFilter{Service: "date"}, "[0 1 2 3 4]"},
+		{dumpFilter{Service: "other"}, "[6 7]"},
+		{dumpFilter{Service: "none"}, "[]"},
+		{dumpFilter{Event: "match.+"}, "[8 9 10]"},
+		{dumpFilter{Event: "match.#"}, "[8 9 10 11]"},
+		{dumpFilter{Event: "*.pos"}, "[11]"},
+		{dumpFilter{Event: "match.start"}, "[9 10]"},
+		// Event patterns are not globs
+		{dumpFilter{Event: "match.[se]*"}, "[]"},
+		{dumpFilter{Event: "re:^match\\.(start|end)$"}, "[8 9 10]"},
+		{dumpFilter{Conn: "127.0.0.1:40003"}, "[8 10]"},
+		{dumpFilter{Service: "date", Event: "match.end"}, "[0 1 2 3 4 8]"},
+		{dumpFilter{Service: "date", Conn: "127.0.0.1:40001"}, "[1 4]"},
+		{dumpFilter{Event: "match.#", Conn: "127.0.0.1:40001"}, "[9 11]"},
+	}
+	for _, test := range tests {
+		if got := testCapture(t, test.filter, messages); got != test.want {
+			t.Errorf("Filter %+v kept %s, want %s", test.filter, got, test.want)
+		}
+	}
+}
+
+// A reply is kept for each copy of its request, the requests without a reply are forgotten after
+// dumpRequestExpiry
+func TestDumpFilterRequestCopies(t *testing.T) {
+	d := &dumper{reqIds: make(map[uint64]*dumpRequest)}
+	d.keepRequest(1)
+	d.keepRequest(1)
+	d.keepRequest(2)
+	for i, want := range []bool{true, true, false} {
+		if got := d.keepReply(1); got != want {
+			t.Errorf("Reply %d of request 1 kept: %t, want %t", i, got, want)
+		}
+	}
+
+	d.reqIds[2].kept = time.Now().Add(-2 * dumpRequestExpiry)
+	d.keepRequest(3)
+	if d.keepReply(2) {
+		t.Error("Reply of the expired request 2 kept")
+	}
+	if !d.keepReply(3) || len(d.reqIds) != 0 {
+		t.Errorf("Requests still kept: %v", d.reqIds)
+	}
+}
+
+func TestDumpStartInvalidEvent(t *testing.T) {
+	for _, event := range []string{"re:(", "match.*.+"} {
+		rep := testCall(t, handleDumpStart, fmt.Sprintf(`{"Event": %q}`, event))
+		if rep.Error.GetType() != cellaserv.Reply_Error_BadArguments {
+			t.Errorf("dump-start %q: error %v, want BadArguments", event, rep.Error)
+		}
+	}
+	dumpMtx.Lock()
+	defer dumpMtx.Unlock()
+	if dumpCapture != nil {
+		t.Error("Capture started with an invalid event")
+	}
+}
+
+// The pcapng interfaces are described once per address, the connections are not kept
+func TestPcapngInterfaces(t *testing.T) {
+	savedFormat := *dumpFormat
+	*dumpFormat = "pcapng"
+	defer func() { *dumpFormat = savedFormat }()
+	d, err := newDumper(filepath.Join(t.TempDir(), "capture.pcapng"), false, dumpFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.close()
+
+	tests := []struct {
+		addr   string
+		wantId uint32
+		wantIf bool
+	}{
+		{"127.0.0.1:40001", 0, true},
+		{"127.0.0.1:40002", 1, true},
+		{"127.0.0.1:40001", 0, false},
+		// A new connection from the same address
+		{"127.0.0.1:40002", 1, false},
+	}
+	for _, test := range tests {
+		id, n := d.pcapngInterface(&testConn{addr: test.addr})
+		if id != test.wantId || (n > 0) != test.wantIf {
+			t.Errorf("Interface of %s: %d, %d bytes written, want %d, described %t",
+				test.addr, id, n, test.wantId, test.wantIf)
+		}
+	}
+	if len(d.interfaces) != 2 {
+		t.Errorf("%d interfaces, want 2", len(d.interfaces))
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+/*
+pcapng format, see https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html
+
+Each client connection is an interface named after its address. The packets hold the raw cellaserv
+messages, without their length prefix, under the LINKTYPE_USER0 link type. The direction of a packet
+is in its flags, and its comment holds the name of the connection at the time it was sent.
+*/
+
+const (
+	pcapngBlockSectionHeader        = 0x0a0d0d0a
+	pcapngBlockInterfaceDescription = 0x00000001
+	pcapngBlockEnhancedPacket       = 0x00000006
+
+	pcapngByteOrderMagic = 0x1a2b3c4d
+
+	pcapngOptEnd         = 0
+	pcapngOptComment     = 1
+	pcapngOptShbUserAppl = 4
+	pcapngOptIfName      = 2
+	pcapngOptIfDesc      = 3
+	pcapngOptIfTsresol   = 9
+	pcapngOptEpbFlags    = 2
+
+	pcapngFlagInbound  = 1
+	pcapngFlagOutbound = 2
+
+	// LINKTYPE_USER0, reserved for private use
+	pcapngLinkType = 147
+	pcapngSnapLen  = 0
+)
+
+// pcapngAppendOption appends an option to the options of a block
+func pcapngAppendOption(b []byte, code uint16, value []byte) []byte {
+	var header [4]byte
+	binary.LittleEndian.PutUint16(header[0:], code)
+	binary.LittleEndian.PutUint16(header[2:], uint16(len(value)))
+	b = append(b, header[:]...)
+	b = append(b, value...)
+	return pcapngPad(b)
+}
+
+// pcapngAppend16, pcapngAppend32 and pcapngAppend64 append a little-endian integer to b
+func pcapngAppend16(b []byte, v uint16) []byte {
+	var buf [2]byte
+	binary.LittleEndian.PutUint16(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func pcapngAppend32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func pcapngAppend64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// pcapngPad pads b to 32 bits
+func pcapngPad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// pcapngWriteBlock writes a block of type blockType holding body, and returns its size
+func pcapngWriteBlock(w io.Writer, blockType uint32, body []byte) int {
+	body = pcapngPad(body)
+	totalLen := uint32(len(body) + 12)
+
+	block := make([]byte, 0, totalLen)
+	block = pcapngAppend32(block, blockType)
+	block = pcapngAppend32(block, totalLen)
+	block = append(block, body...)
+	block = pcapngAppend32(block, totalLen)
+	w.Write(block)
+
+	return len(block)
+}
+
+// pcapngWriteSectionHeader starts a new section, interfaces must be described again after it
+func pcapngWriteSectionHeader(w io.Writer) {
+	var body []byte
+	body = pcapngAppend32(body, pcapngByteOrderMagic)
+	body = pcapngAppend16(body, 1) // Major version
+	body = pcapngAppend16(body, 0) // Minor version
+	// Unknown section length
+	body = pcapngAppend64(body, 0xffffffffffffffff)
+	body = pcapngAppendOption(body, pcapngOptShbUserAppl, []byte("cellaserv2 "+csVersion))
+	body = pcapngAppendOption(body, pcapngOptEnd, nil)
+
+	pcapngWriteBlock(w, pcapngBlockSectionHeader, body)
+}
+
+// pcapngInterface returns the interface of the connection, describing it if it is new
+func (d *dumper) pcapngInterface(conn net.Conn) (uint32, int) {
+	addr := conn.RemoteAddr().String()
+	if id, ok := d.interfaces[addr]; ok {
+		return id, 0
+	}
+	id := uint32(len(d.interfaces))
+	d.interfaces[addr] = id
+
+	var body []byte
+	body = pcapngAppend16(body, pcapngLinkType)
+	body = pcapngAppend16(body, 0) // Reserved
+	body = pcapngAppend32(body, pcapngSnapLen)
+	body = pcapngAppendOption(body, pcapngOptIfName, []byte(addr))
+	body = pcapngAppendOption(body, pcapngOptIfDesc, []byte(connDescribe(conn)))
+	// Nanosecond timestamps
+	body = pcapngAppendOption(body, pcapngOptIfTsresol, []byte{9})
+	body = pcapngAppendOption(body, pcapngOptEnd, nil)
+
+	return id, pcapngWriteBlock(d.file, pcapngBlockInterfaceDescription, body)
+}
+
+// pcapngWritePacket writes the message to the interface of the connection, and returns the size
+// written
+func (d *dumper) pcapngWritePacket(conn net.Conn, msg []byte, incoming bool) int {
+	id, n := d.pcapngInterface(conn)
+
+	comment := "cellaserv -> " + connDescribe(conn)
+	flags := uint32(pcapngFlagOutbound)
+	if incoming {
+		comment = connDescribe(conn) + " -> cellaserv"
+		flags = pcapngFlagInbound
+	}
+
+	ts := uint64(time.Now().UnixNano())
+	var body []byte
+	body = pcapngAppend32(body, id)
+	body = pcapngAppend32(body, uint32(ts>>32))
+	body = pcapngAppend32(body, uint32(ts))
+	body = pcapngAppend32(body, uint32(len(msg))) // Captured length
+	body = pcapngAppend32(body, uint32(len(msg))) // Original length
+	body = pcapngPad(append(body, msg...))
+	body = pcapngAppendOption(body, pcapngOptComment, []byte(comment))
+	body = pcapngAppendOption(body, pcapngOptEpbFlags,
+		pcapngAppend32(nil, flags))
+	body = pcapngAppendOption(body, pcapngOptEnd, nil)
+
+	return n + pcapngWriteBlock(d.file, pcapngBlockEnhancedPacket, body)
+}
+
+// vim: set nowrap tw=100 noet sw=8:
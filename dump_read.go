@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// A message read from a dump
+type dumpRecord struct {
+	Time time.Time
+	// Address of the client
+	Conn string
+	// Name of the client when the message was dumped, only in pcapng dumps
+	Name string
+	// True if the message was sent by the client to cellaserv
+	Incoming bool
+	// Encoded cellaserv.Message
+	Msg []byte
+}
+
+// Magic numbers of the pcap files, microsecond and nanosecond timestamps
+const (
+	pcapMagic     = 0xa1b2c3d4
+	pcapMagicNsec = 0xa1b23c4d
+)
+
+// Largest packet or block read from a dump: a message, and the headers, addresses and names of
+// the packet. Larger lengths come from corrupted dumps, they are not allocated.
+const dumpMaxRecordSize = maxMessageSize + 64*1024
+
+// Returned by the callback of dumpReadFile to stop reading without error
+var errDumpStop = errors.New("stop")
+
+// dumpReadFile calls fn for each message of the pcap or pcapng dump filename, until fn returns an
+// error
+func dumpReadFile(filename string, fn func(*dumpRecord) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	magic, err := r.Peek(4)
+	if err != nil {
+		return fmt.Errorf("Could not read %s: %s", filename, err)
+	}
+
+	switch {
+	case binary.LittleEndian.Uint32(magic) == pcapngBlockSectionHeader:
+		err = dumpReadPcapng(r, fn)
+	case binary.LittleEndian.Uint32(magic) == pcapMagic,
+		binary.LittleEndian.Uint32(magic) == pcapMagicNsec:
+		err = dumpReadPcap(r, binary.LittleEndian, fn)
+	case binary.BigEndian.Uint32(magic) == pcapMagic,
+		binary.BigEndian.Uint32(magic) == pcapMagicNsec:
+		err = dumpReadPcap(r, binary.BigEndian, fn)
+	default:
+		return fmt.Errorf("%s is not a pcap or pcapng file", filename)
+	}
+	if err != nil && err != errDumpStop {
+		return fmt.Errorf("Could not read %s: %s", filename, err)
+	}
+	return nil
+}
+
+/*
+dumpRelinkFile rewrites in place the link type of a pcap dump written with dumpPcapLinkTypeLegacy,
+which Wireshark refuses to open, to dumpPcapLinkType. It returns false if the dump already uses
+dumpPcapLinkType.
+*/
+func dumpRelinkFile(filename string) (bool, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	var order binary.ByteOrder
+	var header PcapHeader
+	for _, order = range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+		if err := binary.Read(file, order, &header); err != nil {
+			return false, fmt.Errorf("Could not read %s: %s", filename, err)
+		}
+		if header.MagicNumber == pcapMagic || header.MagicNumber == pcapMagicNsec {
+			break
+		}
+	}
+	if header.MagicNumber != pcapMagic && header.MagicNumber != pcapMagicNsec {
+		return false, fmt.Errorf("%s is not a pcap file", filename)
+	}
+
+	switch header.LinkType {
+	case dumpPcapLinkType:
+		return false, nil
+	case dumpPcapLinkTypeLegacy:
+	default:
+		return false, fmt.Errorf("%s has an unsupported link type: %d", filename, header.LinkType)
+	}
+
+	header.LinkType = dumpPcapLinkType
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	if err := binary.Write(file, order, header); err != nil {
+		return false, fmt.Errorf("Could not write %s: %s", filename, err)
+	}
+	return true, nil
+}
+
+// dumpReadPcap reads the packets of a pcap dump holding cellaserv.LogMessage
+func dumpReadPcap(r io.Reader, order binary.ByteOrder, fn func(*dumpRecord) error) error {
+	var header PcapHeader
+	if err := binary.Read(r, order, &header); err != nil {
+		return err
+	}
+	if header.LinkType != dumpPcapLinkType && header.LinkType != dumpPcapLinkTypeLegacy {
+		return fmt.Errorf("Unsupported link type: %d", header.LinkType)
+	}
+	nsec := header.MagicNumber == pcapMagicNsec
+
+	for {
+		var packet PacketHeader
+		err := binary.Read(r, order, &packet)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if packet.InclLen > dumpMaxRecordSize {
+			return fmt.Errorf("Packet too large: %d bytes", packet.InclLen)
+		}
+		data := make([]byte, packet.InclLen)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+
+		logMsg := &cellaserv.LogMessage{}
+		if err := proto.Unmarshal(data, logMsg); err != nil {
+			return fmt.Errorf("Could not unmarshal log message: %s", err)
+		}
+
+		rec := &dumpRecord{Msg: logMsg.Content}
+		if nsec {
+			rec.Time = time.Unix(int64(packet.Sec), int64(packet.Usec))
+		} else {
+			rec.Time = time.Unix(int64(packet.Sec), int64(packet.Usec)*1000)
+		}
+		if logMsg.GetDestination() == "cellaserv" {
+			rec.Conn = logMsg.GetSender()
+			rec.Incoming = true
+		} else {
+			rec.Conn = logMsg.GetDestination()
+		}
+
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// Interface of a pcapng section
+type pcapngInterface struct {
+	linkType uint16
+	name     string
+	desc     string
+	// Duration of a timestamp unit, in nanoseconds, or 0 for sub-nanosecond units
+	unit int64
+	// Resolution of the sub-nanosecond units, as a power of ten or two
+	tsresol byte
+}
+
+// pcapngOptions returns the options of a block, indexed by code
+func pcapngOptions(b []byte, order binary.ByteOrder) map[uint16][]byte {
+	opts := make(map[uint16][]byte)
+	for len(b) >= 4 {
+		code := order.Uint16(b)
+		length := int(order.Uint16(b[2:]))
+		if code == pcapngOptEnd || 4+length > len(b) {
+			break
+		}
+		opts[code] = b[4 : 4+length]
+		// The padding of the last option may be missing
+		padded := 4 + (length+3)/4*4
+		if padded > len(b) {
+			break
+		}
+		b = b[padded:]
+	}
+	return opts
+}
+
+// timestamp converts a timestamp of the interface to a time
+func (iface *pcapngInterface) timestamp(ts uint64) time.Time {
+	if iface.unit > 0 {
+		return time.Unix(0, int64(ts)*iface.unit)
+	}
+
+	// Sub-nanosecond resolution
+	perSecond := uint64(1)
+	for i := byte(0); i < iface.tsresol&0x7f; i++ {
+		if iface.tsresol&0x80 != 0 {
+			perSecond *= 2
+		} else {
+			perSecond *= 10
+		}
+	}
+	sec := ts / perSecond
+	frac := ts % perSecond
+	return time.Unix(int64(sec), int64(float64(frac)/float64(perSecond)*1e9))
+}
+
+func newPcapngInterface(body []byte, order binary.ByteOrder) (*pcapngInterface, error) {
+	if len(body) < 8 {
+		return nil, fmt.Errorf("Truncated interface description")
+	}
+	iface := &pcapngInterface{linkType: order.Uint16(body), unit: 1000, tsresol: 6}
+	opts := pcapngOptions(body[8:], order)
+	iface.name = string(opts[pcapngOptIfName])
+	iface.desc = string(opts[pcapngOptIfDesc])
+
+	if tsresol, ok := opts[pcapngOptIfTsresol]; ok && len(tsresol) == 1 {
+		iface.tsresol = tsresol[0]
+		iface.unit = 0
+		if iface.tsresol&0x80 == 0 && iface.tsresol <= 9 {
+			iface.unit = 1
+			for i := iface.tsresol; i < 9; i++ {
+				iface.unit *= 10
+			}
+		}
+	}
+	return iface, nil
+}
+
+// dumpReadPcapng reads the packets of a pcapng dump holding cellaserv.Message
+func dumpReadPcapng(r io.Reader, fn func(*dumpRecord) error) error {
+	var order binary.ByteOrder = binary.LittleEndian
+	var interfaces []*pcapngInterface
+
+	for {
+		var header [8]byte
+		_, err := io.ReadFull(r, header[:])
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		blockType := order.Uint32(header[:])
+		if blockType == pcapngBlockSectionHeader {
+			// The byte order of the section follows the block length
+			var magic [4]byte
+			if _, err := io.ReadFull(r, magic[:]); err != nil {
+				return err
+			}
+			if binary.BigEndian.Uint32(magic[:]) == pcapngByteOrderMagic {
+				order = binary.BigEndian
+			} else {
+				order = binary.LittleEndian
+			}
+			interfaces = nil
+
+			totalLen := order.Uint32(header[4:])
+			if totalLen < 16 {
+				return fmt.Errorf("Bad section header length: %d", totalLen)
+			}
+			if _, err := io.CopyN(io.Discard, r, int64(totalLen)-12); err != nil {
+				return err
+			}
+			continue
+		}
+
+		totalLen := order.Uint32(header[4:])
+		if totalLen < 12 || totalLen%4 != 0 {
+			return fmt.Errorf("Bad block length: %d", totalLen)
+		}
+		if totalLen > dumpMaxRecordSize {
+			return fmt.Errorf("Block too large: %d bytes", totalLen)
+		}
+		block := make([]byte, totalLen-8)
+		if _, err := io.ReadFull(r, block); err != nil {
+			return err
+		}
+		body := block[:len(block)-4]
+
+		switch blockType {
+		case pcapngBlockInterfaceDescription:
+			iface, err := newPcapngInterface(body, order)
+			if err != nil {
+				return err
+			}
+			interfaces = append(interfaces, iface)
+		case pcapngBlockEnhancedPacket:
+			if len(body) < 20 {
+				return fmt.Errorf("Truncated packet")
+			}
+			id := order.Uint32(body)
+			if int(id) >= len(interfaces) {
+				return fmt.Errorf("Packet of unknown interface %d", id)
+			}
+			iface := interfaces[id]
+			if iface.linkType != pcapngLinkType {
+				// Not a cellaserv packet
+				continue
+			}
+
+			ts := uint64(order.Uint32(body[4:]))<<32 | uint64(order.Uint32(body[8:]))
+			capLen := int(order.Uint32(body[12:]))
+			if capLen > len(body)-20 {
+				return fmt.Errorf("Truncated packet")
+			}
+			// The options follow the padded packet, if any
+			var opts map[uint16][]byte
+			if padded := 20 + (capLen+3)/4*4; padded <= len(body) {
+				opts = pcapngOptions(body[padded:], order)
+			}
+
+			rec := &dumpRecord{
+				Time: iface.timestamp(ts),
+				Conn: iface.name,
+				Name: iface.desc,
+				Msg:  body[20 : 20+capLen],
+			}
+			if flags, ok := opts[pcapngOptEpbFlags]; ok && len(flags) == 4 {
+				rec.Incoming = order.Uint32(flags)&3 == pcapngFlagInbound
+			}
+			// The comment holds the name of the client at the time of the packet
+			if comment, ok := opts[pcapngOptComment]; ok {
+				if rec.Incoming {
+					rec.Name = strings.TrimSuffix(string(comment), " -> cellaserv")
+				} else {
+					rec.Name = strings.TrimPrefix(string(comment), "cellaserv -> ")
+				}
+			}
+
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
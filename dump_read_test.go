@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"bytes"
+	"encoding/binary"
+	"github.com/golang/protobuf/proto"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testConn is a connection with a fixed remote address
+type testConn struct {
+	net.Conn
+	addr string
+}
+
+func (c *testConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.addr)
+	return addr
+}
+
+// A message of a test dump
+type testDumpMessage struct {
+	conn     *testConn
+	msg      []byte
+	incoming bool
+}
+
+func testMessage(t *testing.T, msgType cellaserv.Message_MessageType, m proto.Message) []byte {
+	content, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgBytes, err := messageWithContent(msgType, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msgBytes
+}
+
+// testDumpMessages returns a request forwarded to a service, its reply, and a publish
+func testDumpMessages(t *testing.T) []testDumpMessage {
+	client := &testConn{addr: "127.0.0.1:40001"}
+	service := &testConn{addr: "127.0.0.1:40002"}
+	serviceName, method, id := "date", "time", uint64(42)
+	request := testMessage(t, cellaserv.Message_Request,
+		&cellaserv.Request{ServiceName: &serviceName, Method: &method, Id: &id})
+	reply := testMessage(t, cellaserv.Message_Reply,
+		&cellaserv.Reply{Id: &id, Data: []byte("1234")})
+	event := "match.start"
+	publish := testMessage(t, cellaserv.Message_Publish,
+		&cellaserv.Publish{Event: &event, Data: []byte(`{"x": 1}`)})
+
+	return []testDumpMessage{
+		{client, request, true},
+		{service, request, false},
+		{service, reply, true},
+		{client, reply, false},
+		{client, publish, true},
+	}
+}
+
+// testWriteDump writes the messages to a dump file of the format with dumpSetup
+func testWriteDump(t *testing.T, format string, messages []testDumpMessage) string {
+	filename := filepath.Join(t.TempDir(), "dump."+format)
+	savedFile, savedFormat := *dumpFileFlag, *dumpFormat
+	*dumpFileFlag, *dumpFormat = filename, format
+	defer func() { *dumpFileFlag, *dumpFormat = savedFile, savedFormat }()
+
+	if err := dumpSetup(); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range messages {
+		if m.incoming {
+			dumpIncoming(m.conn, m.msg)
+		} else {
+			dumpOutgoing(m.conn, m.msg)
+		}
+	}
+	dumpClose()
+	return filename
+}
+
+func TestDumpReadFile(t *testing.T) {
+	messages := testDumpMessages(t)
+	for _, format := range []string{"pcap", "pcapng"} {
+		filename := testWriteDump(t, format, messages)
+
+		var records []*dumpRecord
+		err := dumpReadFile(filename, func(rec *dumpRecord) error {
+			records = append(records, rec)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		if len(records) != len(messages) {
+			t.Fatalf("%s: read %d records, want %d", format, len(records), len(messages))
+		}
+		for i, rec := range records {
+			m := messages[i]
+			if !bytes.Equal(rec.Msg, m.msg) || rec.Conn != m.conn.addr ||
+				rec.Incoming != m.incoming {
+				t.Errorf("%s: record %d: %s incoming:%t %x, want %s incoming:%t %x", format,
+					i, rec.Conn, rec.Incoming, rec.Msg, m.conn.addr, m.incoming, m.msg)
+			}
+		}
+	}
+}
+
+func TestDumpReadFileStop(t *testing.T) {
+	filename := testWriteDump(t, "pcap", testDumpMessages(t))
+	count := 0
+	err := dumpReadFile(filename, func(rec *dumpRecord) error {
+		count++
+		return errDumpStop
+	})
+	if err != nil || count != 1 {
+		t.Errorf("stopped after %d records with error %v, want 1 record and no error", count, err)
+	}
+}
+
+func TestDumpReadFileInvalid(t *testing.T) {
+	pcap, _ := os.ReadFile(testWriteDump(t, "pcap", testDumpMessages(t)))
+	pcapng, _ := os.ReadFile(testWriteDump(t, "pcapng", testDumpMessages(t)))
+	linkType := append([]byte{}, pcap...)
+	binary.LittleEndian.PutUint32(linkType[20:], 1)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"not a dump", []byte("hello world")},
+		{"pcap header only", pcap[:12]},
+		{"truncated pcap packet", pcap[:len(pcap)-3]},
+		{"pcap link type", linkType},
+		{"truncated pcapng block", pcapng[:len(pcapng)-3]},
+	}
+	for _, test := range tests {
+		filename := filepath.Join(t.TempDir(), "dump")
+		os.WriteFile(filename, test.data, 0644)
+		err := dumpReadFile(filename, func(rec *dumpRecord) error { return nil })
+		if err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
+
+// The lengths of corrupted dumps are not allocated
+func TestDumpReadFileTooLarge(t *testing.T) {
+	pcap, _ := os.ReadFile(testWriteDump(t, "pcap", testDumpMessages(t)))
+	pcapng, _ := os.ReadFile(testWriteDump(t, "pcapng", testDumpMessages(t)))
+
+	// The included length of the first packet, and the length of the block following the
+	// section header
+	binary.LittleEndian.PutUint32(pcap[32:], 0xfffffff0)
+	binary.LittleEndian.PutUint32(pcapng[binary.LittleEndian.Uint32(pcapng[4:])+4:], 0xfffffff0)
+
+	for _, data := range [][]byte{pcap, pcapng} {
+		filename := filepath.Join(t.TempDir(), "dump")
+		os.WriteFile(filename, data, 0644)
+		err := dumpReadFile(filename, func(rec *dumpRecord) error { return nil })
+		if err == nil || !strings.Contains(err.Error(), "too large") {
+			t.Errorf("Error %v, want too large", err)
+		}
+	}
+}
+
+func TestDumpRelinkFile(t *testing.T) {
+	filename := testWriteDump(t, "pcap", testDumpMessages(t))
+
+	// Dumps of older versions use the legacy link type
+	data, _ := os.ReadFile(filename)
+	binary.LittleEndian.PutUint32(data[20:], dumpPcapLinkTypeLegacy)
+	os.WriteFile(filename, data, 0644)
+
+	changed, err := dumpRelinkFile(filename)
+	if err != nil || !changed {
+		t.Fatalf("dumpRelinkFile: %t, %v, want true, nil", changed, err)
+	}
+	relinked, _ := os.ReadFile(filename)
+	if linkType := binary.LittleEndian.Uint32(relinked[20:]); linkType != dumpPcapLinkType {
+		t.Errorf("link type %d, want %d", linkType, dumpPcapLinkType)
+	}
+	if !bytes.Equal(relinked[24:], data[24:]) {
+		t.Errorf("packets changed")
+	}
+
+	changed, err = dumpRelinkFile(filename)
+	if err != nil || changed {
+		t.Errorf("dumpRelinkFile again: %t, %v, want false, nil", changed, err)
+	}
+
+	if _, err := dumpRelinkFile(testWriteDump(t, "pcapng", testDumpMessages(t))); err == nil {
+		t.Errorf("dumpRelinkFile of a pcapng dump: no error")
+	}
+}
+
+func TestPcapngOptions(t *testing.T) {
+	le := binary.LittleEndian
+	tests := []struct {
+		name string
+		b    []byte
+		want map[uint16]string
+	}{
+		{"empty", nil, map[uint16]string{}},
+		{"end", []byte{0, 0, 0, 0}, map[uint16]string{}},
+		{"padded", []byte{2, 0, 3, 0, 'a', 'b', 'c', 0, 3, 0, 1, 0, 'd', 0, 0, 0, 0, 0, 0, 0},
+			map[uint16]string{2: "abc", 3: "d"}},
+		{"aligned", []byte{2, 0, 4, 0, 'a', 'b', 'c', 'd', 0, 0, 0, 0},
+			map[uint16]string{2: "abcd"}},
+		{"stops at end", []byte{2, 0, 1, 0, 'a', 0, 0, 0, 0, 0, 0, 0, 3, 0, 1, 0, 'b', 0, 0, 0},
+			map[uint16]string{2: "a"}},
+		{"last option without padding", []byte{2, 0, 5, 0, 'a', 'b', 'c', 'd', 'e'},
+			map[uint16]string{2: "abcde"}},
+		{"truncated value", []byte{2, 0, 8, 0, 'a', 'b'}, map[uint16]string{}},
+		{"truncated header", []byte{2, 0, 1}, map[uint16]string{}},
+	}
+	for _, test := range tests {
+		opts := pcapngOptions(test.b, le)
+		if len(opts) != len(test.want) {
+			t.Errorf("%s: %d options, want %d", test.name, len(opts), len(test.want))
+		}
+		for code, want := range test.want {
+			if got := string(opts[code]); got != want {
+				t.Errorf("%s: option %d = %q, want %q", test.name, code, got, want)
+			}
+		}
+	}
+
+	be := []byte{0, 2, 0, 2, 'h', 'i', 0, 0, 0, 0, 0, 0}
+	if got := string(pcapngOptions(be, binary.BigEndian)[2]); got != "hi" {
+		t.Errorf("big endian: option 2 = %q, want \"hi\"", got)
+	}
+}
+
+func TestPcapngTimestamp(t *testing.T) {
+	tests := []struct {
+		tsresol []byte
+		ts      uint64
+		want    int64
+	}{
+		// Microseconds by default
+		{nil, 1500000, 1500000000},
+		{[]byte{9}, 1500000000, 1500000000},
+		{[]byte{3}, 1500, 1500000000},
+		{[]byte{0}, 2, 2000000000},
+		// Powers of two
+		{[]byte{0x80 | 10}, 3 * 1024, 3000000000},
+		{[]byte{0x80 | 1}, 3, 1500000000},
+	}
+	for _, test := range tests {
+		body := make([]byte, 8)
+		if test.tsresol != nil {
+			body = append(body, pcapngOptIfTsresol, 0, 1, 0, test.tsresol[0], 0, 0, 0)
+		}
+		iface, err := newPcapngInterface(body, binary.LittleEndian)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := iface.timestamp(test.ts).UnixNano(); got != test.want {
+			t.Errorf("tsresol %v: timestamp(%d) = %d, want %d", test.tsresol, test.ts, got,
+				test.want)
+		}
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
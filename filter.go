@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+/*
+Content filters of the subscriptions.
+
+A subscription may carry a filter expression, evaluated against the JSON data of each publish of
+its events. Publishes whose data does not match, or is not JSON, are not sent to the subscriber.
+
+	robot == "pal"
+	distance < 300 && !stale
+	(pos.x > 1500 || pos.y > 1000) && points.0 != null
+
+Operands are JSON literals (numbers, "strings", true, false, null) or paths of fields in the data,
+made of names and array indexes separated by dots. A missing field is null. Comparisons are:
+
+	== !=          equality of any values
+	< <= > >=      order of two numbers or two strings, false otherwise
+
+An operand alone is true if it is neither null nor false. Expressions are combined with &&, || and
+!, and grouped with parentheses.
+*/
+
+// A compiled filter expression
+type subscriptionFilter struct {
+	expr string
+	root filterNode
+}
+
+// filterNode is a node of the syntax tree of a filter
+type filterNode interface {
+	// eval returns the value of the node for data, the decoded JSON of a publish
+	eval(data interface{}) interface{}
+}
+
+type filterLiteral struct{ value interface{} }
+
+type filterPath struct{ path []string }
+
+type filterNot struct{ operand filterNode }
+
+type filterBinary struct {
+	op          string
+	left, right filterNode
+}
+
+func (n *filterLiteral) eval(data interface{}) interface{} {
+	return n.value
+}
+
+func (n *filterPath) eval(data interface{}) interface{} {
+	for _, key := range n.path {
+		switch v := data.(type) {
+		case map[string]interface{}:
+			data = v[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil
+			}
+			data = v[i]
+		default:
+			return nil
+		}
+	}
+	return data
+}
+
+func (n *filterNot) eval(data interface{}) interface{} {
+	return !filterTruth(n.operand.eval(data))
+}
+
+func (n *filterBinary) eval(data interface{}) interface{} {
+	switch n.op {
+	case "&&":
+		return filterTruth(n.left.eval(data)) && filterTruth(n.right.eval(data))
+	case "||":
+		return filterTruth(n.left.eval(data)) || filterTruth(n.right.eval(data))
+	}
+
+	left, right := n.left.eval(data), n.right.eval(data)
+	switch n.op {
+	case "==":
+		return reflect.DeepEqual(left, right)
+	case "!=":
+		return !reflect.DeepEqual(left, right)
+	}
+
+	// Order of two numbers or two strings
+	var cmp int
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return false
+		}
+		switch {
+		case l < r:
+			cmp = -1
+		case l > r:
+			cmp = 1
+		}
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return false
+		}
+		cmp = strings.Compare(l, r)
+	default:
+		return false
+	}
+
+	switch n.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+// filterTruth returns whether the value is neither null nor false
+func filterTruth(v interface{}) bool {
+	return v != nil && v != false
+}
+
+// Data of a publish, decoded once for all the filters
+type filterPayload struct {
+	data    []byte
+	decoded bool
+	value   interface{}
+	err     error
+}
+
+func (p *filterPayload) decode() (interface{}, error) {
+	if !p.decoded {
+		p.err = json.Unmarshal(p.data, &p.value)
+		p.decoded = true
+	}
+	return p.value, p.err
+}
+
+// match returns whether the data of a publish matches the filter
+func (f *subscriptionFilter) match(payload *filterPayload) bool {
+	v, err := payload.decode()
+	if err != nil {
+		return false
+	}
+	return filterTruth(f.root.eval(v))
+}
+
+// Parser of the filter expressions
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+// Operators of the filters, the longer first, and their first characters
+var filterOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")"}
+
+const filterOperatorChars = "&|=!<>()"
+
+// filterNameChar returns whether c is part of a name, a path or a number
+func filterNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '-' || c == '.'
+}
+
+// filterTokenize splits the expression in operators, strings, numbers and names or paths
+func filterTokenize(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			i++
+			continue
+		}
+
+		found := false
+		for _, op := range filterOperators {
+			if strings.HasPrefix(expr[i:], op) {
+				tokens = append(tokens, op)
+				i += len(op)
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+
+		start := i
+		switch {
+		case c == '"':
+			// Find the closing quote, skipping the escaped characters
+			for i++; i < len(expr) && expr[i] != '"'; i++ {
+				if expr[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(expr) {
+				return nil, fmt.Errorf("Unterminated string at %d", start)
+			}
+			i++
+		case filterNameChar(c):
+			// Names, paths and numbers, with the sign of the exponents
+			for i < len(expr) && (filterNameChar(expr[i]) ||
+				expr[i] == '+' && (expr[i-1] == 'e' || expr[i-1] == 'E')) {
+				i++
+			}
+		default:
+			return nil, fmt.Errorf("Unexpected character %q at %d", c, i)
+		}
+		tokens = append(tokens, expr[start:i])
+	}
+	return tokens, nil
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+// or := and ("||" and)*
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterBinary{"||", left, right}
+	}
+	return left, nil
+}
+
+// and := unary ("&&" unary)*
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterBinary{"&&", left, right}
+	}
+	return left, nil
+}
+
+// unary := "!" unary | "(" or ")" | operand [comparison operand]
+func (p *filterParser) parseUnary() (filterNode, error) {
+	switch p.peek() {
+	case "!":
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &filterNot{operand}, nil
+	case "(":
+		p.next()
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("Missing ')'")
+		}
+		return node, nil
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	switch op := p.peek(); op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.next()
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &filterBinary{op, left, right}, nil
+	}
+	return left, nil
+}
+
+// operand := literal | path
+func (p *filterParser) parseOperand() (filterNode, error) {
+	token := p.next()
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("Unexpected end of filter")
+	case token == "true":
+		return &filterLiteral{true}, nil
+	case token == "false":
+		return &filterLiteral{false}, nil
+	case token == "null":
+		return &filterLiteral{nil}, nil
+	case token[0] == '"':
+		var s string
+		if err := json.Unmarshal([]byte(token), &s); err != nil {
+			return nil, fmt.Errorf("Invalid string %s", token)
+		}
+		return &filterLiteral{s}, nil
+	case token[0] == '-' || token[0] >= '0' && token[0] <= '9':
+		f, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid number %s", token)
+		}
+		return &filterLiteral{f}, nil
+	case strings.Contains(filterOperatorChars, token[:1]):
+		return nil, fmt.Errorf("Unexpected %s", token)
+	}
+
+	path := strings.Split(token, ".")
+	for _, key := range path {
+		if key == "" {
+			return nil, fmt.Errorf("Invalid path %s", token)
+		}
+	}
+	return &filterPath{path}, nil
+}
+
+// compileFilter compiles a filter expression
+func compileFilter(expr string) (*subscriptionFilter, error) {
+	tokens, err := filterTokenize(expr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid filter: %s", err)
+	}
+	p := &filterParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid filter: %s", err)
+	}
+	if p.pos != len(tokens) {
+		return nil, fmt.Errorf("Invalid filter: Unexpected %s", p.peek())
+	}
+	return &subscriptionFilter{expr, root}, nil
+}
+
+// vim: set nowrap tw=100 noet sw=8:
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompileFilterErrors(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr string
+	}{
+		{"", "Unexpected end of filter"},
+		{"x <", "Unexpected end of filter"},
+		{"(x == 1", "Missing ')'"},
+		{"x == 1)", "Unexpected )"},
+		{"x == == 1", "Unexpected =="},
+		{"x == 1 2", "Unexpected 2"},
+		{"x && || y", "Unexpected ||"},
+		{`robot == "pal`, "Unterminated string at 9"},
+		{"x == 1 ; y", "Unexpected character ';' at 7"},
+		{"x == 1.2.3", "Invalid number 1.2.3"},
+		{"x == -", "Invalid number -"},
+		{"pos..x", "Invalid path pos..x"},
+		{".x", "Invalid path .x"},
+	}
+	for _, test := range tests {
+		_, err := compileFilter(test.expr)
+		if err == nil {
+			t.Errorf("compileFilter(%q) succeeded, want error %q", test.expr, test.wantErr)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), "Invalid filter: ") ||
+			!strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("compileFilter(%q) = %q, want error %q", test.expr, err, test.wantErr)
+		}
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	data := `{"robot": "pal", "distance": 250, "stale": false, "pos": {"x": 1600, "y": 200},
+		"points": [12, 3], "tags": ["a", "b"], "none": null, "big": 1e+3}`
+	tests := []struct {
+		expr string
+		data string
+		want bool
+	}{
+		// Equality of any values
+		{`robot == "pal"`, data, true},
+		{`robot == "pal2"`, data, false},
+		{`robot != "pal2"`, data, true},
+		{`distance == 250`, data, true},
+		{`distance == "250"`, data, false},
+		{`tags == tags`, data, true},
+		{`pos == points`, data, false},
+		{`none == null`, data, true},
+		{`missing == null`, data, true},
+		{`missing != null`, data, false},
+		{`stale == false`, data, true},
+		{`big == 1000`, data, true},
+
+		// Order of two numbers or two strings
+		{`distance < 300`, data, true},
+		{`distance <= 250`, data, true},
+		{`distance < 250`, data, false},
+		{`distance > -1.5`, data, true},
+		{`distance >= 251`, data, false},
+		{`robot < "zed"`, data, true},
+		{`robot > "pal"`, data, false},
+		{`robot >= "pal"`, data, true},
+		{`distance < "300"`, data, false},
+		{`missing < 1`, data, false},
+		{`pos < 1`, data, false},
+
+		// Paths of fields and array indexes
+		{`pos.x > 1500`, data, true},
+		{`pos.y > 1000`, data, false},
+		{`points.0 == 12`, data, true},
+		{`points.1 == 3`, data, true},
+		{`points.2 == null`, data, true},
+		{`points.-1 == null`, data, true},
+		{`points.x == null`, data, true},
+		{`robot.x == null`, data, true},
+		{`tags.1 == "b"`, data, true},
+
+		// Truth of an operand alone
+		{`robot`, data, true},
+		{`stale`, data, false},
+		{`none`, data, false},
+		{`missing`, data, false},
+		{`distance`, data, true},
+		{`true`, data, true},
+		{`false`, data, false},
+		{`null`, data, false},
+
+		// Combinations and precedence
+		{`distance < 300 && !stale`, data, true},
+		{`distance < 200 && !stale`, data, false},
+		{`distance < 200 || robot == "pal"`, data, true},
+		{`!(distance < 300)`, data, false},
+		{`!!robot`, data, true},
+		{`(pos.x > 1500 || pos.y > 1000) && points.0 != null`, data, true},
+		{`false && true || true`, data, true},
+		{`false && (true || true)`, data, false},
+		{`true || false && false`, data, true},
+
+		// Data that is not an object or not JSON
+		{`x == null`, `[1]`, true},
+		{`x == 1`, `"x"`, false},
+		{`missing == null`, ``, false},
+		{`missing == null`, `{"robot":`, false},
+		{`true`, `not json`, false},
+		{`true`, `null`, true},
+	}
+	for _, test := range tests {
+		filter, err := compileFilter(test.expr)
+		if err != nil {
+			t.Errorf("compileFilter(%q): %s", test.expr, err)
+			continue
+		}
+		payload := &filterPayload{data: []byte(test.data)}
+		if got := filter.match(payload); got != test.want {
+			t.Errorf("%q match %s = %t, want %t", test.expr, test.data, got, test.want)
+		}
+	}
+}
+
+func TestFiltersMatch(t *testing.T) {
+	near, err := compileFilter("distance < 300")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pal, err := compileFilter(`robot == "pal"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		filters []*subscriptionFilter
+		data    string
+		want    bool
+	}{
+		{nil, `{}`, false},
+		{[]*subscriptionFilter{nil}, `not json`, true},
+		{[]*subscriptionFilter{near}, `{"distance": 100}`, true},
+		{[]*subscriptionFilter{near}, `{"distance": 400}`, false},
+		{[]*subscriptionFilter{near, pal}, `{"distance": 400, "robot": "pal"}`, true},
+		{[]*subscriptionFilter{near, pal}, `{"distance": 400}`, false},
+		{[]*subscriptionFilter{near, nil}, `{"distance": 400}`, true},
+		{[]*subscriptionFilter{near, pal}, `not json`, false},
+	}
+	for i, test := range tests {
+		payload := &filterPayload{data: []byte(test.data)}
+		if got := filtersMatch(test.filters, payload); got != test.want {
+			t.Errorf("test %d: filtersMatch(%s) = %t, want %t", i, test.data, got, test.want)
+		}
+	}
+}
+
+func TestFilterPayloadDecodedOnce(t *testing.T) {
+	filter, err := compileFilter("x == 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := &filterPayload{data: []byte(`{"x": 1}`)}
+	if !filter.match(payload) {
+		t.Fatal("first match failed")
+	}
+	// The decoded value is reused, not the data
+	payload.data = []byte(`{"x": 2}`)
+	if !filter.match(payload) {
+		t.Error("payload decoded again")
+	}
+
+	// A payload that is never matched is never decoded
+	payload = &filterPayload{data: []byte(`{"x": 1}`)}
+	if filtersMatch([]*subscriptionFilter{nil}, payload); payload.decoded {
+		t.Error("payload decoded without filter")
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
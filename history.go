@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+History of the events.
+
+The publishes of the events matching the -history patterns are kept in a ring buffer per pattern,
+bounded by a number of publishes and an age. Each pattern takes its bounds after '=' as COUNT/AGE,
+eg. "robot.#=500/30s", or the defaults -history-count and -history-age.
+
+A subscriber asking for the history with cellaserv.subscribe receives the kept publishes of its
+events since a time or a sequence number, then the live ones. The history is read, the subscriber
+added and the history queued to it under pubsubMtx, which also covers the publishes, so that no
+publish is missed or received twice at the transition. The history is written after releasing the
+lock, the live publishes are queued behind it, see send_queue.go.
+*/
+
+var (
+	historyFlag = flag.String("history", "", "keep the history of the events matching these "+
+		"comma separated patterns, each pattern may be followed by =COUNT/AGE")
+	historyCountFlag = flag.Int("history-count", 1000, "default number of publishes kept by "+
+		"each history pattern")
+	historyAgeFlag = flag.Duration("history-age", time.Minute, "default age of the publishes "+
+		"kept by each history pattern, 0 for no limit")
+
+	// Buffers of the -history patterns, protected by pubsubMtx
+	histories []*historyBuffer
+)
+
+// A publish kept in the history
+type historyEntry struct {
+	publishStamp
+	event string
+	data  []byte
+	// Message forwarded to the subscribers
+	msgBytes []byte
+}
+
+// Ring buffer of the publishes of the events matching pattern
+type historyBuffer struct {
+	pattern *topicPattern
+	count   int
+	age     time.Duration
+
+	entries []*historyEntry
+	// Index of the oldest entry, and number of entries
+	start int
+	len   int
+}
+
+func newHistoryBuffer(pattern *topicPattern, count int, age time.Duration) *historyBuffer {
+	return &historyBuffer{pattern: pattern, count: count, age: age,
+		entries: make([]*historyEntry, count)}
+}
+
+// at returns the i-th oldest entry
+func (h *historyBuffer) at(i int) *historyEntry {
+	return h.entries[(h.start+i)%h.count]
+}
+
+// add adds the entry, dropping the oldest one if the buffer is full
+func (h *historyBuffer) add(e *historyEntry) {
+	if h.len == h.count {
+		h.entries[h.start] = nil
+		h.start = (h.start + 1) % h.count
+		h.len--
+	}
+	h.entries[(h.start+h.len)%h.count] = e
+	h.len++
+}
+
+// expire drops the entries older than the age of the buffer
+func (h *historyBuffer) expire(now time.Time) {
+	if h.age == 0 {
+		return
+	}
+	for h.len > 0 && now.Sub(h.at(0).time) > h.age {
+		h.entries[h.start] = nil
+		h.start = (h.start + 1) % h.count
+		h.len--
+	}
+}
+
+// parseHistoryPattern parses a -history pattern and its optional bounds
+func parseHistoryPattern(s string) (*historyBuffer, error) {
+	name, bounds := s, ""
+	if i := strings.LastIndex(s, "="); i >= 0 {
+		name, bounds = s[:i], s[i+1:]
+	}
+	pattern, err := compileTopic(name)
+	if err != nil {
+		return nil, err
+	}
+
+	count, age := *historyCountFlag, *historyAgeFlag
+	if bounds != "" {
+		countStr, ageStr := bounds, ""
+		if i := strings.Index(bounds, "/"); i >= 0 {
+			countStr, ageStr = bounds[:i], bounds[i+1:]
+		}
+		if countStr != "" {
+			n, err := strconv.Atoi(countStr)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid count for %s: %s", name, countStr)
+			}
+			count = n
+		}
+		if ageStr != "" {
+			d, err := time.ParseDuration(ageStr)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("Invalid age for %s: %s", name, ageStr)
+			}
+			age = d
+		}
+	}
+	if count <= 0 {
+		return nil, fmt.Errorf("Invalid count for %s: %d", name, count)
+	}
+	return newHistoryBuffer(pattern, count, age), nil
+}
+
+// historySetup parses the -history patterns
+func historySetup() {
+	for _, s := range strings.Split(*historyFlag, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		h, err := parseHistoryPattern(s)
+		if err != nil {
+			log.Error("[History] %s", err)
+			continue
+		}
+		log.Info("[History] Keeping %d publishes of %s for %s", h.count, h.pattern.pattern,
+			h.age)
+		histories = append(histories, h)
+	}
+}
+
+// historyAdd adds a publish to the buffers of its event, pubsubMtx must be held
+func historyAdd(stamp *publishStamp, pub *cellaserv.Publish, msgBytes []byte) {
+	event := *pub.Event
+	var e *historyEntry
+	for _, h := range histories {
+		if !h.pattern.match(event) {
+			continue
+		}
+		if e == nil {
+			e = &historyEntry{*stamp, event, pub.Data, msgBytes}
+		}
+		h.expire(e.time)
+		h.add(e)
+	}
+}
+
+// historySince returns the kept publishes of the events matching pattern and filter, published
+// after since and after the sequence number sinceSeq, sorted by sequence number, pubsubMtx must be
+// held
+func historySince(pattern *topicPattern, filter *subscriptionFilter, since time.Time,
+	sinceSeq uint64) []*historyEntry {
+	now := time.Now()
+	seen := make(map[uint64]bool)
+	var entries []*historyEntry
+
+	for _, h := range histories {
+		h.expire(now)
+		for i := 0; i < h.len; i++ {
+			e := h.at(i)
+			if e.seq <= sinceSeq || e.time.Before(since) || seen[e.seq] {
+				continue
+			}
+			if !pattern.match(e.event) {
+				continue
+			}
+			if filter != nil && !filter.match(&filterPayload{data: e.data}) {
+				continue
+			}
+			// An event matching several patterns is in several buffers
+			seen[e.seq] = true
+			entries = append(entries, e)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	return entries
+}
+
+// vim: set nowrap tw=100 noet sw=8:
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHistoryPattern(t *testing.T) {
+	savedCount, savedAge := *historyCountFlag, *historyAgeFlag
+	*historyCountFlag, *historyAgeFlag = 1000, time.Minute
+	defer func() { *historyCountFlag, *historyAgeFlag = savedCount, savedAge }()
+
+	tests := []struct {
+		s       string
+		pattern string
+		count   int
+		age     time.Duration
+		wantErr string
+	}{
+		{"robot.*", "robot.*", 1000, time.Minute, ""},
+		{"robot.#=500", "robot.#", 500, time.Minute, ""},
+		{"robot.#=500/30s", "robot.#", 500, 30 * time.Second, ""},
+		{"robot.#=/30s", "robot.#", 1000, 30 * time.Second, ""},
+		{"robot.#=10/0", "robot.#", 10, 0, ""},
+		{"robot.#=", "robot.#", 1000, time.Minute, ""},
+		// Only the last '=' separates the bounds
+		{"re:^a=b$=5", "re:^a=b$", 5, time.Minute, ""},
+		{"robot.#=abc", "", 0, 0, "Invalid count"},
+		{"robot.#=0", "", 0, 0, "Invalid count"},
+		{"robot.#=-1", "", 0, 0, "Invalid count"},
+		{"robot.#=5/abc", "", 0, 0, "Invalid age"},
+		{"robot.#=5/-1s", "", 0, 0, "Invalid age"},
+		{"a.#.b=5", "", 0, 0, "#"},
+		{"re:(=5", "", 0, 0, "re:("},
+	}
+	for _, test := range tests {
+		h, err := parseHistoryPattern(test.s)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("parseHistoryPattern(%q): error %v, want %q", test.s, err,
+					test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseHistoryPattern(%q): %s", test.s, err)
+			continue
+		}
+		if h.pattern.pattern != test.pattern || h.count != test.count || h.age != test.age {
+			t.Errorf("parseHistoryPattern(%q) = %s %d %s, want %s %d %s", test.s,
+				h.pattern.pattern, h.count, h.age, test.pattern, test.count, test.age)
+		}
+	}
+}
+
+// historySeqs returns the sequence numbers of the entries of the buffer, from the oldest
+func historySeqs(h *historyBuffer) []uint64 {
+	seqs := make([]uint64, 0, h.len)
+	for i := 0; i < h.len; i++ {
+		seqs = append(seqs, h.at(i).seq)
+	}
+	return seqs
+}
+
+func TestHistoryBuffer(t *testing.T) {
+	start := time.Unix(1000, 0)
+	entry := func(seq uint64) *historyEntry {
+		return &historyEntry{publishStamp: publishStamp{seq: seq,
+			time: start.Add(time.Duration(seq) * time.Second)}}
+	}
+
+	tests := []struct {
+		name  string
+		count int
+		age   time.Duration
+		adds  int
+		// Time of the expiry, in seconds after start, 0 for none
+		expireAt int
+		want     []uint64
+	}{
+		{"empty", 3, 0, 0, 0, []uint64{}},
+		{"not full", 3, 0, 2, 0, []uint64{1, 2}},
+		{"full", 3, 0, 3, 0, []uint64{1, 2, 3}},
+		{"wraps", 3, 0, 5, 0, []uint64{3, 4, 5}},
+		{"wraps twice", 3, 0, 7, 0, []uint64{5, 6, 7}},
+		{"single", 1, 0, 4, 0, []uint64{4}},
+		{"expires", 5, 2 * time.Second, 4, 5, []uint64{3, 4}},
+		{"expires all", 5, 2 * time.Second, 4, 10, []uint64{}},
+		{"expires after wrap", 3, 2 * time.Second, 5, 6, []uint64{4, 5}},
+		{"no age", 3, 0, 3, 1000, []uint64{1, 2, 3}},
+	}
+	for _, test := range tests {
+		h := newHistoryBuffer(nil, test.count, test.age)
+		for seq := 1; seq <= test.adds; seq++ {
+			h.add(entry(uint64(seq)))
+		}
+		if test.expireAt != 0 {
+			h.expire(start.Add(time.Duration(test.expireAt) * time.Second))
+		}
+		if got := historySeqs(h); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: entries %v, want %v", test.name, got, test.want)
+		}
+		// Dropped entries are not referenced anymore
+		kept := 0
+		for _, e := range h.entries {
+			if e != nil {
+				kept++
+			}
+		}
+		if kept != h.len {
+			t.Errorf("%s: %d entries referenced, want %d", test.name, kept, h.len)
+		}
+	}
+}
+
+// testHistory replaces the history buffers by the ones of the patterns during the test
+func testHistory(t *testing.T, patterns ...string) {
+	saved := histories
+	histories = nil
+	for _, s := range patterns {
+		h, err := parseHistoryPattern(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		histories = append(histories, h)
+	}
+	t.Cleanup(func() { histories = saved })
+}
+
+func TestHistorySince(t *testing.T) {
+	testHistory(t, "robot.#=10/0", "robot.position=10/0", "other=10/0")
+
+	start := time.Unix(1000, 0)
+	publishes := []struct {
+		event string
+		data  string
+	}{
+		{"robot.position", `{"x": 1}`},
+		{"robot.speed", `2`},
+		{"other", `3`},
+		{"robot.position", `{"x": 4}`},
+		{"untracked", `5`},
+		{"robot.position", `{"x": 6}`},
+	}
+	for i, p := range publishes {
+		event := p.event
+		stamp := &publishStamp{uint64(i + 1), start.Add(time.Duration(i) * time.Second), "test"}
+		historyAdd(stamp, &cellaserv.Publish{Event: &event, Data: []byte(p.data)}, nil)
+	}
+
+	tests := []struct {
+		pattern  string
+		filter   string
+		since    int
+		sinceSeq uint64
+		want     []uint64
+	}{
+		// Events in several buffers are returned once
+		{"#", "", 0, 0, []uint64{1, 2, 3, 4, 6}},
+		{"robot.position", "", 0, 0, []uint64{1, 4, 6}},
+		{"robot.*", "", 0, 0, []uint64{1, 2, 4, 6}},
+		{"untracked", "", 0, 0, []uint64{}},
+		{"#", "", 0, 3, []uint64{4, 6}},
+		{"#", "", 3, 0, []uint64{4, 6}},
+		{"#", "", 2, 4, []uint64{6}},
+		{"robot.position", "x > 2", 0, 0, []uint64{4, 6}},
+		{"#", "x == 1 || x > 5", 0, 0, []uint64{1, 6}},
+	}
+	for _, test := range tests {
+		pattern, err := compileTopic(test.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var filter *subscriptionFilter
+		if test.filter != "" {
+			if filter, err = compileFilter(test.filter); err != nil {
+				t.Fatal(err)
+			}
+		}
+		since := time.Time{}
+		if test.since != 0 {
+			since = start.Add(time.Duration(test.since) * time.Second)
+		}
+
+		seqs := make([]uint64, 0)
+		for _, e := range historySince(pattern, filter, since, test.sinceSeq) {
+			seqs = append(seqs, e.seq)
+		}
+		if !reflect.DeepEqual(seqs, test.want) {
+			t.Errorf("historySince(%s, %q, %d, %d) = %v, want %v", test.pattern, test.filter,
+				test.since, test.sinceSeq, seqs, test.want)
+		}
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
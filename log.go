@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/op/go-logging"
+	"io"
 	golog "log"
 	"os"
 	"path"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -19,12 +24,21 @@ var (
 
 	// Command line flags
 	logRootDirectory = flag.String("log-root", ".", "root directory of logs")
+	// Directory of the current session, use logCurrentSession() outside of log.go
 	logSubDir        string
 	logLevelFlag     = flag.String("log-level", "", "logger verbosity")
 	logToFile        = flag.String("log-file", "", "log to custom file instead of stderr")
+	logFormat        = flag.String("log-format", "text", "format of event logs: text or jsonl")
+	logSessionFormat = flag.String("log-session-format", "2006-01-02T15-04-05",
+		"time layout of the log session names")
 
-	// Map of the logger associated with a service
-	servicesLogs map[string]*golog.Logger
+	// Map of the logger associated with a service, and of its file
+	servicesLogs   = make(map[string]*golog.Logger)
+	servicesLogFds = make(map[string]*os.File)
+
+	// Protects the current session: logSubDir, logSession, the log files and their writes. The
+	// session is rotated by the connection handlers and ended by shutdown, while the others log.
+	logMtx sync.Mutex
 )
 
 // Setup that must be done before any log is made. Command line arguments parsing must be done
@@ -57,40 +71,126 @@ func logPreSetup() {
 func logSetup() {
 	logging.SetLevel(logLevel, "cellaserv")
 	// Set default log subDirectory to now
-	logRotateTimeNow()
+	logRotateTimeNow("")
+}
+
+// Name of the symbolic link to the current session, in the log root directory
+const logLatestLink = "latest"
+
+// logSanitizeName returns name with only the characters that are safe in a directory name
+func logSanitizeName(name string) (string, error) {
+	safe := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, name)
+
+	// No hidden directories, nor "." and ".."
+	safe = strings.TrimLeft(safe, ".")
+	if safe == "" || safe == logLatestLink {
+		return "", fmt.Errorf("Invalid session name: %q", name)
+	}
+	return safe, nil
+}
+
+// logCurrentSession returns the name of the current log session
+func logCurrentSession() string {
+	logMtx.Lock()
+	defer logMtx.Unlock()
+	return logSubDir
+}
+
+// logUpdateLatest points the latest link to the current session, logMtx must be held
+func logUpdateLatest() {
+	link := path.Join(*logRootDirectory, logLatestLink)
+	tmpLink := link + ".tmp"
+
+	// Replace the link atomically
+	os.Remove(tmpLink)
+	if err := os.Symlink(logSubDir, tmpLink); err != nil {
+		log.Error("[Log] Could not create link to the current session: %s", err)
+		return
+	}
+	if err := os.Rename(tmpLink, link); err != nil {
+		log.Error("[Log] Could not update link to the current session: %s", err)
+		os.Remove(tmpLink)
+	}
 }
 
 // logRotateName set the new log subdirectory to name
 func logRotateName(name string) {
 	log.Debug("[Log] Rotating to \"%s\"", name)
+
+	logMtx.Lock()
+	// Finish the previous session and close its log files
+	logSessionClose()
+
 	logSubDir = name
 	logFullDir := path.Join(*logRootDirectory, logSubDir)
 	err := os.MkdirAll(logFullDir, 0755)
 	if err != nil {
 		log.Error("[Log] Could not create log directories, %s: %s", logFullDir, err)
 	}
-	// XXX: close old log files?
-	servicesLogs = make(map[string]*golog.Logger)
+	logSessionStart(logSubDir)
+	logUpdateLatest()
+	// Publishing logs the event, the lock is released first
+	logMtx.Unlock()
+
+	dumpSessionRotate()
 
-	pub_data, err := json.Marshal(logSubDir)
+	pub_data, err := json.Marshal(name)
 	if err != nil {
 		log.Error("[Publish] Could not publish new log session, json error: %s: %s",
-			logSubDir, err)
+			name, err)
 	}
 	cellaservPublish(logNewLogSession, pub_data)
+
+	// Make room for the new session
+	logPrune()
 }
 
-// logRotateTimeNow switch the current log subdirectory to current time
-func logRotateTimeNow() {
+// logRotateTimeNow switch the current log subdirectory to current time, followed by the label if
+// not empty. The label must be sanitized.
+func logRotateTimeNow(label string) {
 	now := time.Now()
-	newSubDir := now.Format(time.Stamp)
+	newSubDir := now.Format(*logSessionFormat)
+	if label != "" {
+		newSubDir += "-" + label
+	}
+	if safe, err := logSanitizeName(newSubDir); err == nil {
+		newSubDir = safe
+	}
 	logRotateName(newSubDir)
 }
 
+// A record of an event log in the jsonl format
+type logRecordJSON struct {
+	// Nanoseconds since the epoch
+	Time      int64
+	Event     string
+	Publisher string `json:",omitempty"`
+	// Data is used if the payload is valid JSON, DataBase64 otherwise
+	Data       json.RawMessage `json:",omitempty"`
+	DataBase64 []byte          `json:",omitempty"`
+}
+
+// logFileExt returns the extension of the event log files
+func logFileExt() string {
+	if *logFormat == "jsonl" {
+		return ".jsonl"
+	}
+	return ".log"
+}
+
+// logSetupFile opens the log file of what in the current session, logMtx must be held
 func logSetupFile(what string) (l *golog.Logger) {
 	l, ok := servicesLogs[what]
 	if !ok {
-		logFilename := path.Join(*logRootDirectory, logSubDir, what+".log")
+		logFilename := path.Join(*logRootDirectory, logSubDir, what+logFileExt())
 		logFd, err := os.OpenFile(logFilename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
 		if err != nil {
 			log.Error("[Log] Could not create log file: %s", logFilename)
@@ -99,19 +199,86 @@ func logSetupFile(what string) (l *golog.Logger) {
 		l = golog.New(logFd, what, golog.LstdFlags)
 		l.SetPrefix("")
 		servicesLogs[what] = l
+		servicesLogFds[what] = logFd
+		logSessionAddEvent(path.Base(logFilename))
 	}
 	return
 }
 
-func logEvent(event string, what string) {
-	logger, ok := servicesLogs[event]
+// logCloseFiles closes the log files of the current session, logMtx must be held
+func logCloseFiles() {
+	for what, logFd := range servicesLogFds {
+		if err := logFd.Close(); err != nil {
+			log.Error("[Log] Could not close log file of %s: %s", what, err)
+		}
+	}
+	servicesLogs = make(map[string]*golog.Logger)
+	servicesLogFds = make(map[string]*os.File)
+}
+
+// logEvent logs a publish in the file what, it does nothing once the last session is ended
+func logEvent(what string, publisher string, pub *cellaserv.Publish) {
+	logMtx.Lock()
+	defer logMtx.Unlock()
+
+	if logSubDir == "" {
+		return
+	}
+	logger, ok := servicesLogs[what]
 	if !ok {
-		logger = logSetupFile(event)
+		logger = logSetupFile(what)
 		if logger == nil {
 			return
 		}
 	}
-	logger.Println(what)
+
+	if *logFormat != "jsonl" {
+		var data string
+		if pub.Data != nil {
+			data = string(pub.Data)
+		}
+		logger.Println(data)
+		logSessionCountEvent()
+		return
+	}
+
+	record := logRecordJSON{
+		Time:      time.Now().UnixNano(),
+		Event:     *pub.Event,
+		Publisher: publisher,
+	}
+	record.Data, record.DataBase64 = jsonOrBytes(pub.Data)
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Error("[Log] Could not marshal log record of %s: %s", *pub.Event, err)
+		return
+	}
+	servicesLogFds[what].Write(append(line, '\n'))
+	logSessionCountEvent()
+}
+
+// logReadRecords reads the records of a jsonl log file
+func logReadRecords(filename string) ([]logRecordJSON, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := make([]logRecordJSON, 0)
+	dec := json.NewDecoder(file)
+	for {
+		var record logRecordJSON
+		err := dec.Decode(&record)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
 }
 
 // vim: set nowrap tw=100 noet sw=8:
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Size of the records replied at once if the query does not set MaxBytes
+	logQueryDefaultMaxBytes = 1024 * 1024
+	// Upper limit of MaxBytes, messages are limited to 8MB
+	logQueryMaxBytes = 4 * 1024 * 1024
+
+	// Layout of the timestamp of text log lines, see golog.LstdFlags
+	logTextTimeLayout = "2006/01/02 15:04:05 "
+)
+
+// Query of cellaserv.get-logs
+type logQuery struct {
+	// Glob of the events, default to all events
+	Event string
+	// Session to read, default to the session of Cursor, or to the current session
+	Session string
+	// Keep records between Since and Until included, in nanoseconds since the epoch. 0 means
+	// no limit. The text records are timestamped to the second, they are kept if their second
+	// is between the seconds of Since and Until.
+	Since int64
+	Until int64
+	// Only keep the last Tail records of each file
+	Tail int
+	// Maximum size of the records in the reply
+	MaxBytes int
+	// Cursor of the previous reply, to get the next records
+	Cursor string
+}
+
+// Position of the next record to read. The session is part of the cursor so that the next pages
+// are read from the same session, even if the logs were rotated in the meantime.
+type logCursor struct {
+	Session string
+	File    string
+	Offset  int64
+}
+
+// A record replied by get-logs
+type logQueryRecordJSON struct {
+	// Name of the log file
+	File string
+	logRecordJSON
+	// Payload of text log lines
+	Text string `json:",omitempty"`
+}
+
+type logQueryReplyJSON struct {
+	Records []logQueryRecordJSON
+	// Set if there are more records, give it in the next query
+	Cursor string `json:",omitempty"`
+}
+
+// logReader reads the records of a log file
+type logReader struct {
+	file   *os.File
+	reader *bufio.Reader
+	jsonl  bool
+	event  string
+	// Offset of the next line
+	offset int64
+	// Line read in advance, to find the continuation lines of text records
+	peeked    []byte
+	hasPeeked bool
+}
+
+func newLogReader(filename string, offset int64) (*logReader, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	base := path.Base(filename)
+	jsonl := strings.HasSuffix(base, ".jsonl")
+	event := "log." + strings.TrimSuffix(strings.TrimSuffix(base, ".jsonl"), ".log")
+
+	return &logReader{file: file, reader: bufio.NewReader(file), jsonl: jsonl, event: event,
+		offset: offset}, nil
+}
+
+func (lr *logReader) Close() {
+	lr.file.Close()
+}
+
+func (lr *logReader) readLine() ([]byte, error) {
+	if lr.hasPeeked {
+		lr.hasPeeked = false
+		return lr.peeked, nil
+	}
+	line, err := lr.reader.ReadBytes('\n')
+	if err == io.EOF && len(line) > 0 {
+		// Last line without newline
+		err = nil
+	}
+	return line, err
+}
+
+func (lr *logReader) unreadLine(line []byte) {
+	lr.peeked = line
+	lr.hasPeeked = true
+}
+
+// parseTextTime returns the time of a text log line, and false if it is a continuation line
+func parseTextTime(line []byte) (time.Time, bool) {
+	if len(line) < len(logTextTimeLayout) {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(logTextTimeLayout, string(line[:len(logTextTimeLayout)]),
+		time.Local)
+	return t, err == nil
+}
+
+// next returns the next record and its offset in the file, or io.EOF
+func (lr *logReader) next() (logQueryRecordJSON, int64, error) {
+	rec := logQueryRecordJSON{File: path.Base(lr.file.Name())}
+	start := lr.offset
+
+	line, err := lr.readLine()
+	if err != nil {
+		return rec, start, err
+	}
+	lr.offset += int64(len(line))
+
+	if lr.jsonl {
+		err = json.Unmarshal(line, &rec.logRecordJSON)
+		return rec, start, err
+	}
+
+	rec.Event = lr.event
+	if t, ok := parseTextTime(line); ok {
+		rec.Time = t.UnixNano()
+		line = line[len(logTextTimeLayout):]
+	}
+	text := string(bytes.TrimSuffix(line, []byte("\n")))
+
+	// Payloads with newlines span several lines
+	for {
+		next, err := lr.readLine()
+		if err != nil {
+			break
+		}
+		if _, ok := parseTextTime(next); ok {
+			lr.unreadLine(next)
+			break
+		}
+		lr.offset += int64(len(next))
+		text += "\n" + string(bytes.TrimSuffix(next, []byte("\n")))
+	}
+	rec.Text = text
+
+	return rec, start, nil
+}
+
+// match returns true if the record is between Since and Until, jsonl is false for text records
+func (q *logQuery) match(rec *logQueryRecordJSON, jsonl bool) bool {
+	since, until := q.Since, q.Until
+	if !jsonl {
+		// Compare the seconds, a text record of the second of Since may be logged after it
+		since -= since % int64(time.Second)
+		until -= until % int64(time.Second)
+	}
+	if since != 0 && rec.Time < since {
+		return false
+	}
+	if until != 0 && rec.Time > until {
+		return false
+	}
+	return true
+}
+
+// tailOffset returns the offset of the first of the last q.Tail matching records of the file
+func (q *logQuery) tailOffset(filename string) (int64, error) {
+	lr, err := newLogReader(filename, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer lr.Close()
+
+	offsets := make([]int64, 0, q.Tail)
+	next := 0
+	for {
+		rec, offset, err := lr.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !q.match(&rec, lr.jsonl) {
+			continue
+		}
+		if len(offsets) < q.Tail {
+			offsets = append(offsets, offset)
+		} else {
+			offsets[next] = offset
+			next = (next + 1) % q.Tail
+		}
+	}
+
+	if len(offsets) == 0 {
+		return lr.offset, nil
+	}
+	if len(offsets) < q.Tail {
+		return offsets[0], nil
+	}
+	return offsets[next], nil
+}
+
+// logQueryFiles returns the log files of the query, sorted by name
+func logQueryFiles(q *logQuery) ([]string, error) {
+	sessionDir, err := logSessionDir(q.Session)
+	if err != nil {
+		return nil, err
+	}
+
+	pattern := path.Join(sessionDir, q.Event)
+	if !strings.HasPrefix(pattern, sessionDir+"/") {
+		return nil, fmt.Errorf("Invalid event: %q", q.Event)
+	}
+
+	var filenames []string
+	for _, ext := range []string{".log", ".jsonl"} {
+		matches, err := filepath.Glob(pattern + ext)
+		if err != nil {
+			return nil, err
+		}
+		filenames = append(filenames, matches...)
+	}
+	sort.Strings(filenames)
+
+	return filenames, nil
+}
+
+// logQueryCursor decodes the cursor of the query and sets the session to read, the session of the
+// cursor is used if the query does not give one, otherwise the current session.
+func logQueryCursor(q *logQuery) (logCursor, error) {
+	var cursor logCursor
+	if q.Cursor != "" {
+		data, err := base64.StdEncoding.DecodeString(q.Cursor)
+		if err == nil {
+			err = json.Unmarshal(data, &cursor)
+		}
+		if err != nil {
+			return cursor, fmt.Errorf("Invalid cursor: %s", err)
+		}
+		if q.Session != "" && cursor.Session != "" && q.Session != cursor.Session {
+			return cursor, fmt.Errorf("Invalid cursor: it belongs to session %q",
+				cursor.Session)
+		}
+		if q.Session == "" {
+			q.Session = cursor.Session
+		}
+	}
+	if q.Session == "" {
+		q.Session = logCurrentSession()
+	}
+	return cursor, nil
+}
+
+// logQueryRun reads the records of the query
+func logQueryRun(q *logQuery) (*logQueryReplyJSON, error) {
+	cursor, err := logQueryCursor(q)
+	if err != nil {
+		return nil, err
+	}
+
+	filenames, err := logQueryFiles(q)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &logQueryReplyJSON{Records: make([]logQueryRecordJSON, 0)}
+	size := 0
+
+	for _, filename := range filenames {
+		base := path.Base(filename)
+		// Skip the files already replied
+		if base < cursor.File {
+			continue
+		}
+
+		var offset int64
+		if base == cursor.File {
+			offset = cursor.Offset
+		} else if q.Tail > 0 {
+			offset, err = q.tailOffset(filename)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		lr, err := newLogReader(filename, offset)
+		if err != nil {
+			return nil, err
+		}
+
+		for {
+			rec, recOffset, err := lr.next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				lr.Close()
+				return nil, fmt.Errorf("Could not read %s: %s", base, err)
+			}
+			if !q.match(&rec, lr.jsonl) {
+				continue
+			}
+
+			recJSON, _ := json.Marshal(rec)
+			if size+len(recJSON) > q.MaxBytes && len(reply.Records) > 0 {
+				lr.Close()
+				next, _ := json.Marshal(logCursor{q.Session, base, recOffset})
+				reply.Cursor = base64.StdEncoding.EncodeToString(next)
+				return reply, nil
+			}
+			size += len(recJSON)
+			reply.Records = append(reply.Records, rec)
+		}
+		lr.Close()
+	}
+
+	return reply, nil
+}
+
+// handleLogQuery replies to a get-logs request with a JSON query, see logQuery
+func handleLogQuery(conn net.Conn, req *cellaserv.Request) {
+	q := logQuery{Event: "*"}
+	if err := json.Unmarshal(req.Data, &q); err != nil {
+		log.Warning("[Cellaserv] Could not unmarshal log query: %s, %s", req.Data, err)
+		sendReplyError(conn, req, cellaserv.Reply_Error_BadArguments)
+		return
+	}
+	if q.MaxBytes <= 0 {
+		q.MaxBytes = logQueryDefaultMaxBytes
+	} else if q.MaxBytes > logQueryMaxBytes {
+		q.MaxBytes = logQueryMaxBytes
+	}
+
+	reply, err := logQueryRun(&q)
+	if err != nil {
+		log.Warning("[Cellaserv] Could not query logs: %s", err)
+		sendReplyCustomError(conn, req, err.Error())
+		return
+	}
+
+	data, err := json.Marshal(reply)
+	if err != nil {
+		log.Error("[Cellaserv] Could not marshal the logs")
+	}
+	sendReply(conn, req, data)
+}
+
+// vim: set nowrap tw=100 noet sw=8:
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCursor(session, file string, offset int64) string {
+	data, _ := json.Marshal(logCursor{session, file, offset})
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func TestLogQueryCursor(t *testing.T) {
+	savedSubDir := logSubDir
+	logSubDir = "current"
+	defer func() { logSubDir = savedSubDir }()
+
+	tests := []struct {
+		session, cursor string
+		wantSession     string
+		wantCursor      logCursor
+		wantErr         string
+	}{
+		{"", "", "current", logCursor{}, ""},
+		{"old", "", "old", logCursor{}, ""},
+		{"", testCursor("old", "a.log", 12), "old", logCursor{"old", "a.log", 12}, ""},
+		{"old", testCursor("old", "a.log", 12), "old", logCursor{"old", "a.log", 12}, ""},
+		{"other", testCursor("old", "a.log", 12), "", logCursor{}, "belongs to session"},
+		// Cursors without a session read the current session
+		{"", testCursor("", "a.log", 12), "current", logCursor{"", "a.log", 12}, ""},
+		{"", "not base64!", "", logCursor{}, "Invalid cursor"},
+		{"", base64.StdEncoding.EncodeToString([]byte("{")), "", logCursor{}, "Invalid cursor"},
+	}
+	for _, test := range tests {
+		q := logQuery{Session: test.session, Cursor: test.cursor}
+		cursor, err := logQueryCursor(&q)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("logQueryCursor(%q, %q): error %v, want %q", test.session,
+					test.cursor, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("logQueryCursor(%q, %q): %s", test.session, test.cursor, err)
+			continue
+		}
+		if q.Session != test.wantSession || cursor != test.wantCursor {
+			t.Errorf("logQueryCursor(%q, %q) = %q, %+v, want %q, %+v", test.session,
+				test.cursor, q.Session, cursor, test.wantSession, test.wantCursor)
+		}
+	}
+}
+
+// The pages of a query are read from the same session, even if the logs are rotated between two
+// queries
+func TestLogQueryPagesAcrossRotation(t *testing.T) {
+	root := t.TempDir()
+	savedRoot, savedSubDir := *logRootDirectory, logSubDir
+	*logRootDirectory = root
+	defer func() { *logRootDirectory, logSubDir = savedRoot, savedSubDir }()
+
+	for _, session := range []string{"first", "second"} {
+		os.Mkdir(filepath.Join(root, session), 0755)
+		var lines []string
+		for i := 0; i < 10; i++ {
+			lines = append(lines, fmt.Sprintf(`{"Time":%d,"Event":"log.test","Data":"%s"}`,
+				i, session))
+		}
+		err := os.WriteFile(filepath.Join(root, session, "test.jsonl"),
+			[]byte(strings.Join(lines, "\n")+"\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logSubDir = "first"
+	var records []logQueryRecordJSON
+	cursor := ""
+	for page := 0; ; page++ {
+		q := logQuery{Event: "*", MaxBytes: 150, Cursor: cursor}
+		reply, err := logQueryRun(&q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, reply.Records...)
+		if reply.Cursor == "" {
+			break
+		}
+		if page > 10 {
+			t.Fatal("too many pages")
+		}
+		cursor = reply.Cursor
+		// Rotate after the first page
+		logSubDir = "second"
+	}
+
+	if len(records) != 10 {
+		t.Fatalf("read %d records, want 10", len(records))
+	}
+	for i, rec := range records {
+		if rec.Time != int64(i) || string(rec.Data) != `"first"` {
+			t.Errorf("record %d: %d %s, want %d \"first\"", i, rec.Time, rec.Data, i)
+		}
+	}
+}
+
+// testLogFiles writes a text and a JSONL log file in the session, each record is logged at a
+// second after base, the text records have a second payload line
+func testLogFiles(t *testing.T, root, session string, base time.Time) {
+	os.Mkdir(filepath.Join(root, session), 0755)
+	var text, jsonl []string
+	for i := 0; i < 5; i++ {
+		at := base.Add(time.Duration(i) * time.Second)
+		prefix := at.Format(logTextTimeLayout)
+		text = append(text, fmt.Sprintf("%s%d\nline %d", prefix, i, i))
+		jsonl = append(jsonl, fmt.Sprintf(`{"Time":%d,"Event":"log.test.jsonl","Data":%d}`,
+			at.Add(500*time.Millisecond).UnixNano(), i))
+	}
+	files := map[string][]string{"test.text.log": text, "test.jsonl.jsonl": jsonl}
+	for name, lines := range files {
+		err := os.WriteFile(filepath.Join(root, session, name),
+			[]byte(strings.Join(lines, "\n")+"\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLogQueryRun(t *testing.T) {
+	root := t.TempDir()
+	savedRoot := *logRootDirectory
+	*logRootDirectory = root
+	defer func() { *logRootDirectory = savedRoot }()
+
+	base := time.Date(2020, 1, 2, 15, 4, 5, 0, time.Local)
+	testLogFiles(t, root, "query", base)
+	second := func(i int) int64 { return base.Add(time.Duration(i) * time.Second).UnixNano() }
+
+	tests := []struct {
+		name  string
+		query logQuery
+		// Payloads of the text records then of the JSONL records
+		text, jsonl string
+	}{
+		{"all", logQuery{}, "01234", "01234"},
+		{"tail", logQuery{Tail: 2}, "34", "34"},
+		{"tail larger than the file", logQuery{Tail: 10}, "01234", "01234"},
+		{"since", logQuery{Since: second(3)}, "34", "34"},
+		{"until", logQuery{Until: second(1)}, "01", "0"},
+		{"since and until", logQuery{Since: second(1), Until: second(3)}, "123", "12"},
+		// The text records of the second of Since are kept, the JSONL records are precise
+		{"since within a second", logQuery{Since: second(1) + int64(700*time.Millisecond)},
+			"1234", "234"},
+		{"until within a second", logQuery{Until: second(1) + int64(700*time.Millisecond)},
+			"01", "01"},
+		{"tail since", logQuery{Since: second(1), Until: second(3), Tail: 2}, "23", "12"},
+	}
+	for _, test := range tests {
+		q := test.query
+		q.Event, q.Session, q.MaxBytes = "test.*", "query", logQueryDefaultMaxBytes
+		reply, err := logQueryRun(&q)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		var text, jsonl string
+		for _, rec := range reply.Records {
+			if rec.File == "test.text.log" {
+				// Multi-line payloads are a single record
+				var i int
+				_, err := fmt.Sscanf(rec.Text, "%d\nline %d", &i, &i)
+				if err != nil || rec.Event != "log.test.text" || rec.Time != second(i) {
+					t.Errorf("%s: text record %+v", test.name, rec)
+				}
+				text += rec.Text[:1]
+			} else {
+				jsonl += string(rec.Data)
+			}
+		}
+		if text != test.text || jsonl != test.jsonl {
+			t.Errorf("%s: records %q and %q, want %q and %q", test.name, text, jsonl,
+				test.text, test.jsonl)
+		}
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
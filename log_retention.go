@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path"
+	"time"
+)
+
+var (
+	// Command line flags, 0 means no limit
+	logMaxSessions = flag.Int("log-max-sessions", 0, "maximum number of log sessions kept")
+	logMaxAge      = flag.Duration("log-max-age", 0, "maximum age of the log sessions kept")
+	logMaxBytes    = flag.Int64("log-max-bytes", 0, "maximum total size of the log sessions")
+)
+
+// Sent with logLogPruned
+type logPrunedJSON struct {
+	Sessions []string
+	Bytes    int64
+}
+
+/*
+logPrune removes the oldest log sessions until the retention policy is satisfied.
+
+The current session is never removed. Directories without a session manifest are not removed
+either, they may not be log sessions: they are not counted in the number of sessions nor in their
+size. The archive of a removed session is removed with it.
+*/
+func logPrune() {
+	if *logMaxSessions <= 0 && *logMaxAge <= 0 && *logMaxBytes <= 0 {
+		return
+	}
+
+	sessions, err := logListSessions()
+	if err != nil {
+		log.Error("[Log] Could not list sessions to prune: %s", err)
+		return
+	}
+
+	var totalBytes, otherBytes int64
+	count := 0
+	for i := range sessions {
+		archive := path.Join(*logRootDirectory, sessions[i].Name+".tar.gz")
+		if info, err := os.Stat(archive); err == nil {
+			sessions[i].Size += info.Size()
+		}
+		if sessions[i].hasManifest {
+			count++
+			totalBytes += sessions[i].Size
+		} else {
+			otherBytes += sessions[i].Size
+		}
+	}
+
+	pruned := logPrunedJSON{Sessions: make([]string, 0)}
+	now := time.Now()
+
+	// Sessions are sorted from the oldest
+	for _, session := range sessions {
+		if session.Current || !session.hasManifest {
+			continue
+		}
+
+		tooMany := *logMaxSessions > 0 && count > *logMaxSessions
+		tooOld := *logMaxAge > 0 && now.Sub(session.Start) > *logMaxAge
+		tooBig := *logMaxBytes > 0 && totalBytes > *logMaxBytes
+		if !tooMany && !tooOld && !tooBig {
+			continue
+		}
+
+		sessionDir := path.Join(*logRootDirectory, session.Name)
+		if err := os.RemoveAll(sessionDir); err != nil {
+			log.Error("[Log] Could not prune session %s: %s", session.Name, err)
+			continue
+		}
+		os.Remove(sessionDir + ".tar.gz")
+		log.Info("[Log] Pruned session %s", session.Name)
+
+		count--
+		totalBytes -= session.Size
+		pruned.Sessions = append(pruned.Sessions, session.Name)
+		pruned.Bytes += session.Size
+	}
+
+	if *logMaxBytes > 0 && otherBytes > 0 && totalBytes+otherBytes > *logMaxBytes {
+		log.Warning("[Log] Directories without a session manifest use %d bytes in %s, "+
+			"they are not pruned", otherBytes, *logRootDirectory)
+	}
+
+	if len(pruned.Sessions) == 0 {
+		return
+	}
+
+	pub_json, _ := json.Marshal(pruned)
+	cellaservPublish(logLogPruned, pub_json)
+}
+
+// vim: set nowrap tw=100 noet sw=8:
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testPruneSessions writes the sessions a, b and c in the log root, started 3, 2 and 1 hours ago
+// with 10000 bytes of logs each, a directory that is not a session, older and bigger than them,
+// and starts the current session
+func testPruneSessions(t *testing.T) string {
+	root := testLogSession(t)
+	for i, name := range []string{"a", "b", "c"} {
+		dir := filepath.Join(root, name)
+		os.Mkdir(dir, 0755)
+		start := time.Now().Add(-time.Duration(3-i) * time.Hour)
+		manifest, _ := json.Marshal(logSessionJSON{Name: name, Start: start})
+		os.WriteFile(filepath.Join(dir, logSessionManifest), manifest, 0644)
+		os.WriteFile(filepath.Join(dir, "robot.log"), make([]byte, 10000), 0644)
+	}
+	os.WriteFile(filepath.Join(root, "a.tar.gz"), []byte("archive"), 0644)
+
+	other := filepath.Join(root, "other")
+	os.Mkdir(other, 0755)
+	os.WriteFile(filepath.Join(other, "data"), make([]byte, 100000), 0644)
+	old := time.Now().Add(-24 * time.Hour)
+	os.Chtimes(other, old, old)
+
+	logRotateName("current")
+	return root
+}
+
+// testSessionsLeft returns the directories left in the log root
+func testSessionsLeft(t *testing.T, root string) string {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return fmt.Sprint(names)
+}
+
+func TestLogPrune(t *testing.T) {
+	tests := []struct {
+		name     string
+		sessions int
+		age      time.Duration
+		bytes    int64
+		want     string
+	}{
+		{"no limit", 0, 0, 0, "[a b c current other]"},
+		{"by count", 2, 0, 0, "[c current other]"},
+		{"by age", 0, 90 * time.Minute, 0, "[c current other]"},
+		{"by bytes", 0, 0, 25000, "[b c current other]"},
+		{"by count and age", 3, 150 * time.Minute, 0, "[b c current other]"},
+		// The current session and the other directory are never removed
+		{"all", 1, time.Nanosecond, 1, "[current other]"},
+	}
+	defer func() { *logMaxSessions, *logMaxAge, *logMaxBytes = 0, 0, 0 }()
+	for _, test := range tests {
+		root := testPruneSessions(t)
+		*logMaxSessions, *logMaxAge, *logMaxBytes = test.sessions, test.age, test.bytes
+		logPrune()
+		*logMaxSessions, *logMaxAge, *logMaxBytes = 0, 0, 0
+
+		if got := testSessionsLeft(t, root); got != test.want {
+			t.Errorf("%s: sessions left %s, want %s", test.name, got, test.want)
+		}
+		_, err := os.Stat(filepath.Join(root, "a.tar.gz"))
+		if archived := err == nil; archived != (test.want == "[a b c current other]") {
+			t.Errorf("%s: archive of a kept: %t", test.name, archived)
+		}
+	}
+}
+
+func TestLogPrunePublish(t *testing.T) {
+	root := testPruneSessions(t)
+	_, listener := testSubscriber(t, logLogPruned)
+
+	*logMaxSessions = 2
+	defer func() { *logMaxSessions = 0 }()
+	go logPrune()
+
+	msg := testRead(t, listener)
+	pub := &cellaserv.Publish{}
+	proto.Unmarshal(msg.Content, pub)
+	var pruned logPrunedJSON
+	if err := json.Unmarshal(pub.Data, &pruned); err != nil {
+		t.Fatalf("%s: %s", pub.Data, err)
+	}
+	// The sizes of the manifests vary with the start times
+	if fmt.Sprint(pruned.Sessions) != "[a b]" || pruned.Bytes < 2*10000+int64(len("archive")) {
+		t.Errorf("Pruned %+v, want a and b", pruned)
+	}
+	if got := testSessionsLeft(t, root); got != "[c current other]" {
+		t.Errorf("Sessions left %s", got)
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
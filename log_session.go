@@ -0,0 +1,504 @@
+package main
+
+import (
+	"archive/tar"
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Name of the manifest written in each log session directory
+const logSessionManifest = "session.json"
+
+// Manifest of a log session
+type logSessionJSON struct {
+	Name    string
+	Start   time.Time
+	End     *time.Time `json:",omitempty"`
+	Version string
+	// Clients connected and services registered during the session
+	Clients  []connNameJSON
+	Services []string
+	// Files of the events logged during the session
+	Events []string
+	// Number of events logged during the session, only written when the session ends
+	EventCount *int `json:",omitempty"`
+}
+
+type logSessionState struct {
+	name  string
+	start time.Time
+	// Map client address to its last known name
+	clients  map[string]string
+	services map[string]bool
+	events   map[string]bool
+	// Number of events logged
+	eventCount int
+}
+
+var (
+	// Current log session, nil before logSetup(), protected by logMtx
+	logSession *logSessionState
+
+	// Clients connected and services registered, part of the next sessions, protected by
+	// logMtx. They are kept here as the maps of the connection handlers cannot be read from
+	// another goroutine.
+	logClients  = make(map[string]string)
+	logServices = make(map[string]bool)
+)
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// logSessionWrite writes the manifest of the current session, end is nil if it is not finished.
+// logMtx must be held.
+func logSessionWrite(end *time.Time) {
+	if logSession == nil {
+		return
+	}
+
+	clients := make([]connNameJSON, 0, len(logSession.clients))
+	for addr, name := range logSession.clients {
+		clients = append(clients, connNameJSON{addr, name})
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Addr < clients[j].Addr })
+
+	manifest := logSessionJSON{
+		Name:     logSession.name,
+		Start:    logSession.start,
+		End:      end,
+		Version:  csVersion,
+		Clients:  clients,
+		Services: sortedKeys(logSession.services),
+		Events:   sortedKeys(logSession.events),
+	}
+	if end != nil {
+		manifest.EventCount = &logSession.eventCount
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		log.Error("[Log] Could not marshal session manifest: %s", err)
+		return
+	}
+
+	filename := path.Join(*logRootDirectory, logSession.name, logSessionManifest)
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		log.Error("[Log] Could not write session manifest, %s: %s", filename, err)
+	}
+}
+
+// logSessionStart starts a new session, already connected clients and services are part of it.
+// logMtx must be held.
+func logSessionStart(name string) {
+	logSession = &logSessionState{
+		name:     name,
+		start:    time.Now(),
+		clients:  make(map[string]string),
+		services: make(map[string]bool),
+		events:   make(map[string]bool),
+	}
+	for addr, name := range logClients {
+		logSession.clients[addr] = name
+	}
+	for s := range logServices {
+		logSession.services[s] = true
+	}
+
+	logSessionWrite(nil)
+}
+
+// logSessionClose writes the final manifest of the session and closes its log files, logMtx must
+// be held
+func logSessionClose() {
+	if logSession != nil {
+		now := time.Now()
+		logSessionWrite(&now)
+		logSession = nil
+	}
+	logCloseFiles()
+}
+
+// logSessionEnd ends the last session, the events published afterwards are not logged
+func logSessionEnd() {
+	logMtx.Lock()
+	defer logMtx.Unlock()
+
+	logSessionClose()
+	logSubDir = ""
+}
+
+// logSessionAddClient adds the client to the session, or updates its name
+func logSessionAddClient(conn net.Conn) {
+	addr, name := conn.RemoteAddr().String(), connDescribe(conn)
+
+	logMtx.Lock()
+	defer logMtx.Unlock()
+
+	logClients[addr] = name
+	if logSession == nil {
+		return
+	}
+	if known, ok := logSession.clients[addr]; !ok || known != name {
+		logSession.clients[addr] = name
+		logSessionWrite(nil)
+	}
+}
+
+// logSessionRemoveClient removes the client from the next sessions, it stays in the current one
+func logSessionRemoveClient(conn net.Conn) {
+	logMtx.Lock()
+	delete(logClients, conn.RemoteAddr().String())
+	logMtx.Unlock()
+}
+
+func logSessionAddService(s *Service) {
+	logMtx.Lock()
+	defer logMtx.Unlock()
+
+	logServices[s.String()] = true
+	if logSession != nil && !logSession.services[s.String()] {
+		logSession.services[s.String()] = true
+		logSessionWrite(nil)
+	}
+}
+
+// logSessionRemoveService removes the service from the next sessions, it stays in the current one
+func logSessionRemoveService(s *Service) {
+	logMtx.Lock()
+	delete(logServices, s.String())
+	logMtx.Unlock()
+}
+
+// logSessionCountEvent counts an event logged in the current session, logMtx must be held
+func logSessionCountEvent() {
+	if logSession != nil {
+		logSession.eventCount++
+	}
+}
+
+// logSessionAddEvent adds the log file to the current session, logMtx must be held
+func logSessionAddEvent(filename string) {
+	if logSession != nil && !logSession.events[filename] {
+		logSession.events[filename] = true
+		logSessionWrite(nil)
+	}
+}
+
+/*
+logSessionDir returns the directory of a session, if the name is valid.
+
+The directory is removed by delete-session: the name must be a directory right under the log root.
+"." and "..", hidden directories, path separators and the latest link are rejected.
+*/
+func logSessionDir(name string) (string, error) {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) ||
+		name == logLatestLink {
+		return "", fmt.Errorf("Invalid session: %q", name)
+	}
+	dir := filepath.Join(*logRootDirectory, name)
+	if filepath.Dir(dir) != filepath.Clean(*logRootDirectory) {
+		return "", fmt.Errorf("Invalid session: %q", name)
+	}
+	return dir, nil
+}
+
+// Description of a session replied by list-sessions
+type sessionInfoJSON struct {
+	Name  string
+	Start time.Time
+	// Size of the files of the session, in bytes
+	Size int64
+	// Number of logged events, missing if it is unknown
+	Events  *int `json:",omitempty"`
+	Current bool
+
+	// The directory holds a session manifest
+	hasManifest bool
+}
+
+/*
+logSessionInfo reads the description of the session stored in dir.
+
+The number of events is counted by the current session, and read from the manifest of the
+finished sessions: the log files are not read. It is unknown for the sessions that were not ended
+properly and for the ones created by older versions.
+*/
+func logSessionInfo(dir os.FileInfo) sessionInfoJSON {
+	info := sessionInfoJSON{
+		Name:  dir.Name(),
+		Start: dir.ModTime(),
+	}
+
+	// Read the current session first, it may be rotated while reading the files
+	var count int
+	logMtx.Lock()
+	info.Current = dir.Name() == logSubDir
+	if info.Current && logSession != nil {
+		count = logSession.eventCount
+	}
+	logMtx.Unlock()
+
+	sessionDir := path.Join(*logRootDirectory, dir.Name())
+
+	// The manifest is missing in sessions created by older versions
+	var manifest logSessionJSON
+	data, err := ioutil.ReadFile(path.Join(sessionDir, logSessionManifest))
+	if err == nil && json.Unmarshal(data, &manifest) == nil {
+		info.Start = manifest.Start
+		info.Events = manifest.EventCount
+		info.hasManifest = true
+	}
+	if info.Current {
+		info.Events = &count
+	}
+
+	files, _ := ioutil.ReadDir(sessionDir)
+	for _, file := range files {
+		info.Size += file.Size()
+	}
+
+	return info
+}
+
+// logListSessions returns the sessions under the log root, sorted by start time
+func logListSessions() ([]sessionInfoJSON, error) {
+	entries, err := ioutil.ReadDir(*logRootDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]sessionInfoJSON, 0)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			sessions = append(sessions, logSessionInfo(entry))
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Start.Before(sessions[j].Start)
+	})
+
+	return sessions, nil
+}
+
+// handleListSessions replies with the log sessions
+func handleListSessions(conn net.Conn, req *cellaserv.Request) {
+	sessions, err := logListSessions()
+	if err != nil {
+		log.Warning("[Cellaserv] Could not list sessions: %s", err)
+		sendReplyCustomError(conn, req, err.Error())
+		return
+	}
+
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		log.Error("[Cellaserv] Could not marshal the sessions")
+	}
+	sendReply(conn, req, data)
+}
+
+/*
+handleDeleteSession removes a log session. The current session cannot be deleted.
+
+Request format:
+
+	{"Session": "name"}
+*/
+func handleDeleteSession(conn net.Conn, req *cellaserv.Request) {
+	var data struct {
+		Session string
+	}
+
+	if err := json.Unmarshal(req.Data, &data); err != nil {
+		log.Warning("[Cellaserv] Could not unmarshal delete-session: %s, %s", req.Data, err)
+		sendReplyError(conn, req, cellaserv.Reply_Error_BadArguments)
+		return
+	}
+
+	sessionDir, err := logSessionDir(data.Session)
+	if err != nil {
+		log.Warning("[Cellaserv] Could not delete session: %s", err)
+		sendReplyError(conn, req, cellaserv.Reply_Error_BadArguments)
+		return
+	}
+	if data.Session == logCurrentSession() {
+		log.Warning("[Cellaserv] Could not delete the current session")
+		sendReplyCustomError(conn, req, "cannot delete the current session")
+		return
+	}
+	if _, err := os.Stat(sessionDir); err != nil {
+		log.Warning("[Cellaserv] No such session: %s", data.Session)
+		sendReplyError(conn, req, cellaserv.Reply_Error_BadArguments)
+		return
+	}
+
+	if err := os.RemoveAll(sessionDir); err != nil {
+		log.Error("[Cellaserv] Could not delete session %s: %s", data.Session, err)
+		sendReplyCustomError(conn, req, err.Error())
+		return
+	}
+	log.Info("[Cellaserv] Deleted session %s", data.Session)
+
+	sendReply(conn, req, nil)
+}
+
+/*
+logArchiveSession writes a tar.gz archive of the session directory in filename.
+
+The archive is written in a temporary file renamed at the end, a previous archive is kept if it
+fails. Only a previous archive can be replaced: filename must not be a directory, such as a
+session named like the archive.
+*/
+func logArchiveSession(name string, sessionDir string, filename string) error {
+	if info, err := os.Lstat(filename); err == nil && !info.Mode().IsRegular() {
+		return fmt.Errorf("Could not write the archive, %s is not a file", filename)
+	}
+
+	tmpFilename := filename + ".tmp"
+	file, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		file.Close()
+		os.Remove(tmpFilename)
+	}()
+
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+
+	err = filepath.Walk(sessionDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// The archive is not part of itself
+		if p == tmpFilename || p == filename {
+			return nil
+		}
+		rel, err := filepath.Rel(sessionDir, p)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = path.Join(name, filepath.ToSlash(rel))
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		// Files of the current session may grow while archiving
+		_, err = io.CopyN(tw, f, info.Size())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
+
+/*
+handleArchiveSession creates a tar.gz archive of a log session, with its packet captures.
+
+The archive is written in the log root directory, next to the session.
+
+Request format:
+
+	{"Session": "name"}
+
+Reply format:
+
+	{"Path": "...", "Size": 1234, "Data": "base64..."}
+
+Data holds the archive if it is small enough to be sent in a message.
+*/
+func handleArchiveSession(conn net.Conn, req *cellaserv.Request) {
+	var data struct {
+		Session string
+	}
+
+	if err := json.Unmarshal(req.Data, &data); err != nil {
+		log.Warning("[Cellaserv] Could not unmarshal archive-session: %s, %s", req.Data, err)
+		sendReplyError(conn, req, cellaserv.Reply_Error_BadArguments)
+		return
+	}
+
+	sessionDir, err := logSessionDir(data.Session)
+	if err != nil {
+		log.Warning("[Cellaserv] Could not archive session: %s", err)
+		sendReplyError(conn, req, cellaserv.Reply_Error_BadArguments)
+		return
+	}
+	if info, err := os.Stat(sessionDir); err != nil || !info.IsDir() {
+		log.Warning("[Cellaserv] No such session: %s", data.Session)
+		sendReplyError(conn, req, cellaserv.Reply_Error_BadArguments)
+		return
+	}
+
+	archiveName := sessionDir + ".tar.gz"
+	if err := logArchiveSession(data.Session, sessionDir, archiveName); err != nil {
+		log.Error("[Cellaserv] Could not archive session %s: %s", data.Session, err)
+		sendReplyCustomError(conn, req, err.Error())
+		return
+	}
+
+	var archive struct {
+		Path string
+		Size int64
+		Data []byte `json:",omitempty"`
+	}
+	archive.Path = archiveName
+	if info, err := os.Stat(archiveName); err == nil {
+		archive.Size = info.Size()
+	}
+	if archive.Size <= logQueryMaxBytes {
+		archive.Data, _ = ioutil.ReadFile(archiveName)
+	}
+	log.Info("[Cellaserv] Archived session %s in %s", data.Session, archiveName)
+
+	reply, err := json.Marshal(archive)
+	if err != nil {
+		log.Error("[Cellaserv] Could not marshal the archive")
+	}
+	sendReply(conn, req, reply)
+}
+
+// vim: set nowrap tw=100 noet sw=8:
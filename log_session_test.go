@@ -0,0 +1,368 @@
+package main
+
+import (
+	"archive/tar"
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// testLogSession sets up an empty log root, and restores the test session at the end of the test
+func testLogSession(t *testing.T) string {
+	root := t.TempDir()
+	savedRoot := *logRootDirectory
+	*logRootDirectory = root
+	t.Cleanup(func() {
+		logSessionEnd()
+		*logRootDirectory = savedRoot
+		logMtx.Lock()
+		logSubDir = "test"
+		logMtx.Unlock()
+	})
+	return root
+}
+
+// testReadManifest reads the manifest of the session
+func testReadManifest(t *testing.T, root, session string) logSessionJSON {
+	data, err := os.ReadFile(filepath.Join(root, session, logSessionManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest logSessionJSON
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatalf("%s: %s", data, err)
+	}
+	return manifest
+}
+
+// testCheckLatest checks that the latest link points to the session
+func testCheckLatest(t *testing.T, root, session string) {
+	target, err := os.Readlink(filepath.Join(root, logLatestLink))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != session {
+		t.Errorf("%s links to %s, want %s", logLatestLink, target, session)
+	}
+}
+
+func testLogPublish(event string) {
+	logEvent(event, "test", &cellaserv.Publish{Event: &event, Data: []byte(`"data"`)})
+}
+
+func TestLogSessionManifest(t *testing.T) {
+	root := testLogSession(t)
+	client := testTCPConn(t, "10.1.1.1:5000")
+	service := &Service{Conn: client, Name: "robot", Identification: "pal"}
+
+	logRotateName("first")
+	logSessionAddClient(client)
+	logSessionAddService(service)
+	testLogPublish("robot.position")
+	testLogPublish("robot.position")
+
+	first := testReadManifest(t, root, "first")
+	if first.Name != "first" || first.End != nil || first.EventCount != nil {
+		t.Errorf("Current session manifest %+v, want no end nor count", first)
+	}
+	if len(first.Clients) != 1 || first.Clients[0].Addr != "10.1.1.1:5000" {
+		t.Errorf("Clients %+v, want 10.1.1.1:5000", first.Clients)
+	}
+	if fmt.Sprint(first.Services) != "[robot/pal]" {
+		t.Errorf("Services %v, want robot/pal", first.Services)
+	}
+	// The new session is published, and logged in the session
+	ext := logFileExt()
+	want := fmt.Sprintf("[cellaserv.new-log-session%s robot.position%s]", ext, ext)
+	if fmt.Sprint(first.Events) != want {
+		t.Errorf("Events %v, want %s", first.Events, want)
+	}
+	testCheckLatest(t, root, "first")
+
+	// The connected clients and registered services are carried over to the next session
+	logRotateName("second")
+	first = testReadManifest(t, root, "first")
+	if first.End == nil || first.EventCount == nil || *first.EventCount != 3 {
+		t.Errorf("Finished session manifest %+v, want an end and 3 events", first)
+	}
+	second := testReadManifest(t, root, "second")
+	if second.End != nil || len(second.Clients) != 1 || len(second.Services) != 1 {
+		t.Errorf("New session manifest %+v, want the client and service", second)
+	}
+	testCheckLatest(t, root, "second")
+
+	// The clients and services that left are not
+	logSessionRemoveService(service)
+	logSessionRemoveClient(client)
+	logRotateName("third")
+	third := testReadManifest(t, root, "third")
+	if len(third.Clients) != 0 || len(third.Services) != 0 {
+		t.Errorf("Session manifest %+v, want no client nor service", third)
+	}
+	testCheckLatest(t, root, "third")
+
+	// The events published after the end of the sessions are not logged
+	logSessionEnd()
+	testLogPublish("robot.late")
+	if _, err := os.Stat(filepath.Join(root, "third", "robot.late"+logFileExt())); err == nil {
+		t.Error("Event logged after the end of the session")
+	}
+}
+
+// Events are logged while the sessions rotate, run with -race
+func TestLogSessionRotateConcurrent(t *testing.T) {
+	testLogSession(t)
+	logRotateName("rotate-0")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				testLogPublish(fmt.Sprintf("robot.%d", j%5))
+			}
+		}(i)
+	}
+	for i := 1; i <= 5; i++ {
+		logRotateName(fmt.Sprintf("rotate-%d", i))
+	}
+	wg.Wait()
+
+	if session := logCurrentSession(); session != "rotate-5" {
+		t.Errorf("Current session %s, want rotate-5", session)
+	}
+}
+
+func TestLogSanitizeName(t *testing.T) {
+	tests := []struct {
+		name, want string
+		wantErr    bool
+	}{
+		{"match-1_final.2", "match-1_final.2", false},
+		{"2020-01-02T15:04:05", "2020-01-02T15_04_05", false},
+		{"../etc", "_etc", false},
+		{"a/../../b", "a_.._.._b", false},
+		{`a\b`, "a_b", false},
+		{".hidden", "hidden", false},
+		{"été", "_t_", false},
+		{"", "", true},
+		{".", "", true},
+		{"..", "", true},
+		{logLatestLink, "", true},
+	}
+	for _, test := range tests {
+		got, err := logSanitizeName(test.name)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("logSanitizeName(%q) = %q, %v, want %q", test.name, got, err,
+				test.want)
+		}
+	}
+}
+
+func TestLogSessionDir(t *testing.T) {
+	savedRoot := *logRootDirectory
+	*logRootDirectory = "/var/log/cellaserv/"
+	defer func() { *logRootDirectory = savedRoot }()
+
+	for _, name := range []string{"match", "2020-01-02T15-04-05", "a..b"} {
+		dir, err := logSessionDir(name)
+		if err != nil || dir != "/var/log/cellaserv/"+name {
+			t.Errorf("logSessionDir(%q) = %s, %v", name, dir, err)
+		}
+	}
+	for _, name := range []string{"", ".", "..", "../etc", "a/b", "a/..", `..\`, ".hidden",
+		logLatestLink} {
+		if dir, err := logSessionDir(name); err == nil {
+			t.Errorf("logSessionDir(%q) = %s, want an error", name, dir)
+		}
+	}
+}
+
+// testCall calls the handler of a request with data, and returns its reply
+func testCall(t *testing.T, handler func(net.Conn, *cellaserv.Request),
+	data string) *cellaserv.Reply {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	sendQueueAdd(conn)
+	defer sendQueueRemove(conn)
+
+	req := testRequest("cellaserv", "", "test")
+	req.Data = []byte(data)
+	go handler(conn, req)
+	msg := testRead(t, peer)
+	rep := &cellaserv.Reply{}
+	if err := proto.Unmarshal(msg.Content, rep); err != nil {
+		t.Fatal(err)
+	}
+	return rep
+}
+
+// testSessions writes finished sessions in the log root, with a log file each
+func testSessions(t *testing.T, root string, names ...string) {
+	for _, name := range names {
+		os.Mkdir(filepath.Join(root, name), 0755)
+		count := 4
+		manifest, _ := json.Marshal(logSessionJSON{Name: name, EventCount: &count})
+		os.WriteFile(filepath.Join(root, name, logSessionManifest), manifest, 0644)
+		os.WriteFile(filepath.Join(root, name, "robot.log"), []byte(name+"\n"), 0644)
+	}
+}
+
+func TestHandleListSessions(t *testing.T) {
+	root := testLogSession(t)
+	testSessions(t, root, "old")
+	logRotateName("current")
+
+	rep := testCall(t, handleListSessions, "")
+	var sessions []sessionInfoJSON
+	if err := json.Unmarshal(rep.Data, &sessions); err != nil {
+		t.Fatalf("%s: %s", rep.Data, err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("Sessions %s, want old and current", rep.Data)
+	}
+	old, current := sessions[0], sessions[1]
+	if old.Name != "old" || old.Current || old.Events == nil || *old.Events != 4 ||
+		old.Size == 0 {
+		t.Errorf("Session %+v, want old with 4 events", old)
+	}
+	if current.Name != "current" || !current.Current || current.Events == nil {
+		t.Errorf("Session %+v, want the current session", current)
+	}
+}
+
+func TestHandleDeleteSession(t *testing.T) {
+	root := testLogSession(t)
+	testSessions(t, root, "old")
+	logRotateName("current")
+
+	// A file outside of the log root, that a path traversal would remove
+	outside := filepath.Join(t.TempDir(), "outside")
+	os.Mkdir(outside, 0755)
+
+	tests := []struct {
+		session   string
+		wantError bool
+	}{
+		{"current", true},
+		{"missing", true},
+		{"..", true},
+		{"../" + filepath.Base(outside), true},
+		{"", true},
+		{logLatestLink, true},
+		{"old", false},
+	}
+	for _, test := range tests {
+		data, _ := json.Marshal(map[string]string{"Session": test.session})
+		rep := testCall(t, handleDeleteSession, string(data))
+		if (rep.Error != nil) != test.wantError {
+			t.Errorf("delete-session %q: error %v, want error %v", test.session,
+				rep.Error, test.wantError)
+		}
+	}
+
+	for _, dir := range []string{filepath.Join(root, "current"), outside} {
+		if _, err := os.Stat(dir); err != nil {
+			t.Errorf("%s was removed", dir)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "old")); err == nil {
+		t.Error("The old session was not removed")
+	}
+	if rep := testCall(t, handleDeleteSession, "{"); rep.Error.GetType() !=
+		cellaserv.Reply_Error_BadArguments {
+		t.Errorf("Invalid request: error %v, want BadArguments", rep.Error)
+	}
+}
+
+// testArchiveFiles returns the names of the files in the archive, and the content of robot.log
+func testArchiveFiles(t *testing.T, data []byte) ([]string, string) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	var names []string
+	var robot string
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+		if filepath.Base(header.Name) == "robot.log" {
+			content, _ := io.ReadAll(tr)
+			robot = string(content)
+		}
+	}
+	sort.Strings(names)
+	return names, robot
+}
+
+func TestHandleArchiveSession(t *testing.T) {
+	root := testLogSession(t)
+	testSessions(t, root, "old")
+
+	var archive struct {
+		Path string
+		Size int64
+		Data []byte
+	}
+	for i := 0; i < 2; i++ {
+		// Archiving again replaces the archive
+		rep := testCall(t, handleArchiveSession, `{"Session": "old"}`)
+		if rep.Error != nil {
+			t.Fatalf("archive-session: %v", rep.Error)
+		}
+		if err := json.Unmarshal(rep.Data, &archive); err != nil {
+			t.Fatalf("%s: %s", rep.Data, err)
+		}
+	}
+	if archive.Path != filepath.Join(root, "old.tar.gz") ||
+		archive.Size != int64(len(archive.Data)) {
+		t.Errorf("Archive %s of %d bytes, with %d bytes of data", archive.Path,
+			archive.Size, len(archive.Data))
+	}
+	names, robot := testArchiveFiles(t, archive.Data)
+	want := "[old/ old/robot.log old/session.json]"
+	if fmt.Sprint(names) != want || robot != "old\n" {
+		t.Errorf("Archive files %v, robot.log %q, want %s", names, robot, want)
+	}
+	if _, err := os.Stat(archive.Path + ".tmp"); err == nil {
+		t.Error("The temporary archive was not removed")
+	}
+
+	// A session named like the archive of another one is not overwritten
+	testSessions(t, root, "new", "new.tar.gz")
+	rep := testCall(t, handleArchiveSession, `{"Session": "new"}`)
+	if rep.Error == nil {
+		t.Error("archive-session over a session succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(root, "new.tar.gz", "robot.log")); err != nil {
+		t.Errorf("The session named like the archive was modified: %s", err)
+	}
+
+	for _, session := range []string{"..", "missing", logLatestLink} {
+		rep := testCall(t, handleArchiveSession, fmt.Sprintf(`{"Session": %q}`, session))
+		if rep.Error == nil {
+			t.Errorf("archive-session %q succeeded", session)
+		}
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
@@ -4,24 +4,33 @@ import (
 	"bitbucket.org/evolutek/cellaserv2-protobuf"
 	"github.com/golang/protobuf/proto"
 	"container/list"
-	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
-	"io"
+	"sync"
+	"time"
 )
 
 var (
 	// Command line flags
 	versionFlag    = flag.Bool("version", false, "output version information and exit")
 	sockPortFlag   = flag.String("port", "", "listening port")
+	sockUnixFlag   = flag.String("unix-socket", "", "also listen on the unix socket PATH")
 	sockAddrListen = ":4200"
 
+	// Listeners accepting new connections, closed on shutdown
+	listeners []net.Listener
+
 	// List of all currently handled connections
 	connList *list.List
 
+	// Running connection handlers, waited for by shutdown
+	connHandlers sync.WaitGroup
+
 	// Map a connection to a name, filled with cellaserv.descrbie-conn
 	connNameMap map[net.Conn]string
 
@@ -34,14 +43,16 @@ var (
 	// Map of all services associated with a connection
 	servicesConn map[net.Conn][]*Service
 
-	// Map of requests ids with associated timeout timer
+	// Map of requests ids with associated timeout timer, protected by reqIdsMtx
 	reqIds             map[uint64]*RequestTracking
+	reqIdsMtx          sync.Mutex
 	subscriberMap      map[string][]net.Conn
 	subscriberMatchMap map[string][]net.Conn
 )
 
 // Manage incoming connexions
 func handle(conn net.Conn) {
+	defer connHandlers.Done()
 	log.Info("[Net] Connection opened: %s", connDescribe(conn))
 
 	connJson := connToJson(conn)
@@ -49,6 +60,10 @@ func handle(conn net.Conn) {
 
 	// Append to list of handled connections
 	connListElt := connList.PushBack(conn)
+	metricsClients(1)
+	statsAddConn(conn)
+	sendQueueAdd(conn)
+	logSessionAddClient(conn)
 
 	// Handle all messages received on this connection
 	for {
@@ -68,6 +83,9 @@ func handle(conn net.Conn) {
 	// Clean connection name, if not given this is a noop
 	delete(connNameMap, conn)
 
+	// Forget admin rights given by cellaserv.authenticate
+	delete(connAdmins, conn)
+
 	// Remove services registered by this connection
 	// TODO: notify goroutines waiting for acks for this service
 	for _, s := range servicesConn[conn] {
@@ -75,6 +93,8 @@ func handle(conn net.Conn) {
 		pub_json, _ := json.Marshal(s.JSONStruct())
 		cellaservPublish(logLostService, pub_json)
 		delete(services[s.Name], s.Identification)
+		metricsServices(-1)
+		logSessionRemoveService(s)
 
 		// Close connections that spied this service
 		for _, c := range s.Spies {
@@ -85,28 +105,13 @@ func handle(conn net.Conn) {
 	delete(servicesConn, conn)
 
 	// Remove subscribes from this connection
-	removeConnFromMap := func(subMap map[string][]net.Conn) {
-		for key, subs := range subMap {
-			for i, subConn := range subs {
-				if conn == subConn {
-					// Remove from list of subscribers
-					subs[i] = subs[len(subs)-1]
-					subMap[key] = subs[:len(subs)-1]
-
-					pub_json, _ := json.Marshal(
-						LogSubscriberJSON{key, connDescribe(conn)})
-					cellaservPublish(logLostSubscriber, pub_json)
-
-					if len(subMap[key]) == 0 {
-						delete(subMap, key)
-						break
-					}
-				}
-			}
-		}
+	pubsubMtx.Lock()
+	lostEvents := unsubscribeAll(conn)
+	pubsubMtx.Unlock()
+	for _, event := range lostEvents {
+		pub_json, _ := json.Marshal(LogSubscriberJSON{event, connDescribe(conn)})
+		cellaservPublish(logLostSubscriber, pub_json)
 	}
-	removeConnFromMap(subscriberMap)
-	removeConnFromMap(subscriberMatchMap)
 
 	// Remove conn from the services it spied
 	for _, srvc := range connSpies[conn] {
@@ -122,6 +127,11 @@ func handle(conn net.Conn) {
 	delete(connSpies, conn)
 
 	cellaservPublish(logCloseConnection, connJson)
+
+	metricsClients(-1)
+	logSessionRemoveClient(conn)
+	statsRemoveConn(conn)
+	sendQueueRemove(conn)
 }
 
 func logUnmarshalError(msg []byte) {
@@ -133,28 +143,18 @@ func logUnmarshalError(msg []byte) {
 }
 
 func handleMessage(conn net.Conn) (bool, error) {
-	// Read message length as uint32
-	var msgLen uint32
-	err := binary.Read(conn, binary.BigEndian, &msgLen)
-	if err != nil {
-		if err == io.EOF {
-			return true, nil
-		}
-		return true, fmt.Errorf("Could not read message length: %s", err)
-	}
-
-	if msgLen > 8*1024*1024 {
-		return false, fmt.Errorf("Request too big: %d", msgLen)
+	msgBytes, err := readRawMessage(conn)
+	if err == io.EOF {
+		return true, nil
 	}
-
-	msgBytes := make([]byte, msgLen)
-	_, err = conn.Read(msgBytes)
 	if err != nil {
-		return true, fmt.Errorf("Could not read message: %s", err)
+		// The rest of the stream cannot be framed
+		return true, err
 	}
 
 	// Dump raw msg to log
 	dumpIncoming(conn, msgBytes)
+	statsIncoming(conn, len(msgBytes)+4)
 
 	msg := &cellaserv.Message{}
 	err = proto.Unmarshal(msgBytes, msg)
@@ -162,6 +162,7 @@ func handleMessage(conn net.Conn) (bool, error) {
 		logUnmarshalError(msgBytes)
 		return false, fmt.Errorf("Could not unmarshal message: %s", err)
 	}
+	metricMessages.inc(msg.Type.String())
 
 	switch *msg.Type {
 	case cellaserv.Message_Register:
@@ -198,7 +199,7 @@ func handleMessage(conn net.Conn) (bool, error) {
 			logUnmarshalError(msg.Content)
 			return false, fmt.Errorf("Could not unmarshal subscribe: %s", err)
 		}
-		handleSubscribe(conn, sub)
+		handleSubscribe(conn, msgBytes, sub)
 		return false, nil
 	case cellaserv.Message_Publish:
 		pub := &cellaserv.Publish{}
@@ -214,28 +215,92 @@ func handleMessage(conn net.Conn) (bool, error) {
 	}
 }
 
-// Start listening and receiving connections
-func serve() {
-	ln, err := net.Listen("tcp", sockAddrListen)
-	if err != nil {
-		log.Error("[Net] Could not listen: %s", err)
-		return
-	}
-	defer ln.Close()
-
-	log.Info("[Net] Listening on %s", sockAddrListen)
-
+// Accept connections on the listener until it is closed. The systemd watchdog is pinged from the
+// loop every watchdog period if it is not 0, see sdWatchdog().
+func acceptLoop(ln net.Listener, watchdog time.Duration) {
+	var nextPing time.Time
 	for {
+		if watchdog > 0 && !time.Now().Before(nextPing) {
+			sdWatchdogPing()
+			nextPing = time.Now().Add(watchdog)
+			// Interrupt Accept in time for the next ping
+			ln.(sdDeadlineListener).SetDeadline(nextPing)
+		}
+
 		conn, err := ln.Accept()
 		if err != nil {
+			if isShuttingDown() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
 			log.Error("[Net] Could not accept: %s", err)
 			continue
 		}
 
+		connHandlers.Add(1)
 		go handle(conn)
 	}
 }
 
+// listen creates the listeners of cellaserv
+func listen() error {
+	// Sockets given by systemd socket activation replace our own sockets
+	activated, err := sdListeners()
+	if err != nil {
+		log.Error("[Net] Socket activation: %s", err)
+	}
+	if len(activated) > 0 {
+		for _, ln := range activated {
+			log.Info("[Net] Listening on %s (socket activation)", ln.Addr())
+		}
+		listeners = activated
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", sockAddrListen)
+	if err != nil {
+		return err
+	}
+	listeners = append(listeners, ln)
+	log.Info("[Net] Listening on %s", sockAddrListen)
+
+	if *sockUnixFlag != "" {
+		// Remove stale socket of a previous instance
+		os.Remove(*sockUnixFlag)
+		unixLn, err := net.Listen("unix", *sockUnixFlag)
+		if err != nil {
+			log.Error("[Net] Could not listen on unix socket: %s", err)
+		} else {
+			listeners = append(listeners, unixLn)
+			log.Info("[Net] Listening on %s", *sockUnixFlag)
+		}
+	}
+
+	return nil
+}
+
+// Start listening and receiving connections
+func serve() {
+	err := listen()
+	if err != nil {
+		log.Error("[Net] Could not listen: %s", err)
+		return
+	}
+
+	// Dependent units are started once we accept connections
+	if err := sdNotify("READY=1"); err != nil {
+		log.Error("[Systemd] Could not notify readiness: %s", err)
+	}
+	watchdog := sdWatchdog(listeners[0])
+
+	for _, ln := range listeners[1:] {
+		go acceptLoop(ln, 0)
+	}
+	acceptLoop(listeners[0], watchdog)
+}
+
 // Output version information and exit
 func version() {
 	fmt.Println("cellaserv2 version", csVersion)
@@ -247,7 +312,10 @@ func version() {
 }
 
 func setup() {
+	startTime = time.Now()
+
 	// Initialize our maps
+	connAdmins = make(map[net.Conn]bool)
 	connNameMap = make(map[net.Conn]string)
 	connSpies = make(map[net.Conn][]*Service)
 	services = make(map[string]map[string]*Service)
@@ -269,6 +337,9 @@ func setup() {
 
 	settingsSetup()
 
+	// Check the access policy of admin methods
+	adminSetup()
+
 	// Enable CPU profiling, stopped when cellaserv receive the kill request
 	setupProfiling()
 
@@ -280,11 +351,47 @@ func setup() {
 	if err != nil {
 		log.Error("Could not setup dump: %s", err)
 	}
+
+	// Events whose last value is retained
+	retainSetup()
+
+	// Events whose history is kept
+	historySetup()
+
+	// Export traces of the requests
+	err = traceSetup()
+	if err != nil {
+		log.Error("Could not setup tracing: %s", err)
+	}
+
+	// Serve Prometheus metrics
+	metricsSetup()
+
+	// Shutdown gracefully on SIGTERM and SIGINT
+	setupSignals()
+}
+
+// Offline commands, run instead of the broker with: cellaserv2 COMMAND ARGS...
+var commands = map[string]func(args []string) int{
+	"dump":   dumpCommand,
+	"replay": replayCommand,
+	"stub":   stubCommand,
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+
 	setup()
 	serve()
+
+	// The listeners are closed by shutdown(), wait for it to exit
+	if isShuttingDown() {
+		select {}
+	}
 }
 
 // vim: set nowrap tw=100 noet sw=8:
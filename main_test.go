@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"github.com/golang/protobuf/proto"
+	"github.com/op/go-logging"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Most functions log, keep the test output quiet
+	log = logging.MustGetLogger("cellaserv")
+	logging.SetLevel(logging.CRITICAL, "cellaserv")
+
+	// Events published by cellaserv are logged in a temporary log session
+	root, err := os.MkdirTemp("", "cellaserv-test")
+	if err != nil {
+		panic(err)
+	}
+	*logRootDirectory = root
+	logSubDir = "test"
+	os.Mkdir(path.Join(root, logSubDir), 0755)
+
+	subscriberMap = make(map[string][]net.Conn)
+	subscriberMatchMap = make(map[string][]net.Conn)
+	reqIds = make(map[uint64]*RequestTracking)
+	connList = list.New()
+
+	code := m.Run()
+	logSessionEnd()
+	os.RemoveAll(root)
+	os.Exit(code)
+}
+
+// testLength returns the length prefix of a message
+func testLength(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b
+}
+
+// testPublishMessage returns an encoded publish of the event, prefixed by its length
+func testPublishMessage(t *testing.T, event string, data []byte) []byte {
+	msgBytes := testMessage(t, cellaserv.Message_Publish,
+		&cellaserv.Publish{Event: &event, Data: data})
+	return append(testLength(uint32(len(msgBytes))), msgBytes...)
+}
+
+// Messages received in several reads are handled whole, and the next ones are framed after them
+func TestHandleMessageFraming(t *testing.T) {
+	_, listener := testSubscriber(t, "framing.#")
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	big := make([]byte, 100000)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	first := testPublishMessage(t, "framing.big", big)
+	second := testPublishMessage(t, "framing.small", []byte("small"))
+	go func() {
+		// Each write of a net.Pipe is a separate read
+		for len(first) > 0 {
+			n := len(first)
+			if n > 1000 {
+				n = 1000
+			}
+			peer.Write(first[:n])
+			first = first[n:]
+			time.Sleep(time.Millisecond / 10)
+		}
+		peer.Write(second)
+	}()
+
+	// The publishes are written to the listener while handling them
+	go func() {
+		for i := 0; i < 2; i++ {
+			if closed, err := handleMessage(conn); closed || err != nil {
+				t.Errorf("Message %d: closed %t, error %v", i, closed, err)
+				return
+			}
+		}
+	}()
+
+	for i, want := range []string{"framing.big", "framing.small"} {
+		msg := testRead(t, listener)
+		pub := &cellaserv.Publish{}
+		proto.Unmarshal(msg.Content, pub)
+		if pub.GetEvent() != want {
+			t.Errorf("Message %d: event %s, want %s", i, pub.GetEvent(), want)
+		}
+		if i == 0 && !bytes.Equal(pub.Data, big) {
+			t.Errorf("Message %d: %d bytes of data, want %d", i, len(pub.Data), len(big))
+		}
+	}
+}
+
+// The connection is closed on messages that cannot be framed, and at the end of the stream
+func TestHandleMessageClose(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"end of stream", nil, false},
+		{"too big", testLength(maxMessageSize + 1), true},
+		{"truncated length", []byte{0, 0}, true},
+		{"truncated message", append(testLength(10), 1, 2, 3), true},
+	}
+	for _, test := range tests {
+		conn, peer := net.Pipe()
+		go func() {
+			peer.Write(test.data)
+			peer.Close()
+		}()
+		closed, err := handleMessage(conn)
+		if !closed || (err != nil) != test.wantErr {
+			t.Errorf("%s: closed %t, error %v", test.name, closed, err)
+		}
+		conn.Close()
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"bytes"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics in the Prometheus text exposition format
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+var (
+	metricsAddrFlag = flag.String("metrics", "", "serve Prometheus metrics on ADDR/metrics")
+
+	// Protects all the metrics, they are read by the HTTP server goroutine
+	metricsMtx sync.Mutex
+
+	metricMessages = newMetricVec("cellaserv_messages_total", "counter",
+		"Messages received by type.", "type")
+	metricRequests = newMetricVec("cellaserv_requests_total", "counter",
+		"Requests received by service and method.", "service", "method")
+	metricRequestErrors = newMetricVec("cellaserv_request_errors_total", "counter",
+		"Error replies by service, method and error type.", "service", "method", "error")
+	metricTimeouts = newMetricVec("cellaserv_request_timeouts_total", "counter",
+		"Requests that timed out by service.", "service")
+	metricPublishes = newMetricVec("cellaserv_publishes_total", "counter",
+		"Publishes by event.", "event")
+	metricClients = newMetricVec("cellaserv_connected_clients", "gauge",
+		"Currently connected clients.")
+	metricServices = newMetricVec("cellaserv_registered_services", "gauge",
+		"Currently registered services.")
+	metricSubscribers = newMetricVec("cellaserv_subscribers", "gauge",
+		"Subscribers by event or pattern.", "event")
+	metricPendingRequests = newMetricVec("cellaserv_pending_requests", "gauge",
+		"Requests waiting for a reply.")
+
+	metricReplyLatency = newHistogramVec("cellaserv_reply_latency_seconds",
+		"Time between the forwarding of a request and its reply, by service.",
+		[]float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}, "service")
+)
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricLabels formats label values as {name="value",...}
+func metricLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+metricLabelEscaper.Replace(values[i])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// metricVec is a counter or a gauge with labels
+type metricVec struct {
+	name   string
+	kind   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+func newMetricVec(name, kind, help string, labels ...string) *metricVec {
+	return &metricVec{name, kind, help, labels, make(map[string]float64)}
+}
+
+func (m *metricVec) add(v float64, labelValues ...string) {
+	metricsMtx.Lock()
+	m.values[metricLabels(m.labels, labelValues)] += v
+	metricsMtx.Unlock()
+}
+
+func (m *metricVec) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+// set must be called with metricsMtx held
+func (m *metricVec) set(v float64, labelValues ...string) {
+	m.values[metricLabels(m.labels, labelValues)] = v
+}
+
+func (m *metricVec) write(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	var keys []string
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(buf, "%s%s %g\n", m.name, k, m.values[k])
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// histogramVec is a histogram with labels
+type histogramVec struct {
+	name    string
+	help    string
+	buckets []float64
+	labels  []string
+	series  map[string][]string
+	values  map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name, help, buckets, labels,
+		make(map[string][]string), make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	metricsMtx.Lock()
+	defer metricsMtx.Unlock()
+
+	key := metricLabels(h.labels, labelValues)
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+		h.series[key] = labelValues
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *histogramVec) write(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	var keys []string
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		hist := h.values[k]
+		labels := append([]string{}, h.labels...)
+		labels = append(labels, "le")
+		for i, bound := range h.buckets {
+			values := append(append([]string{}, h.series[k]...), fmt.Sprintf("%g", bound))
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name, metricLabels(labels, values),
+				hist.counts[i])
+		}
+		values := append(append([]string{}, h.series[k]...), "+Inf")
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name, metricLabels(labels, values), hist.count)
+		fmt.Fprintf(buf, "%s_sum%s %g\n", h.name, k, hist.sum)
+		fmt.Fprintf(buf, "%s_count%s %d\n", h.name, k, hist.count)
+	}
+}
+
+// serviceFullName returns the name of a service, with its identification if any
+func serviceFullName(name, ident string) string {
+	if ident != "" {
+		return name + "/" + ident
+	}
+	return name
+}
+
+// requestServiceName returns the name of the service targeted by the request, with its
+// identification if any
+func requestServiceName(req *cellaserv.Request) string {
+	return serviceFullName(req.GetServiceName(), req.GetServiceIdentification())
+}
+
+func metricsRequest(req *cellaserv.Request) {
+	metricRequests.inc(requestServiceName(req), *req.Method)
+}
+
+func metricsRequestError(req *cellaserv.Request, err_t cellaserv.Reply_Error_Type) {
+	metricRequestErrors.inc(requestServiceName(req), *req.Method, err_t.String())
+}
+
+func metricsReply(req *cellaserv.Request, latency time.Duration) {
+	metricReplyLatency.observe(latency.Seconds(), requestServiceName(req))
+}
+
+// metricsClients counts the connected clients, delta is 1 when a client connects and -1 when it
+// leaves
+func metricsClients(delta float64) {
+	metricClients.add(delta)
+}
+
+// metricsServices counts the registered services, delta is 1 when a service is registered and -1
+// when it is removed
+func metricsServices(delta float64) {
+	metricServices.add(delta)
+}
+
+// metricsUpdateGauges copies the size of the locked cellaserv data structures to the gauges, it is
+// called when the metrics are scraped. metricsMtx must be held.
+//
+// The connections and the services are owned by the connection handlers and cannot be read from
+// the HTTP server goroutine: their gauges are updated by metricsClients() and metricsServices().
+func metricsUpdateGauges() {
+	metricSubscribers.values = make(map[string]float64)
+	pubsubMtx.Lock()
+	for event, conns := range subscriberMap {
+		metricSubscribers.set(float64(len(conns)), event)
+	}
+	for pattern, conns := range subscriberMatchMap {
+		metricSubscribers.set(float64(len(conns)), pattern)
+	}
+	pubsubMtx.Unlock()
+
+	metricPendingRequests.set(float64(requestsPending()))
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+
+	metricsMtx.Lock()
+	metricsUpdateGauges()
+	for _, m := range []*metricVec{metricMessages, metricRequests, metricRequestErrors,
+		metricTimeouts, metricPublishes, metricClients, metricServices, metricSubscribers,
+		metricPendingRequests} {
+		m.write(&buf)
+	}
+	metricReplyLatency.write(&buf)
+	metricsMtx.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// metricsSetup starts the HTTP server of the metrics endpoint
+func metricsSetup() {
+	if *metricsAddrFlag == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+
+	go func() {
+		log.Info("[Metrics] Serving metrics on %s/metrics", *metricsAddrFlag)
+		err := http.ListenAndServe(*metricsAddrFlag, mux)
+		if err != nil {
+			log.Error("[Metrics] Could not serve metrics: %s", err)
+		}
+	}()
+}
+
+// vim: set nowrap tw=100 noet sw=8:
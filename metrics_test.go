@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricLabels(t *testing.T) {
+	tests := []struct {
+		names, values []string
+		want          string
+	}{
+		{nil, nil, ""},
+		{[]string{"service"}, []string{"robot"}, `{service="robot"}`},
+		{[]string{"service", "method"}, []string{"robot", "move"},
+			`{service="robot",method="move"}`},
+		{[]string{"event"}, []string{""}, `{event=""}`},
+		{[]string{"event"}, []string{`say "hi"`}, `{event="say \"hi\""}`},
+		{[]string{"event"}, []string{`C:\robot`}, `{event="C:\\robot"}`},
+		{[]string{"event"}, []string{"two\nlines"}, `{event="two\nlines"}`},
+		{[]string{"event"}, []string{`\"` + "\n"}, `{event="\\\"\n"}`},
+	}
+	for _, test := range tests {
+		if got := metricLabels(test.names, test.values); got != test.want {
+			t.Errorf("metricLabels(%q, %q) = %s, want %s", test.names, test.values, got, test.want)
+		}
+	}
+}
+
+func TestMetricVecWrite(t *testing.T) {
+	m := newMetricVec("test_requests_total", "counter", "Requests.", "service", "method")
+	m.inc("robot", "move")
+	m.inc("robot", "move")
+	m.add(0.5, "arm", "grab")
+	m.inc(`a"b`, "c")
+
+	var buf bytes.Buffer
+	m.write(&buf)
+	want := `# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{service="a\"b",method="c"} 1
+test_requests_total{service="arm",method="grab"} 0.5
+test_requests_total{service="robot",method="move"} 2
+`
+	if buf.String() != want {
+		t.Errorf("Got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestMetricVecWriteNoLabels(t *testing.T) {
+	m := newMetricVec("test_clients", "gauge", "Clients.")
+	m.add(1)
+	m.add(1)
+	m.add(-1)
+
+	var buf bytes.Buffer
+	m.write(&buf)
+	want := "# HELP test_clients Clients.\n# TYPE test_clients gauge\ntest_clients 1\n"
+	if buf.String() != want {
+		t.Errorf("Got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestHistogramVecWrite(t *testing.T) {
+	h := newHistogramVec("test_latency_seconds", "Latency.", []float64{.001, 1, 2.5}, "service")
+	for _, v := range []float64{0.5, 1, 3, 0.0005} {
+		h.observe(v, "robot")
+	}
+	h.observe(2, `arm"1`)
+
+	var buf bytes.Buffer
+	h.write(&buf)
+	want := `# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{service="arm\"1",le="0.001"} 0
+test_latency_seconds_bucket{service="arm\"1",le="1"} 0
+test_latency_seconds_bucket{service="arm\"1",le="2.5"} 1
+test_latency_seconds_bucket{service="arm\"1",le="+Inf"} 1
+test_latency_seconds_sum{service="arm\"1"} 2
+test_latency_seconds_count{service="arm\"1"} 1
+test_latency_seconds_bucket{service="robot",le="0.001"} 1
+test_latency_seconds_bucket{service="robot",le="1"} 3
+test_latency_seconds_bucket{service="robot",le="2.5"} 3
+test_latency_seconds_bucket{service="robot",le="+Inf"} 4
+test_latency_seconds_sum{service="robot"} 4.5005
+test_latency_seconds_count{service="robot"} 4
+`
+	if buf.String() != want {
+		t.Errorf("Got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+// The scrape includes every metric, with the gauges of the clients and services counted by the
+// connection handlers
+func TestHandleMetrics(t *testing.T) {
+	metricsClients(1)
+	metricsClients(1)
+	metricsServices(1)
+	defer func() {
+		metricsClients(-2)
+		metricsServices(-1)
+	}()
+
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Errorf("Content-Type: %s", ct)
+	}
+
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE cellaserv_messages_total counter",
+		"# TYPE cellaserv_connected_clients gauge",
+		"cellaserv_connected_clients 2",
+		"cellaserv_registered_services 1",
+		"cellaserv_pending_requests 0",
+		"# TYPE cellaserv_reply_latency_seconds histogram",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Missing line %q in:\n%s", line, body)
+		}
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
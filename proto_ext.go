@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"encoding/binary"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+)
+
+/*
+Broker extension fields.
+
+cellaserv appends these fields to the protobuf messages it forwards. Their numbers are not used by
+cellaserv.proto, so clients that do not know about them skip them as unknown fields. Clients that
+know about them can also set them in the messages they send.
+*/
+const (
+	// Fields numbers from this one are extensions
+	extFirstField = 1000
+
+	// Request, Reply: 16 bytes trace ID
+	extTraceId = 1000
+	// Request, Reply: 8 bytes ID of the span that is the parent of the receiver's work
+	extSpanId = 1001
+	// Publish: varint, 1 to retain the publish as the last value of the event
+	extRetain = 1002
+	// Publish, set by cellaserv: varint, sequence number of the publish in the broker
+	extSeq = 1003
+	// Publish, set by cellaserv: varint, time the publish was received, in ns since the epoch
+	extTimestamp = 1004
+	// Publish, set by cellaserv: bytes, name of the connection of the publisher
+	extPublisher = 1005
+	// Subscribe: varint, 1 to receive the publishes with extSeq, extTimestamp and extPublisher
+	extStamp = 1006
+	// Subscribe: bytes, filter of the data of the publishes, see filter.go
+	extFilter = 1007
+)
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+func extAppendTag(b []byte, field int, wireType int) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(field)<<3|uint64(wireType))
+	return append(b, buf[:n]...)
+}
+
+// extAppendBytes appends a length-delimited field to the encoded message b
+func extAppendBytes(b []byte, field int, value []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	b = extAppendTag(b, field, wireBytes)
+	n := binary.PutUvarint(buf[:], uint64(len(value)))
+	b = append(b, buf[:n]...)
+	return append(b, value...)
+}
+
+// extAppendVarint appends a varint field to the encoded message b
+func extAppendVarint(b []byte, field int, value uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	b = extAppendTag(b, field, wireVarint)
+	n := binary.PutUvarint(buf[:], value)
+	return append(b, buf[:n]...)
+}
+
+// extFields calls fn with the number, the encoding and the raw value of each field of the encoded
+// message b, varints are given as their encoding
+func extFields(b []byte, fn func(field int, encoded []byte, value []byte)) error {
+	for i := 0; i < len(b); {
+		key, n := binary.Uvarint(b[i:])
+		if n <= 0 {
+			return fmt.Errorf("Bad field key at offset %d", i)
+		}
+		field := int(key >> 3)
+		start := i
+		valueStart := i + n
+
+		var valueEnd int
+		switch key & 7 {
+		case wireVarint:
+			_, m := binary.Uvarint(b[valueStart:])
+			if m <= 0 {
+				return fmt.Errorf("Bad varint of field %d", field)
+			}
+			valueEnd = valueStart + m
+		case wireFixed64:
+			valueEnd = valueStart + 8
+		case wireFixed32:
+			valueEnd = valueStart + 4
+		case wireBytes:
+			length, m := binary.Uvarint(b[valueStart:])
+			if m <= 0 {
+				return fmt.Errorf("Bad length of field %d", field)
+			}
+			valueStart += m
+			valueEnd = valueStart + int(length)
+		default:
+			return fmt.Errorf("Unsupported wire type %d of field %d", key&7, field)
+		}
+		if valueEnd > len(b) || valueEnd < valueStart {
+			return fmt.Errorf("Truncated field %d", field)
+		}
+
+		fn(field, b[start:valueEnd], b[valueStart:valueEnd])
+		i = valueEnd
+	}
+	return nil
+}
+
+/*
+extSplit separates the extension fields from the encoded message b.
+
+It returns the raw value of the extension fields found, varints are returned as their encoding, and
+the message without them.
+*/
+func extSplit(b []byte) (map[int][]byte, []byte, error) {
+	exts := make(map[int][]byte)
+	rest := make([]byte, 0, len(b))
+
+	err := extFields(b, func(field int, encoded []byte, value []byte) {
+		if field >= extFirstField {
+			exts[field] = value
+		} else {
+			rest = append(rest, encoded...)
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return exts, rest, nil
+}
+
+// extRemove returns the encoded message b without the given fields, the other fields are kept as
+// they are, in the same order
+func extRemove(b []byte, fields ...int) ([]byte, error) {
+	rest := make([]byte, 0, len(b))
+	err := extFields(b, func(field int, encoded []byte, value []byte) {
+		for _, removed := range fields {
+			if field == removed {
+				return
+			}
+		}
+		rest = append(rest, encoded...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rest, nil
+}
+
+// extValue returns the raw value of the extension field of the encoded message msgBytes
+func extValue(msgBytes []byte, field int) ([]byte, bool) {
+	msg := &cellaserv.Message{}
+	if err := proto.Unmarshal(msgBytes, msg); err != nil {
+		return nil, false
+	}
+	exts, _, err := extSplit(msg.Content)
+	if err != nil {
+		return nil, false
+	}
+	value, ok := exts[field]
+	return value, ok
+}
+
+// extFlag returns whether the encoded message msgBytes sets the varint extension field to 1
+func extFlag(msgBytes []byte, field int) bool {
+	value, ok := extValue(msgBytes, field)
+	return ok && len(value) == 1 && value[0] == 1
+}
+
+// messageWithContent encodes a cellaserv message of type msgType holding content
+func messageWithContent(msgType cellaserv.Message_MessageType, content []byte) ([]byte, error) {
+	msg := &cellaserv.Message{Type: &msgType, Content: content}
+	return proto.Marshal(msg)
+}
+
+// vim: set nowrap tw=100 noet sw=8:
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExtRemove(t *testing.T) {
+	// A message field, a trace, an unknown extension, and a span
+	var b []byte
+	b = extAppendBytes(b, 1, []byte("robot"))
+	b = extAppendBytes(b, extTraceId, bytes.Repeat([]byte{1}, 16))
+	b = extAppendVarint(b, testExtField, 300)
+	b = extAppendBytes(b, extSpanId, bytes.Repeat([]byte{2}, 8))
+
+	tests := []struct {
+		fields []int
+		want   []byte
+	}{
+		{nil, b},
+		{[]int{extTraceId, extSpanId},
+			extAppendVarint(extAppendBytes(nil, 1, []byte("robot")), testExtField, 300)},
+		{[]int{1, testExtField}, append(
+			extAppendBytes(nil, extTraceId, bytes.Repeat([]byte{1}, 16)),
+			extAppendBytes(nil, extSpanId, bytes.Repeat([]byte{2}, 8))...)},
+		{[]int{extRetain}, b},
+	}
+	for _, test := range tests {
+		got, err := extRemove(b, test.fields...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("extRemove(%v) = %x, want %x", test.fields, got, test.want)
+		}
+	}
+
+	if _, err := extRemove(b[:len(b)-1], extSpanId); err == nil {
+		t.Error("extRemove of a truncated message succeeded")
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
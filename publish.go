@@ -3,43 +3,95 @@ package main
 import (
 	"bitbucket.org/evolutek/cellaserv2-protobuf"
 	"net"
-	"path/filepath"
 	"strings"
+	"time"
 )
 
+// Sequence number of the last publish, protected by pubsubMtx
+var publishSeq uint64
+
 func handlePublish(conn net.Conn, msgBytes []byte, pub *cellaserv.Publish) {
 	log.Info("[Publish] %s publishes %s", connDescribe(conn), *pub.Event)
-	doPublish(msgBytes, pub)
+	doPublish(connDescribe(conn), msgBytes, pub)
 }
 
-func doPublish(msgBytes []byte, pub *cellaserv.Publish) {
+// doPublish sends a publish to its subscribers, publisher describes its sender
+func doPublish(publisher string, msgBytes []byte, pub *cellaserv.Publish) {
 	event := *pub.Event
+	received := time.Now()
 
 	// Logging
 	log.Debug("[Publish] Publishing %s", event)
+	metricPublishes.inc(event)
 
 	// Handle log publishes
 	if strings.HasPrefix(event, "log.") {
-		cellaservLog(pub)
+		cellaservLog(publisher, pub)
 	}
 
-	var subs []net.Conn
+	pubsubMtx.Lock()
+	publishSeq++
+	stamp := &publishStamp{publishSeq, received, publisher}
 
-	// Handle glob susbscribers
-	for pattern, cons := range subscriberMatchMap {
-		matched, _ := filepath.Match(pattern, event)
-		if matched {
-			subs = append(subs, cons...)
+	// Keep the last value of retained events, and the history
+	retainPublish(stamp, msgBytes, pub)
+	historyAdd(stamp, pub, msgBytes)
+
+	// Each connection receives the publish once, if one of its subscriptions matching the event
+	// has no filter or a filter matching the data. The filters are evaluated after releasing the
+	// lock.
+	var candidates []net.Conn
+	filters := make(map[net.Conn][]*subscriptionFilter)
+	addSubs := func(subEvent string, conns []net.Conn) {
+		for _, conn := range conns {
+			if _, ok := filters[conn]; !ok {
+				candidates = append(candidates, conn)
+			}
+			// nil if the subscription has no filter
+			filter := subscriptionFilters[subscription{conn, subEvent}]
+			filters[conn] = append(filters[conn], filter)
 		}
 	}
 
+	// Handle pattern susbscribers
+	for _, pattern := range subscriberIndex.match(event) {
+		addSubs(pattern.pattern, subscriberMatchMap[pattern.pattern])
+	}
+
 	// Add exact matches
-	subs = append(subs, subscriberMap[event]...)
+	addSubs(event, subscriberMap[event])
+
+	// Subscribers asking for stamped publishes
+	stamped := make(map[net.Conn]bool)
+	for _, connSub := range candidates {
+		if stampedConns[connSub] {
+			stamped[connSub] = true
+		}
+	}
+	pubsubMtx.Unlock()
 
+	// The data is only decoded if one of the subscriptions has a filter
+	var subs []net.Conn
+	payload := &filterPayload{data: pub.Data}
+	for _, connSub := range candidates {
+		if filtersMatch(filters[connSub], payload) {
+			subs = append(subs, connSub)
+		}
+	}
+
+	statsPublish(event, len(subs))
+
+	var stampedBytes []byte
 	for _, connSub := range subs {
 		log.Debug("[Publish] Forwarding publish to %s", connDescribe(connSub))
-		dumpOutgoing(connSub, msgBytes)
-		sendRawMessage(connSub, msgBytes)
+		if !stamped[connSub] {
+			sendRawMessage(connSub, msgBytes)
+			continue
+		}
+		if stampedBytes == nil {
+			stampedBytes = stamp.stampMessage(msgBytes)
+		}
+		sendRawMessage(connSub, stampedBytes)
 	}
 }
 
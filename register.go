@@ -38,6 +38,8 @@ func handleRegister(conn net.Conn, msg *cellaserv.Register) {
 			}
 		}
 	} else {
+		metricsServices(1)
+
 		// Sanity checks
 		if ident == "" {
 			if len(services[name]) >= 1 {
@@ -58,6 +60,10 @@ func handleRegister(conn net.Conn, msg *cellaserv.Register) {
 	// Keep track of origin connection in order to remove when the connection is closed
 	servicesConn[conn] = append(servicesConn[conn], service)
 
+	statsAddService(name, ident)
+	logSessionAddService(service)
+	logSessionAddClient(conn)
+
 	// Publish new service data
 	pub_json, _ := json.Marshal(service.JSONStruct())
 	cellaservPublish(logNewService, pub_json)
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+Replay of a dump against a running broker.
+
+The messages sent by the clients of the dump are sent again on a single connection, with their
+original timing: the publishes, and the requests with -requests. The requests get new IDs, and
+their replies are printed. Requests to the cellaserv service are never replayed, so that a replay
+cannot rotate the logs or shut the broker down.
+*/
+
+// How long to wait for the replies of the last requests, the broker times out after 5s
+const replayReplyTimeout = 6 * time.Second
+
+// replayer sends the messages of a dump to a broker
+type replayer struct {
+	conn net.Conn
+	// Frames sent and replies are printed to out
+	out io.Writer
+
+	// Options, see the flags of replayCommand
+	speed    float64
+	step     bool
+	requests bool
+	// Waits between two messages, time.Sleep but in tests
+	sleep func(time.Duration)
+
+	// Requests sent and waiting for their reply, by new ID
+	mtx     sync.Mutex
+	pending map[uint64]*dumpFrameJSON
+	nextId  uint64
+}
+
+// replayDelay returns how long to wait before sending a message dumped at next, after the one
+// dumped at prev, 0 for the first message or without waiting
+func replayDelay(prev time.Time, next time.Time, speed float64) time.Duration {
+	if speed == 0 || prev.IsZero() || next.Before(prev) {
+		return 0
+	}
+	return time.Duration(float64(next.Sub(prev)) / speed)
+}
+
+// request returns the request msg with a new ID, and remembers it until its reply
+func (r *replayer) request(msg []byte, frame *dumpFrameJSON) ([]byte, error) {
+	m := &cellaserv.Message{}
+	if err := proto.Unmarshal(msg, m); err != nil {
+		return nil, err
+	}
+	req := &cellaserv.Request{}
+	if err := proto.Unmarshal(m.Content, req); err != nil {
+		return nil, err
+	}
+
+	r.mtx.Lock()
+	id := r.nextId
+	r.nextId++
+	r.pending[id] = frame
+	r.mtx.Unlock()
+
+	req.Id = &id
+	content, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	return messageWithContent(cellaserv.Message_Request, content)
+}
+
+// readReplies prints the replies of the requests until the connection is closed
+func (r *replayer) readReplies() {
+	dec := &dumpDecoder{requests: r.pending}
+	for {
+		msg, err := readRawMessage(r.conn)
+		if err != nil {
+			return
+		}
+
+		r.mtx.Lock()
+		frame, err := dec.decode(&dumpRecord{Time: time.Now(), Conn: "replay", Msg: msg})
+		if err == nil && frame.Type == "Reply" {
+			delete(r.pending, frame.id())
+			fmt.Fprintln(r.out, frame)
+		}
+		r.mtx.Unlock()
+	}
+}
+
+// waitReplies waits until all the requests got their reply, or the timeout
+func (r *replayer) waitReplies() {
+	deadline := time.Now().Add(replayReplyTimeout)
+	for time.Now().Before(deadline) {
+		r.mtx.Lock()
+		pending := len(r.pending)
+		r.mtx.Unlock()
+		if pending == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	fmt.Fprintln(os.Stderr, "Some requests did not get a reply")
+}
+
+// replayCommand sends the messages of a dump to a running broker
+func replayCommand(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cellaserv2 replay [flags] FILE")
+		flags.PrintDefaults()
+	}
+	var filter dumpInspectFilter
+	filter.addFlags(flags)
+	addrFlag := flags.String("addr", "", "address of the broker, default to the client "+
+		"configuration, CS_HOST and CS_PORT")
+	speedFlag := flags.Float64("speed", 1, "speed of the replay relative to the dump, 0 to "+
+		"send the messages without waiting")
+	stepFlag := flags.Bool("step", false, "wait for Enter before sending each message")
+	requestsFlag := flags.Bool("requests", false, "also send the requests, and print the replies")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	if err := filter.check(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *speedFlag < 0 {
+		fmt.Fprintln(os.Stderr, "Invalid speed:", *speedFlag)
+		return 2
+	}
+
+	addr := *addrFlag
+	if addr == "" {
+		addr = clientAddr()
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer conn.Close()
+
+	// Use IDs unlikely to be used by the other clients of the broker
+	r := &replayer{conn: conn, out: os.Stdout, speed: *speedFlag, step: *stepFlag,
+		requests: *requestsFlag, sleep: time.Sleep,
+		pending: make(map[uint64]*dumpFrameJSON), nextId: uint64(time.Now().UnixNano())}
+	go r.readReplies()
+
+	if err := r.replay(flags.Arg(0), &filter, bufio.NewReader(os.Stdin)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	r.waitReplies()
+	return 0
+}
+
+// replay sends the messages of the dump selected by the filter, stdin is read by -step
+func (r *replayer) replay(filename string, filter *dumpInspectFilter, stdin *bufio.Reader) error {
+	dec := newDumpDecoder()
+	var last time.Time
+
+	return dumpReadFile(filename, func(rec *dumpRecord) error {
+		frame, err := dec.decode(rec)
+		if err != nil {
+			return err
+		}
+		if !filter.match(frame) {
+			if !filter.end.IsZero() && frame.Time.After(filter.end) {
+				return errDumpStop
+			}
+			return nil
+		}
+		// Only replay what the clients sent
+		if !rec.Incoming {
+			return nil
+		}
+
+		msg := rec.Msg
+		switch frame.Type {
+		case "Publish":
+		case "Request":
+			if !r.requests || frame.Service == "cellaserv" {
+				return nil
+			}
+			msg, err = r.request(rec.Msg, frame)
+			if err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+
+		if r.step {
+			fmt.Fprint(r.out, frame, " [Enter]")
+			if _, err := stdin.ReadString('\n'); err != nil {
+				return errDumpStop
+			}
+		} else {
+			if delay := replayDelay(last, frame.Time, r.speed); delay > 0 {
+				r.sleep(delay)
+			}
+			fmt.Fprintln(r.out, frame)
+		}
+		last = frame.Time
+
+		return writeRawMessage(r.conn, msg)
+	})
+}
+
+// vim: set nowrap tw=100 noet sw=8:
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"bufio"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayDelay(t *testing.T) {
+	start := testInspectStart
+	tests := []struct {
+		prev, next time.Time
+		speed      float64
+		want       time.Duration
+	}{
+		{time.Time{}, start, 1, 0},
+		{start, start.Add(time.Second), 1, time.Second},
+		{start, start.Add(time.Second), 2, 500 * time.Millisecond},
+		{start, start.Add(time.Second), 0.5, 2 * time.Second},
+		{start, start.Add(time.Second), 0, 0},
+		{start, start, 1, 0},
+		// Clients may send messages with the same time, in any order
+		{start.Add(time.Second), start, 1, 0},
+	}
+	for _, test := range tests {
+		if got := replayDelay(test.prev, test.next, test.speed); got != test.want {
+			t.Errorf("replayDelay(%s, %s, %g) = %s, want %s", test.prev, test.next,
+				test.speed, got, test.want)
+		}
+	}
+}
+
+// testReplayMessages returns a dump of publishes and requests of a client, with messages sent by
+// cellaserv that are not replayed
+func testReplayMessages(t *testing.T) []testInspectMessage {
+	client, listener := "127.0.0.1:40001", "127.0.0.1:40003"
+	date, broker, method, shutdown := "date", "cellaserv", "time", "shutdown"
+	id, shutdownId := uint64(7), uint64(8)
+	event := "match.start"
+	publish := testMessage(t, cellaserv.Message_Publish,
+		&cellaserv.Publish{Event: &event, Data: []byte("1")})
+	ms := time.Millisecond
+
+	return []testInspectMessage{
+		{client, 0, publish, true},
+		{listener, 1 * ms, publish, false},
+		{client, 10 * ms, testMessage(t, cellaserv.Message_Request,
+			&cellaserv.Request{ServiceName: &date, Method: &method, Id: &id}), true},
+		{client, 20 * ms, testMessage(t, cellaserv.Message_Request, &cellaserv.Request{
+			ServiceName: &broker, Method: &shutdown, Id: &shutdownId}), true},
+		{client, 40 * ms, publish, true},
+	}
+}
+
+// testReplay replays the dump on a pipe, and returns the messages received by the broker and the
+// delays waited before them
+func testReplay(t *testing.T, r *replayer,
+	filename string) ([]*cellaserv.Message, []time.Duration) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	r.conn = conn
+	r.out = io.Discard
+	r.pending = make(map[uint64]*dumpFrameJSON)
+	var delays []time.Duration
+	r.sleep = func(d time.Duration) { delays = append(delays, d) }
+
+	done := make(chan error, 1)
+	go func() {
+		stdin := bufio.NewReader(strings.NewReader(""))
+		done <- r.replay(filename, &dumpInspectFilter{}, stdin)
+		conn.Close()
+	}()
+
+	var messages []*cellaserv.Message
+	for {
+		msgBytes, err := readRawMessage(peer)
+		if err != nil {
+			break
+		}
+		msg := &cellaserv.Message{}
+		if err := proto.Unmarshal(msgBytes, msg); err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, msg)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	return messages, delays
+}
+
+func TestReplay(t *testing.T) {
+	filename := testWritePcapng(t, testReplayMessages(t))
+	ms := time.Millisecond
+
+	tests := []struct {
+		speed    float64
+		requests bool
+		// Types of the messages sent
+		want       string
+		wantDelays string
+	}{
+		{1, false, "[Publish Publish]", fmt.Sprint([]time.Duration{40 * ms})},
+		{2, false, "[Publish Publish]", fmt.Sprint([]time.Duration{20 * ms})},
+		{0, false, "[Publish Publish]", "[]"},
+		// The request to cellaserv is never replayed
+		{1, true, "[Publish Request Publish]",
+			fmt.Sprint([]time.Duration{10 * ms, 30 * ms})},
+		{4, true, "[Publish Request Publish]",
+			fmt.Sprint([]time.Duration{2500 * time.Microsecond,
+				7500 * time.Microsecond})},
+	}
+	for _, test := range tests {
+		r := &replayer{speed: test.speed, requests: test.requests, nextId: 1000}
+		messages, delays := testReplay(t, r, filename)
+
+		var types []string
+		for _, msg := range messages {
+			types = append(types, msg.GetType().String())
+		}
+		if fmt.Sprint(types) != test.want || fmt.Sprint(delays) != test.wantDelays {
+			t.Errorf("speed %g, requests %t: sent %v after %v, want %s after %s",
+				test.speed, test.requests, types, delays, test.want,
+				test.wantDelays)
+		}
+	}
+}
+
+// The requests are sent with new IDs, their replies are matched with them
+func TestReplayRequestIds(t *testing.T) {
+	filename := testWritePcapng(t, testReplayMessages(t))
+	r := &replayer{speed: 0, requests: true, nextId: 1000}
+	messages, _ := testReplay(t, r, filename)
+	if len(messages) != 3 {
+		t.Fatalf("Sent %d messages, want 3", len(messages))
+	}
+
+	req := &cellaserv.Request{}
+	if err := proto.Unmarshal(messages[1].Content, req); err != nil {
+		t.Fatal(err)
+	}
+	if req.GetId() != 1000 || req.GetServiceName() != "date" || req.GetMethod() != "time" {
+		t.Errorf("Sent request %v, want date.time with ID 1000", req)
+	}
+	if frame, ok := r.pending[1000]; !ok || frame.id() != 7 || len(r.pending) != 1 {
+		t.Fatalf("Pending requests %v, want the request 7 as 1000", r.pending)
+	}
+
+	// The broker replies to the new ID
+	conn, peer := net.Pipe()
+	r.conn = conn
+	var out strings.Builder
+	r.out = &out
+	done := make(chan struct{})
+	go func() {
+		r.readReplies()
+		close(done)
+	}()
+	id := uint64(1000)
+	writeRawMessage(peer, testMessage(t, cellaserv.Message_Reply,
+		&cellaserv.Reply{Id: &id, Data: []byte("42")}))
+	peer.Close()
+	<-done
+
+	if len(r.pending) != 0 {
+		t.Errorf("Pending requests %v after the reply", r.pending)
+	}
+	if !strings.Contains(out.String(), "id:1000 (date.time) 42") {
+		t.Errorf("Printed %q, want the reply of date.time", out.String())
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
@@ -3,25 +3,35 @@ package main
 import (
 	"bitbucket.org/evolutek/cellaserv2-protobuf"
 	"net"
+	"time"
 )
 
 func handleReply(conn net.Conn, msgRaw []byte, rep *cellaserv.Reply) {
 	id := *rep.Id
 	log.Info("[Reply] id:%d reply from %s", id, conn.RemoteAddr())
 
-	reqTrack, ok := reqIds[id]
+	reqTrack, ok := requestTake(id)
 	if !ok {
 		log.Error("[Reply] Unknown ID: %d", id)
 		return
 	}
-	delete(reqIds, id)
+
+	latency := time.Since(reqTrack.start)
+	metricsReply(reqTrack.req, latency)
+	statsReply(reqTrack.req, latency)
+	statsReplyReceived(reqTrack.sender)
+	if rep.Error != nil {
+		metricsRequestError(reqTrack.req, rep.Error.GetType())
+	}
+	if reqTrack.trace != nil {
+		msgRaw = traceReply(reqTrack.trace, rep, msgRaw)
+	}
 
 	// Forward reply to spies
 	for _, spy := range reqTrack.spies {
 		sendRawMessage(spy, msgRaw)
 	}
 
-	reqTrack.timer.Stop()
 	log.Debug("[Reply] Forwarding to %s", reqTrack.sender.RemoteAddr())
 	sendRawMessage(reqTrack.sender, msgRaw)
 }
@@ -8,11 +8,16 @@ import (
 
 type RequestTracking struct {
 	sender net.Conn
+	req    *cellaserv.Request
+	start  time.Time
 	timer  *time.Timer
 	spies  []net.Conn
+	// Trace context, nil if tracing is disabled
+	trace *requestTrace
 }
 
 func handleRequest(conn net.Conn, msgRaw []byte, req *cellaserv.Request) {
+	received := time.Now()
 	log.Info("[Request] Incoming from %s", conn.RemoteAddr())
 
 	// Runtime checks in Get*() functions are useless
@@ -27,6 +32,8 @@ func handleRequest(conn net.Conn, msgRaw []byte, req *cellaserv.Request) {
 	} else {
 		log.Debug("[Request] id:%d %s.%s", *id, *name, *method)
 	}
+	metricsRequest(req)
+	statsRequestSent(conn)
 
 	if *name == "cellaserv" {
 		cellaservRequest(conn, req)
@@ -60,16 +67,30 @@ func handleRequest(conn net.Conn, msgRaw []byte, req *cellaserv.Request) {
 
 	// Handle timeouts
 	handleTimeout := func() {
-		_, ok := reqIds[*id]
+		reqTrack, ok := requestTake(*id)
 		if ok {
 			log.Error("[Request] id:%d Timeout of %s", *id, srvc)
+			metricTimeouts.inc(srvc.String())
+			statsTimeout(req)
+			if reqTrack.trace != nil {
+				traceFail(reqTrack.trace, cellaserv.Reply_Error_Timeout.String())
+			}
 			sendReplyError(conn, req, cellaserv.Reply_Error_Timeout)
 		}
 	}
 	timer := time.AfterFunc(5*time.Second, handleTimeout)
 
+	statsRequest(req)
+
 	// The ID is used to track the sender of the request
-	reqIds[*id] = &RequestTracking{conn, timer, srvc.Spies}
+	reqTrack := &RequestTracking{conn, req, time.Now(), timer, srvc.Spies, nil}
+	if tracingEnabled() {
+		reqTrack.trace, msgRaw = traceRequest(conn, srvc, req, msgRaw, received)
+		reqTrack.trace.forwarded = time.Now()
+	}
+	reqIdsMtx.Lock()
+	reqIds[*id] = reqTrack
+	reqIdsMtx.Unlock()
 
 	srvc.sendMessage(msgRaw)
 
@@ -79,4 +100,40 @@ func handleRequest(conn net.Conn, msgRaw []byte, req *cellaserv.Request) {
 	}
 }
 
+// requestTake removes the request from reqIds and stops its timeout timer. The request is only
+// taken once, so that it is answered only once by a reply, a timeout or the shutdown.
+func requestTake(id uint64) (*RequestTracking, bool) {
+	reqIdsMtx.Lock()
+	defer reqIdsMtx.Unlock()
+
+	reqTrack, ok := reqIds[id]
+	if !ok {
+		return nil, false
+	}
+	delete(reqIds, id)
+	reqTrack.timer.Stop()
+	return reqTrack, true
+}
+
+// requestsTakeAll removes all the pending requests from reqIds and stops their timers
+func requestsTakeAll() []*RequestTracking {
+	reqIdsMtx.Lock()
+	defer reqIdsMtx.Unlock()
+
+	var reqTracks []*RequestTracking
+	for id, reqTrack := range reqIds {
+		delete(reqIds, id)
+		reqTrack.timer.Stop()
+		reqTracks = append(reqTracks, reqTrack)
+	}
+	return reqTracks
+}
+
+// requestsPending returns the number of requests waiting for a reply
+func requestsPending() int {
+	reqIdsMtx.Lock()
+	defer reqIdsMtx.Unlock()
+	return len(reqIds)
+}
+
 // vim: set nowrap tw=100 noet sw=8:
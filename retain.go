@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"encoding/json"
+	"flag"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+Last value cache of the events.
+
+The last publish of an event is retained if it sets the extRetain field, or if the event matches one
+of the -retain patterns. A retained publish without data clears the cache of its event. The retained
+publishes are sent to the new subscribers of their event, before the live ones.
+*/
+
+var (
+	retainFlag = flag.String("retain", "", "retain the last publish of the events matching "+
+		"these comma separated patterns")
+
+	// Patterns of -retain
+	retainPatterns []*topicPattern
+
+	// Protects retained, publishes come from all the connections
+	retainMtx sync.Mutex
+	// Last publish of the retained events, by event
+	retained = make(map[string]*retainedPublish)
+)
+
+type retainedPublish struct {
+	publishStamp
+	pub *cellaserv.Publish
+	// Message forwarded to the subscribers
+	msgBytes []byte
+}
+
+// retainSetup parses the -retain patterns
+func retainSetup() {
+	for _, s := range strings.Split(*retainFlag, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		pattern, err := compileTopic(s)
+		if err != nil {
+			log.Error("[Retain] %s", err)
+			continue
+		}
+		retainPatterns = append(retainPatterns, pattern)
+	}
+}
+
+// retainPublish updates the last value of the event if it is retained
+func retainPublish(stamp *publishStamp, msgBytes []byte, pub *cellaserv.Publish) {
+	event := *pub.Event
+
+	keep := false
+	for _, pattern := range retainPatterns {
+		if pattern.match(event) {
+			keep = true
+			break
+		}
+	}
+	if !keep && !extFlag(msgBytes, extRetain) {
+		return
+	}
+
+	retainMtx.Lock()
+	defer retainMtx.Unlock()
+
+	if len(pub.Data) == 0 {
+		log.Debug("[Retain] Clear %s", event)
+		delete(retained, event)
+		return
+	}
+	retained[event] = &retainedPublish{*stamp, pub, msgBytes}
+}
+
+// retainedMatching returns the retained publishes of the events matching pattern, sorted by event
+func retainedMatching(pattern *topicPattern) []*retainedPublish {
+	retainMtx.Lock()
+	defer retainMtx.Unlock()
+
+	var events []string
+	for event := range retained {
+		if pattern.match(event) {
+			events = append(events, event)
+		}
+	}
+	sort.Strings(events)
+
+	pubs := make([]*retainedPublish, 0, len(events))
+	for _, event := range events {
+		pubs = append(pubs, retained[event])
+	}
+	return pubs
+}
+
+// retainSendTo queues the retained publishes matching the subscribed pattern and the filter to
+// conn, except the events of skip. pubsubMtx must be held, see queuePublish.
+func retainSendTo(conn net.Conn, event string, filter *subscriptionFilter, skip map[string]bool) {
+	pattern, err := compileTopic(event)
+	if err != nil {
+		return
+	}
+	for _, r := range retainedMatching(pattern) {
+		if skip[*r.pub.Event] {
+			continue
+		}
+		if filter != nil && !filter.match(&filterPayload{data: r.pub.Data}) {
+			continue
+		}
+		log.Debug("[Retain] Sending %s to %s", *r.pub.Event, connDescribe(conn))
+		queuePublish(conn, r.msgBytes, &r.publishStamp)
+	}
+}
+
+/*
+handleGetRetained replies with the retained publishes, as log records
+
+Request format, optional:
+
+	{"Event": "pattern"}
+*/
+func handleGetRetained(conn net.Conn, req *cellaserv.Request) {
+	query := struct{ Event string }{"*"}
+	if req.Data != nil {
+		if err := json.Unmarshal(req.Data, &query); err != nil {
+			log.Warning("[Cellaserv] Could not unmarshal get-retained query: %s", err)
+			sendReplyError(conn, req, cellaserv.Reply_Error_BadArguments)
+			return
+		}
+	}
+	pattern, err := compileTopic(query.Event)
+	if err != nil {
+		log.Warning("[Cellaserv] Invalid event pattern: %s", err)
+		sendReplyError(conn, req, cellaserv.Reply_Error_BadArguments)
+		return
+	}
+
+	records := make([]logRecordJSON, 0)
+	for _, r := range retainedMatching(pattern) {
+		record := logRecordJSON{
+			Time:      r.time.UnixNano(),
+			Event:     *r.pub.Event,
+			Publisher: r.publisher,
+		}
+		record.Data, record.DataBase64 = jsonOrBytes(r.pub.Data)
+		records = append(records, record)
+	}
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		log.Error("[Cellaserv] Could not marshal the retained events")
+	}
+	sendReply(conn, req, data)
+}
+
+// vim: set nowrap tw=100 noet sw=8:
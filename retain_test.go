@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"net"
+	"testing"
+)
+
+// testRetain retains the events matching the patterns, with an empty cache, for the test
+func testRetain(t *testing.T, patterns ...string) {
+	savedPatterns := retainPatterns
+	retainPatterns = nil
+	for _, s := range patterns {
+		pattern, err := compileTopic(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		retainPatterns = append(retainPatterns, pattern)
+	}
+	retainMtx.Lock()
+	saved := retained
+	retained = make(map[string]*retainedPublish)
+	retainMtx.Unlock()
+	t.Cleanup(func() {
+		retainPatterns = savedPatterns
+		retainMtx.Lock()
+		retained = saved
+		retainMtx.Unlock()
+	})
+}
+
+// testPublishRetained publishes the event from the test, with the retain flag
+func testPublishRetained(t *testing.T, event string, data string) {
+	pub := &cellaserv.Publish{Event: &event, Data: []byte(data)}
+	content, err := proto.Marshal(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgBytes, _ := messageWithContent(cellaserv.Message_Publish,
+		extAppendVarint(content, extRetain, 1))
+	doPublish("test", msgBytes, pub)
+}
+
+// testRetained returns the retained events and their data
+func testRetained(t *testing.T) string {
+	pattern, _ := compileTopic("#")
+	var events []string
+	for _, r := range retainedMatching(pattern) {
+		events = append(events, *r.pub.Event+"="+string(r.pub.Data))
+	}
+	return fmt.Sprint(events)
+}
+
+func TestRetainPublish(t *testing.T) {
+	testRetain(t, "robot.*")
+
+	tests := []struct {
+		event    string
+		data     string
+		retained bool
+		want     string
+	}{
+		{"robot.position", "1", false, "[robot.position=1]"},
+		{"match.score", "10", true, "[match.score=10 robot.position=1]"},
+		{"match.other", "x", false, "[match.score=10 robot.position=1]"},
+		{"robot.position", "2", false, "[match.score=10 robot.position=2]"},
+		{"robot.speed", "3", true, "[match.score=10 robot.position=2 robot.speed=3]"},
+		// A publish without data clears the event
+		{"match.score", "", true, "[robot.position=2 robot.speed=3]"},
+		{"robot.position", "", false, "[robot.speed=3]"},
+		{"match.other", "", false, "[robot.speed=3]"},
+	}
+	for _, test := range tests {
+		if test.retained {
+			testPublishRetained(t, test.event, test.data)
+		} else {
+			testPublish(t, test.event, test.data)
+		}
+		if got := testRetained(t); got != test.want {
+			t.Errorf("After %s %q, retained %s, want %s", test.event, test.data, got,
+				test.want)
+		}
+	}
+}
+
+// The new subscribers receive the retained events matching their subscription, then the live
+// publishes
+func TestRetainSubscribe(t *testing.T) {
+	testRetain(t, "robot.*")
+	testPublish(t, "robot.position", "1")
+	testPublish(t, "robot.speed", "2")
+	testPublishRetained(t, "match.score", "10")
+
+	conn, peer := net.Pipe()
+	sendQueueAdd(conn)
+	t.Cleanup(func() {
+		pubsubMtx.Lock()
+		unsubscribeAll(conn)
+		pubsubMtx.Unlock()
+		sendQueueRemove(conn)
+		conn.Close()
+		peer.Close()
+	})
+
+	event := "robot.*"
+	sub := &cellaserv.Subscribe{Event: &event}
+	go func() {
+		handleSubscribe(conn, testMessage(t, cellaserv.Message_Subscribe, sub), sub)
+		testPublish(t, "robot.position", "3")
+	}()
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		msg := testRead(t, peer)
+		pub := &cellaserv.Publish{}
+		proto.Unmarshal(msg.Content, pub)
+		got = append(got, pub.GetEvent()+"="+string(pub.Data))
+	}
+	if want := "[robot.position=1 robot.speed=2 robot.position=3]"; fmt.Sprint(got) != want {
+		t.Errorf("Received %v, want %s", got, want)
+	}
+}
+
+func TestHandleGetRetained(t *testing.T) {
+	testRetain(t)
+	testPublishRetained(t, "robot.position", `{"x":1}`)
+	testPublishRetained(t, "robot.speed", "\x00")
+	testPublishRetained(t, "match.score", "10")
+
+	rep := testCall(t, handleGetRetained, `{"Event": "robot.*"}`)
+	var records []logRecordJSON
+	if err := json.Unmarshal(rep.Data, &records); err != nil {
+		t.Fatalf("%s: %s", rep.Data, err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Records %+v, want robot.position and robot.speed", records)
+	}
+	if records[0].Event != "robot.position" || string(records[0].Data) != `{"x":1}` ||
+		records[0].Publisher != "test" || records[0].Time == 0 {
+		t.Errorf("Record %+v, want robot.position", records[0])
+	}
+	if records[1].Event != "robot.speed" || string(records[1].DataBase64) != "\x00" {
+		t.Errorf("Record %+v, want robot.speed in base64", records[1])
+	}
+
+	// All the events by default
+	rep = testCall(t, handleGetRetained, "{}")
+	if err := json.Unmarshal(rep.Data, &records); err != nil || len(records) != 3 {
+		t.Errorf("Records %s, want the 3 events", rep.Data)
+	}
+
+	for _, data := range []string{`{"Event": "re:("}`, `{"Event": 1}`} {
+		rep := testCall(t, handleGetRetained, data)
+		if rep.Error.GetType() != cellaserv.Reply_Error_BadArguments {
+			t.Errorf("get-retained %s: error %v, want BadArguments", data, rep.Error)
+		}
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+Send queues of the connections.
+
+The messages sent to a connection go through its queue: they are written in the order they were
+queued, by one of the goroutines sending to the connection at a time. Queueing a message is cheap
+and never blocks on the network, so messages can be queued while holding pubsubMtx, and written
+after releasing it: a slow connection does not block the publishes of the others.
+*/
+
+// A message waiting in the send queue of a connection
+type sendItem struct {
+	msgBytes []byte
+	// Stamp added to the publish when it is written, nil to write it as is
+	stamp *publishStamp
+}
+
+type sendQueue struct {
+	mtx   sync.Mutex
+	items []sendItem
+	// Set while a goroutine writes the queued messages
+	writing bool
+}
+
+var (
+	// Protects sendQueues
+	sendQueuesMtx sync.Mutex
+	// Send queue of the handled connections
+	sendQueues = make(map[net.Conn]*sendQueue)
+)
+
+// sendQueueAdd creates the send queue of a new connection
+func sendQueueAdd(conn net.Conn) {
+	sendQueuesMtx.Lock()
+	sendQueues[conn] = &sendQueue{}
+	sendQueuesMtx.Unlock()
+}
+
+// sendQueueRemove removes the send queue of a closed connection, messages sent to it afterwards are
+// dropped
+func sendQueueRemove(conn net.Conn) {
+	sendQueuesMtx.Lock()
+	delete(sendQueues, conn)
+	sendQueuesMtx.Unlock()
+}
+
+// queueMessage adds a message to the send queue of conn without writing it, stamp is nil or the
+// stamp to add to the publish. Call flushMessages to write it.
+func queueMessage(conn net.Conn, msgBytes []byte, stamp *publishStamp) {
+	sendQueuesMtx.Lock()
+	q, ok := sendQueues[conn]
+	sendQueuesMtx.Unlock()
+	if !ok {
+		log.Debug("[Net] Dropping message to closed connection %s", conn.RemoteAddr())
+		return
+	}
+
+	q.mtx.Lock()
+	q.items = append(q.items, sendItem{msgBytes, stamp})
+	q.mtx.Unlock()
+}
+
+// flushMessages writes the queued messages of conn, unless another goroutine is already writing
+// them. It must not be called while holding pubsubMtx.
+func flushMessages(conn net.Conn) {
+	sendQueuesMtx.Lock()
+	q, ok := sendQueues[conn]
+	sendQueuesMtx.Unlock()
+	if !ok {
+		return
+	}
+
+	q.mtx.Lock()
+	if q.writing {
+		// The messages are written in order by the other goroutine
+		q.mtx.Unlock()
+		return
+	}
+	q.writing = true
+	for len(q.items) > 0 {
+		items := q.items
+		q.items = nil
+		q.mtx.Unlock()
+
+		for _, item := range items {
+			msgBytes := item.msgBytes
+			if item.stamp != nil {
+				msgBytes = item.stamp.stampMessage(msgBytes)
+			}
+			dumpOutgoing(conn, msgBytes)
+			statsOutgoing(conn, len(msgBytes)+4)
+			// Any IO error will be detected by the main loop trying to read from the conn
+			writeRawMessage(conn, msgBytes)
+		}
+
+		q.mtx.Lock()
+	}
+	q.writing = false
+	q.mtx.Unlock()
+}
+
+// sendQueueIdle returns true if no message of conn is queued or being written
+func sendQueueIdle(conn net.Conn) bool {
+	sendQueuesMtx.Lock()
+	q, ok := sendQueues[conn]
+	sendQueuesMtx.Unlock()
+	if !ok {
+		return true
+	}
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return !q.writing && len(q.items) == 0
+}
+
+// waitMessages writes the queued messages of conn and waits until they are all written, even by
+// another goroutine, or until the deadline. It returns false if the deadline was reached.
+func waitMessages(conn net.Conn, deadline time.Time) bool {
+	flushMessages(conn)
+	for !sendQueueIdle(conn) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+// sendQueuesConns returns the connections that have a send queue, that is all the handled
+// connections
+func sendQueuesConns() []net.Conn {
+	sendQueuesMtx.Lock()
+	defer sendQueuesMtx.Unlock()
+
+	conns := make([]net.Conn, 0, len(sendQueues))
+	for conn := range sendQueues {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// vim: set nowrap tw=100 noet sw=8:
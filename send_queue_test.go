@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// waitMessages returns once the messages queued behind the writes of another goroutine are written
+func TestWaitMessages(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	sendQueueAdd(conn)
+	defer sendQueueRemove(conn)
+
+	for i := 0; i < 3; i++ {
+		queueMessage(conn, []byte{byte(i)}, nil)
+	}
+	// net.Pipe blocks the writer until the peer reads the message
+	go flushMessages(conn)
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := readRawMessage(peer); err != nil {
+		t.Fatal(err)
+	}
+
+	// The reply is queued while the other goroutine writes
+	queueMessage(conn, []byte("reply"), nil)
+	done := make(chan bool)
+	go func() { done <- waitMessages(conn, time.Now().Add(2*time.Second)) }()
+
+	for i := 1; i < 3; i++ {
+		if _, err := readRawMessage(peer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-done:
+		t.Fatal("waitMessages returned before the reply was written")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	msg, err := readRawMessage(peer)
+	if err != nil || string(msg) != "reply" {
+		t.Fatalf("Read %q, %v, want the reply", msg, err)
+	}
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("waitMessages reached the deadline")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("waitMessages did not return after the reply was written")
+	}
+}
+
+// waitMessages gives up at the deadline when the peer does not read
+func TestWaitMessagesDeadline(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	sendQueueAdd(conn)
+	defer sendQueueRemove(conn)
+
+	queueMessage(conn, []byte("first"), nil)
+	go flushMessages(conn)
+	for writing := false; !writing; {
+		time.Sleep(time.Millisecond)
+		sendQueuesMtx.Lock()
+		q := sendQueues[conn]
+		sendQueuesMtx.Unlock()
+		q.mtx.Lock()
+		writing = q.writing
+		q.mtx.Unlock()
+	}
+
+	queueMessage(conn, []byte("reply"), nil)
+	start := time.Now()
+	if waitMessages(conn, start.Add(20*time.Millisecond)) {
+		t.Error("waitMessages returned true, the peer did not read")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waitMessages returned after %s", elapsed)
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net"
 	"os"
 
 	"gopkg.in/gcfg.v1"
@@ -9,8 +10,10 @@ import (
 
 var cfg struct {
 	Cellaserv struct {
+		Admin string
 		Debug string
 		Port  string
+		Token string
 	}
 	Client struct {
 		Debug string
@@ -39,8 +42,11 @@ func setSockAddrListenFromString(addr string) {
 	}
 }
 
+// Configuration file shared with the clients
+const settingsFile = "/etc/conf.d/cellaserv"
+
 func settingsSetup() {
-	err := gcfg.ReadFileInto(&cfg, "/etc/conf.d/cellaserv")
+	err := gcfg.ReadFileInto(&cfg, settingsFile)
 	if err != nil {
 		// Not fatal, all values will be ""
 		log.Debug("[Config] %s", err)
@@ -54,4 +60,32 @@ func settingsSetup() {
 	setSockAddrListenFromString(":" + cfg.Cellaserv.Port)
 	setSockAddrListenFromString(":" + os.Getenv("CS_PORT"))
 	setSockAddrListenFromString(":" + *sockPortFlag)
+
+	setAdminAllowFromString(cfg.Cellaserv.Admin)
+	setAdminAllowFromString(os.Getenv("CS_ADMIN"))
+	setAdminAllowFromString(*adminFlag)
+
+	setAdminTokenFromString(cfg.Cellaserv.Token)
+	setAdminTokenFromString(os.Getenv("CS_ADMIN_TOKEN"))
+	setAdminTokenFromString(*adminTokenFlag)
+}
+
+// clientAddr returns the address of the broker used by the offline commands, from the client
+// section of the configuration, overridden by CS_HOST and CS_PORT
+func clientAddr() string {
+	// Not fatal, the defaults are used
+	gcfg.ReadFileInto(&cfg, settingsFile)
+
+	host, port := "localhost", "4200"
+	for _, h := range []string{cfg.Client.Host, os.Getenv("CS_HOST")} {
+		if h != "" {
+			host = h
+		}
+	}
+	for _, p := range []string{cfg.Client.Port, os.Getenv("CS_PORT")} {
+		if p != "" {
+			port = p
+		}
+	}
+	return net.JoinHostPort(host, port)
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	shutdownTimeout = flag.Duration("shutdown-timeout", 2*time.Second,
+		"maximum time to wait for pending requests when shutting down")
+
+	// Set to 1 when cellaserv is shutting down, stops the accept loops, use isShuttingDown()
+	shuttingDown int32
+	shutdownOnce sync.Once
+)
+
+// setupSignals shuts down cellaserv gracefully when receiving SIGTERM or SIGINT
+func setupSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+
+	go func() {
+		sig := <-sigs
+		log.Info("[Cellaserv] Received signal: %s", sig)
+		shutdown("signal " + sig.String())
+	}()
+}
+
+// isShuttingDown returns true once shutdown() has been called
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) != 0
+}
+
+// shutdown stops accepting connections, waits for pending requests, flushes dump and log files
+// and quits cellaserv.
+func shutdown(reason string) {
+	shutdownOnce.Do(func() { doShutdown(reason) })
+}
+
+func doShutdown(reason string) {
+	log.Info("[Cellaserv] Shutting down: %s", reason)
+	atomic.StoreInt32(&shuttingDown, 1)
+	sdNotify("STOPPING=1")
+
+	for _, ln := range listeners {
+		ln.Close()
+	}
+
+	pub_json, _ := json.Marshal(struct{ Reason string }{reason})
+	cellaservPublish(logShutdown, pub_json)
+
+	shutdownRequests(time.Now().Add(*shutdownTimeout))
+
+	// Close client connections properly instead of letting them see a reset, once the replies
+	// are written. A client that does not read them delays the shutdown by a second at most.
+	deadline := time.Now().Add(time.Second)
+	conns := sendQueuesConns()
+	for _, conn := range conns {
+		conn.SetWriteDeadline(deadline)
+	}
+	for _, conn := range conns {
+		waitMessages(conn, deadline)
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	// The connection handlers still publish and log their cleanup, wait for them before closing
+	// the files
+	handled := make(chan struct{})
+	go func() {
+		connHandlers.Wait()
+		close(handled)
+	}()
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		log.Warning("[Cellaserv] Connection handlers still running, shutting down anyway")
+	}
+
+	traceClose()
+	dumpClose()
+	logSessionEnd()
+	stopProfiling()
+
+	os.Exit(0)
+}
+
+// shutdownRequests lets the services answer the pending requests until the deadline, then fails
+// the requests that are still pending
+func shutdownRequests(deadline time.Time) {
+	for requestsPending() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, reqTrack := range requestsTakeAll() {
+		log.Warning("[Request] id:%d Failed, cellaserv is shutting down", reqTrack.req.GetId())
+		if reqTrack.trace != nil {
+			traceFail(reqTrack.trace, "cellaserv is shutting down")
+		}
+		sendReplyCustomError(reqTrack.sender, reqTrack.req, "cellaserv is shutting down")
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
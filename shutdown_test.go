@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"github.com/golang/protobuf/proto"
+	"net"
+	"testing"
+	"time"
+)
+
+// testPendingRequest adds a request of the connection waiting for the reply of a service
+func testPendingRequest(t *testing.T, sender net.Conn, id uint64) {
+	service, method := "robot", "move"
+	req := &cellaserv.Request{ServiceName: &service, Method: &method, Id: &id}
+	timer := time.AfterFunc(time.Hour, func() { t.Errorf("id:%d timed out", id) })
+
+	reqIdsMtx.Lock()
+	reqIds[id] = &RequestTracking{sender, req, time.Now(), timer, nil, nil}
+	reqIdsMtx.Unlock()
+}
+
+// The requests answered before the deadline are not failed
+func TestShutdownRequestsAnswered(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	sendQueueAdd(conn)
+	defer sendQueueRemove(conn)
+
+	testPendingRequest(t, conn, 1)
+	testPendingRequest(t, conn, 2)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		requestTake(1)
+		time.Sleep(20 * time.Millisecond)
+		requestTake(2)
+	}()
+
+	// A reply would block on net.Pipe until the write deadline, as the peer does not read
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	start := time.Now()
+	shutdownRequests(start.Add(2 * time.Second))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("shutdownRequests returned after %s, the requests were answered", elapsed)
+	}
+	if n := requestsPending(); n != 0 {
+		t.Errorf("%d requests still pending", n)
+	}
+}
+
+// The requests still pending at the deadline are failed with an error reply
+func TestShutdownRequestsFailed(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	sendQueueAdd(conn)
+	defer sendQueueRemove(conn)
+
+	testPendingRequest(t, conn, 3)
+	testPendingRequest(t, conn, 4)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		requestTake(3)
+	}()
+
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		shutdownRequests(start.Add(50 * time.Millisecond))
+		close(done)
+	}()
+
+	msg := testRead(t, peer)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Request failed after %s, before the deadline", elapsed)
+	}
+	rep := &cellaserv.Reply{}
+	if msg.GetType() != cellaserv.Message_Reply || proto.Unmarshal(msg.Content, rep) != nil {
+		t.Fatalf("Got %s, want a reply", msg.GetType())
+	}
+	if rep.GetId() != 4 || rep.Error.GetType() != cellaserv.Reply_Error_Custom ||
+		rep.Error.GetWhat() != "cellaserv is shutting down" {
+		t.Errorf("Got reply %v, want the shutdown error of request 4", rep)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdownRequests did not return")
+	}
+	if n := requestsPending(); n != 0 {
+		t.Errorf("%d requests still pending", n)
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"github.com/golang/protobuf/proto"
+	"net"
+	"time"
+)
+
+/*
+Stamps of the publishes.
+
+cellaserv numbers the publishes it receives, with a sequence number shared by all the events: a
+subscriber sees gaps for the publishes it does not subscribe to or filters out. A connection that
+subscribes with the extStamp field, or with "Stamp": true in cellaserv.subscribe, receives all its
+publishes with the sequence number, the time they were received and the name of their publisher in
+extension fields. Other connections receive the publishes as they were sent.
+
+The stamp fields are appended to the publish, a value set by the publisher is overridden since the
+last value of a field wins.
+*/
+
+// Connections receiving stamped publishes, protected by pubsubMtx
+var stampedConns = make(map[net.Conn]bool)
+
+type publishStamp struct {
+	seq       uint64
+	time      time.Time
+	publisher string
+}
+
+// stampMessage returns the publish message msgBytes with the stamp fields
+func (s *publishStamp) stampMessage(msgBytes []byte) []byte {
+	msg := &cellaserv.Message{}
+	if err := proto.Unmarshal(msgBytes, msg); err != nil {
+		log.Error("[Publish] Could not stamp publish: %s", err)
+		return msgBytes
+	}
+
+	content := make([]byte, len(msg.Content), len(msg.Content)+len(s.publisher)+32)
+	copy(content, msg.Content)
+	content = extAppendVarint(content, extSeq, s.seq)
+	content = extAppendVarint(content, extTimestamp, uint64(s.time.UnixNano()))
+	content = extAppendBytes(content, extPublisher, []byte(s.publisher))
+
+	stamped, err := messageWithContent(cellaserv.Message_Publish, content)
+	if err != nil {
+		log.Error("[Publish] Could not stamp publish: %s", err)
+		return msgBytes
+	}
+	return stamped
+}
+
+// queuePublish queues the publish to conn, stamped if conn asked for it. pubsubMtx must be held,
+// the caller writes the queue with flushMessages after releasing it.
+func queuePublish(conn net.Conn, msgBytes []byte, stamp *publishStamp) {
+	if !stampedConns[conn] {
+		stamp = nil
+	}
+	queueMessage(conn, msgBytes, stamp)
+}
+
+// vim: set nowrap tw=100 noet sw=8:
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"bytes"
+	"encoding/binary"
+	"github.com/golang/protobuf/proto"
+	"net"
+	"testing"
+	"time"
+)
+
+// testStampFields returns the stamp fields of the publish message msgBytes
+func testStampFields(t *testing.T, msgBytes []byte) (uint64, time.Time, string) {
+	_, exts := testMessageExts(t, msgBytes)
+	seq, _ := binary.Uvarint(exts[extSeq])
+	ts, _ := binary.Uvarint(exts[extTimestamp])
+	return seq, time.Unix(0, int64(ts)), string(exts[extPublisher])
+}
+
+func TestStampMessage(t *testing.T) {
+	event := "robot.position"
+	pub := &cellaserv.Publish{Event: &event, Data: []byte(`{"x": 1}`)}
+	received := time.Unix(1000, 42)
+	stamp := &publishStamp{7, received, "127.0.0.1:40001"}
+
+	tests := []struct {
+		name string
+		exts [][]byte
+	}{
+		{"not stamped", nil},
+		// The publisher cannot choose its stamp
+		{"stamped by the publisher", [][]byte{
+			extAppendVarint(nil, extSeq, 99),
+			extAppendVarint(nil, extTimestamp, 1),
+			extAppendBytes(nil, extPublisher, []byte("fake")),
+		}},
+		{"other extension", [][]byte{extAppendBytes(nil, testExtField, []byte("kept"))}},
+	}
+	for _, test := range tests {
+		msgBytes := testTracedMessage(t, cellaserv.Message_Publish, pub, test.exts...)
+		original := append([]byte(nil), msgBytes...)
+		stamped := stamp.stampMessage(msgBytes)
+		if !bytes.Equal(msgBytes, original) {
+			t.Errorf("%s: the message was modified", test.name)
+		}
+
+		seq, ts, publisher := testStampFields(t, stamped)
+		if seq != 7 || !ts.Equal(received) || publisher != "127.0.0.1:40001" {
+			t.Errorf("%s: stamped %d, %s, %s", test.name, seq, ts, publisher)
+		}
+
+		msg := &cellaserv.Message{}
+		got := &cellaserv.Publish{}
+		proto.Unmarshal(stamped, msg)
+		if err := proto.Unmarshal(msg.Content, got); err != nil ||
+			msg.GetType() != cellaserv.Message_Publish || got.GetEvent() != event ||
+			string(got.Data) != `{"x": 1}` {
+			t.Errorf("%s: stamped %v, %v, want the publish", test.name, msg, got)
+		}
+		// The fields of the publisher are kept before the stamp
+		sent := &cellaserv.Message{}
+		proto.Unmarshal(msgBytes, sent)
+		if !bytes.HasPrefix(msg.Content, sent.Content) {
+			t.Errorf("%s: the content of the publish is not kept", test.name)
+		}
+	}
+}
+
+// testReadRaw reads the next message sent to the peer of a connection, as it was sent
+func testReadRaw(t *testing.T, peer net.Conn) []byte {
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msgBytes, err := readRawMessage(peer)
+	if err != nil {
+		t.Errorf("Could not read message: %s", err)
+	}
+	return msgBytes
+}
+
+// Only the connections asking for it receive stamped publishes
+func TestStampSubscribers(t *testing.T) {
+	stampedConn, stampedPeer := testSubscriber(t, "robot.position")
+	_, peer := testSubscriber(t, "robot.position")
+	pubsubMtx.Lock()
+	stampedConns[stampedConn] = true
+	pubsubMtx.Unlock()
+
+	event := "robot.position"
+	pub := &cellaserv.Publish{Event: &event, Data: []byte("1")}
+	msgBytes := testMessage(t, cellaserv.Message_Publish, pub)
+	go doPublish("test", msgBytes, pub)
+
+	// The publish is written to the subscribers in any order
+	received := make(chan []byte)
+	go func() { received <- testReadRaw(t, stampedPeer) }()
+	if got := testReadRaw(t, peer); !bytes.Equal(got, msgBytes) {
+		t.Errorf("Received %x, want the publish as it was sent %x", got, msgBytes)
+	}
+
+	stamped := <-received
+	seq, ts, publisher := testStampFields(t, stamped)
+	pubsubMtx.Lock()
+	lastSeq := publishSeq
+	pubsubMtx.Unlock()
+	if seq != lastSeq || time.Since(ts) > time.Minute || publisher != "test" {
+		t.Errorf("Stamped %d, %s, %s, want %d by test", seq, ts, publisher, lastSeq)
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
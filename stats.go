@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"encoding/json"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Number of latencies kept per service to compute percentiles
+const statsLatencyWindow = 1024
+
+// Counters of a connection, the directions are seen from cellaserv
+type connStats struct {
+	BytesIn         uint64
+	BytesOut        uint64
+	MessagesIn      uint64
+	MessagesOut     uint64
+	RequestsSent    uint64
+	RepliesReceived uint64
+	LastActivity    time.Time
+}
+
+type serviceStats struct {
+	requests   uint64
+	timeouts   uint64
+	replies    uint64
+	latencySum time.Duration
+	// Ring buffer of the last latencies
+	latencies []time.Duration
+	next      int
+}
+
+type eventStats struct {
+	publishes  uint64
+	deliveries uint64
+}
+
+var (
+	// Time at which cellaserv was started
+	startTime time.Time
+
+	// Protects the statistics, sendRawMessage is also called by timers
+	statsMtx sync.Mutex
+
+	statsConns    = make(map[net.Conn]*connStats)
+	statsServices = make(map[string]*serviceStats)
+	statsEvents   = make(map[string]*eventStats)
+)
+
+// statsConn returns the counters of the connection, or nil if the connection is not handled
+// anymore, statsMtx must be held
+func statsConn(conn net.Conn) *connStats {
+	return statsConns[conn]
+}
+
+// statsService returns the counters of the service, or nil if the service was never registered,
+// statsMtx must be held
+func statsService(name string) *serviceStats {
+	return statsServices[name]
+}
+
+func statsIncoming(conn net.Conn, size int) {
+	statsMtx.Lock()
+	if s := statsConn(conn); s != nil {
+		s.BytesIn += uint64(size)
+		s.MessagesIn++
+		s.LastActivity = time.Now()
+	}
+	statsMtx.Unlock()
+}
+
+func statsOutgoing(conn net.Conn, size int) {
+	statsMtx.Lock()
+	if s := statsConn(conn); s != nil {
+		s.BytesOut += uint64(size)
+		s.MessagesOut++
+		s.LastActivity = time.Now()
+	}
+	statsMtx.Unlock()
+}
+
+func statsRequestSent(conn net.Conn) {
+	statsMtx.Lock()
+	if s := statsConn(conn); s != nil {
+		s.RequestsSent++
+	}
+	statsMtx.Unlock()
+}
+
+func statsReplyReceived(conn net.Conn) {
+	statsMtx.Lock()
+	if s := statsConn(conn); s != nil {
+		s.RepliesReceived++
+	}
+	statsMtx.Unlock()
+}
+
+// statsAddConn starts counting the messages of the connection
+func statsAddConn(conn net.Conn) {
+	statsMtx.Lock()
+	statsConns[conn] = &connStats{}
+	statsMtx.Unlock()
+}
+
+// statsRemoveConn forgets the counters of the connection, messages sent to it afterwards are not
+// counted
+func statsRemoveConn(conn net.Conn) {
+	statsMtx.Lock()
+	delete(statsConns, conn)
+	statsMtx.Unlock()
+}
+
+// statsAddService starts counting the requests of a registered service, the counters are kept when
+// the service leaves
+func statsAddService(name, ident string) {
+	key := serviceFullName(name, ident)
+	statsMtx.Lock()
+	if _, ok := statsServices[key]; !ok {
+		statsServices[key] = &serviceStats{}
+	}
+	statsMtx.Unlock()
+}
+
+func statsRequest(req *cellaserv.Request) {
+	statsMtx.Lock()
+	if s := statsService(requestServiceName(req)); s != nil {
+		s.requests++
+	}
+	statsMtx.Unlock()
+}
+
+func statsTimeout(req *cellaserv.Request) {
+	statsMtx.Lock()
+	if s := statsService(requestServiceName(req)); s != nil {
+		s.timeouts++
+	}
+	statsMtx.Unlock()
+}
+
+func statsReply(req *cellaserv.Request, latency time.Duration) {
+	statsMtx.Lock()
+	defer statsMtx.Unlock()
+
+	s := statsService(requestServiceName(req))
+	if s == nil {
+		return
+	}
+	s.replies++
+	s.latencySum += latency
+	if len(s.latencies) < statsLatencyWindow {
+		s.latencies = append(s.latencies, latency)
+	} else {
+		s.latencies[s.next] = latency
+		s.next = (s.next + 1) % statsLatencyWindow
+	}
+}
+
+func statsPublish(event string, fanOut int) {
+	statsMtx.Lock()
+	s, ok := statsEvents[event]
+	if !ok {
+		s = &eventStats{}
+		statsEvents[event] = s
+	}
+	s.publishes++
+	s.deliveries += uint64(fanOut)
+	statsMtx.Unlock()
+}
+
+// statsPercentile returns the p-th percentile of the latencies with the nearest-rank method: the
+// smallest latency greater than or equal to p percent of them, p is from 1 to 100. latencies must
+// not be empty.
+func statsPercentile(latencies []time.Duration, p int) time.Duration {
+	sorted := append([]time.Duration{}, latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	// Rank ceil(p/100*n), from 1
+	rank := (len(sorted)*p + 99) / 100
+	return sorted[rank-1]
+}
+
+type connStatsJSON struct {
+	Addr string
+	Name string
+	connStats
+}
+
+type serviceStatsJSON struct {
+	Requests uint64
+	Timeouts uint64
+	// Latencies in seconds
+	MeanLatency float64
+	P99Latency  float64
+}
+
+type eventStatsJSON struct {
+	Publishes  uint64
+	Deliveries uint64
+	MeanFanOut float64
+}
+
+type statsJSON struct {
+	Uptime      float64
+	Connections []connStatsJSON
+	Services    map[string]serviceStatsJSON
+	Events      map[string]eventStatsJSON
+}
+
+// handleStats replies with runtime statistics of cellaserv
+func handleStats(conn net.Conn, req *cellaserv.Request) {
+	stats := statsJSON{
+		Uptime:      time.Since(startTime).Seconds(),
+		Connections: make([]connStatsJSON, 0),
+		Services:    make(map[string]serviceStatsJSON),
+		Events:      make(map[string]eventStatsJSON),
+	}
+
+	statsMtx.Lock()
+	for c := connList.Front(); c != nil; c = c.Next() {
+		connElt := c.Value.(net.Conn)
+		connStatsElt := connStats{}
+		if s, ok := statsConns[connElt]; ok {
+			connStatsElt = *s
+		}
+		stats.Connections = append(stats.Connections,
+			connStatsJSON{connElt.RemoteAddr().String(), connDescribe(connElt), connStatsElt})
+	}
+
+	for name, s := range statsServices {
+		srvcStats := serviceStatsJSON{Requests: s.requests, Timeouts: s.timeouts}
+		if s.replies > 0 {
+			srvcStats.MeanLatency = (s.latencySum / time.Duration(s.replies)).Seconds()
+		}
+		if len(s.latencies) > 0 {
+			srvcStats.P99Latency = statsPercentile(s.latencies, 99).Seconds()
+		}
+		stats.Services[name] = srvcStats
+	}
+
+	for event, s := range statsEvents {
+		stats.Events[event] = eventStatsJSON{s.publishes, s.deliveries,
+			float64(s.deliveries) / float64(s.publishes)}
+	}
+	statsMtx.Unlock()
+
+	data, err := json.Marshal(stats)
+	if err != nil {
+		log.Error("[Cellaserv] Could not marshal the stats")
+	}
+	sendReply(conn, req, data)
+}
+
+// vim: set nowrap tw=100 noet sw=8:
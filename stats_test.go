@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"encoding/json"
+	"github.com/golang/protobuf/proto"
+	"net"
+	"testing"
+	"time"
+)
+
+// testLatencies returns the latencies 1ms to n ms, in reverse order
+func testLatencies(n int) []time.Duration {
+	var latencies []time.Duration
+	for i := n; i > 0; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	return latencies
+}
+
+func TestStatsPercentile(t *testing.T) {
+	tests := []struct {
+		latencies []time.Duration
+		p         int
+		want      time.Duration
+	}{
+		{testLatencies(1), 99, 1 * time.Millisecond},
+		{testLatencies(2), 99, 2 * time.Millisecond},
+		{testLatencies(2), 50, 1 * time.Millisecond},
+		{testLatencies(10), 99, 10 * time.Millisecond},
+		{testLatencies(10), 90, 9 * time.Millisecond},
+		{testLatencies(10), 50, 5 * time.Millisecond},
+		{testLatencies(99), 99, 99 * time.Millisecond},
+		{testLatencies(100), 99, 99 * time.Millisecond},
+		{testLatencies(101), 99, 100 * time.Millisecond},
+		{testLatencies(200), 99, 198 * time.Millisecond},
+		{testLatencies(1024), 99, 1014 * time.Millisecond},
+		{testLatencies(100), 100, 100 * time.Millisecond},
+		{testLatencies(100), 1, 1 * time.Millisecond},
+		{[]time.Duration{5, 5, 1, 5}, 99, 5},
+	}
+	for _, test := range tests {
+		if got := statsPercentile(test.latencies, test.p); got != test.want {
+			t.Errorf("statsPercentile(%d latencies, %d) = %s, want %s",
+				len(test.latencies), test.p, got, test.want)
+		}
+	}
+}
+
+// testRequest returns a request to the service
+func testRequest(service, ident, method string) *cellaserv.Request {
+	id := uint64(1)
+	req := &cellaserv.Request{ServiceName: &service, Method: &method, Id: &id}
+	if ident != "" {
+		req.ServiceIdentification = &ident
+	}
+	return req
+}
+
+// Only the registered services are counted, the unknown names do not add entries
+func TestStatsServices(t *testing.T) {
+	statsAddService("stats", "")
+	statsAddService("stats", "pal")
+	defer func() {
+		statsMtx.Lock()
+		delete(statsServices, "stats")
+		delete(statsServices, "stats/pal")
+		statsMtx.Unlock()
+	}()
+
+	statsRequest(testRequest("stats", "", "m"))
+	statsRequest(testRequest("stats", "pal", "m"))
+	statsRequest(testRequest("stats", "pal", "m"))
+	statsTimeout(testRequest("stats", "pal", "m"))
+	statsReply(testRequest("stats", "pal", "m"), 3*time.Millisecond)
+	statsReply(testRequest("stats", "pal", "m"), 5*time.Millisecond)
+	for _, name := range []string{"stats-typo", "nonexistent"} {
+		statsRequest(testRequest(name, "", "m"))
+		statsTimeout(testRequest(name, "", "m"))
+		statsReply(testRequest(name, "", "m"), time.Millisecond)
+	}
+	statsRequest(testRequest("stats", "pmi", "m"))
+
+	// Registering again keeps the counters
+	statsAddService("stats", "pal")
+
+	statsMtx.Lock()
+	defer statsMtx.Unlock()
+	for _, name := range []string{"stats-typo", "nonexistent", "stats/pmi"} {
+		if _, ok := statsServices[name]; ok {
+			t.Errorf("Stats of the unregistered service %s", name)
+		}
+	}
+	if s := statsServices["stats"]; s == nil || s.requests != 1 || s.replies != 0 {
+		t.Errorf("Stats of stats: %+v", s)
+	}
+	s := statsServices["stats/pal"]
+	if s == nil || s.requests != 2 || s.timeouts != 1 || s.replies != 2 ||
+		s.latencySum != 8*time.Millisecond {
+		t.Errorf("Stats of stats/pal: %+v", s)
+	}
+}
+
+// The latencies of the last statsLatencyWindow replies are kept
+func TestStatsReplyWindow(t *testing.T) {
+	statsAddService("window", "")
+	defer func() {
+		statsMtx.Lock()
+		delete(statsServices, "window")
+		statsMtx.Unlock()
+	}()
+
+	req := testRequest("window", "", "m")
+	for i := 0; i < statsLatencyWindow+10; i++ {
+		statsReply(req, time.Duration(i))
+	}
+
+	statsMtx.Lock()
+	defer statsMtx.Unlock()
+	s := statsServices["window"]
+	if len(s.latencies) != statsLatencyWindow || s.next != 10 {
+		t.Fatalf("%d latencies, next %d", len(s.latencies), s.next)
+	}
+	if s.latencies[9] != statsLatencyWindow+9 || s.latencies[10] != 10 {
+		t.Errorf("Latencies %d %d, want the last ones", s.latencies[9], s.latencies[10])
+	}
+	if s.replies != statsLatencyWindow+10 {
+		t.Errorf("%d replies", s.replies)
+	}
+}
+
+func TestHandleStats(t *testing.T) {
+	statsAddService("handled", "")
+	defer func() {
+		statsMtx.Lock()
+		delete(statsServices, "handled")
+		statsMtx.Unlock()
+	}()
+	for i := 1; i <= 100; i++ {
+		statsRequest(testRequest("handled", "", "m"))
+		statsReply(testRequest("handled", "", "m"), time.Duration(i)*time.Millisecond)
+	}
+
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	sendQueueAdd(conn)
+	defer sendQueueRemove(conn)
+
+	go handleStats(conn, testRequest("cellaserv", "", "stats"))
+	msg := testRead(t, peer)
+	rep := &cellaserv.Reply{}
+	proto.Unmarshal(msg.Content, rep)
+	var stats statsJSON
+	if err := json.Unmarshal(rep.Data, &stats); err != nil {
+		t.Fatalf("%s: %s", rep.Data, err)
+	}
+	s, ok := stats.Services["handled"]
+	if !ok {
+		t.Fatalf("No stats of the service: %s", rep.Data)
+	}
+	if s.Requests != 100 || s.MeanLatency != 0.0505 || s.P99Latency != 0.099 {
+		t.Errorf("Stats %+v, want 100 requests, mean 50.5ms and p99 99ms", s)
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+/*
+Stub services answering with the replies of a dump.
+
+The stub registers the services that replied to requests in the dump, and answers each request with
+the reply recorded for the same request. When a request was recorded several times, its replies are
+given in order, then the last one is repeated.
+
+-match selects what makes two requests the same:
+
+	method: the service, its identification and the method
+	data:   the method, and the same data
+	json:   the method, and the same JSON data, ignoring formatting and the order of the keys
+
+-fallback selects the answer to the requests that were not recorded:
+
+	error:  reply with an error
+	method: reply with the replies of the same method, regardless of the data
+	ignore: do not reply, the request times out
+*/
+
+// Replies recorded for a request
+type stubReplies struct {
+	replies []*cellaserv.Reply
+	next    int
+}
+
+// reply returns the next reply of the sequence
+func (s *stubReplies) reply() *cellaserv.Reply {
+	rep := s.replies[s.next]
+	if s.next < len(s.replies)-1 {
+		s.next++
+	}
+	return rep
+}
+
+type stubServer struct {
+	match    string
+	fallback string
+
+	// Services to register, by name then identification
+	services map[string]map[string]bool
+	// Replies by request key, see key(), and by method
+	replies       map[string]*stubReplies
+	methodReplies map[string]*stubReplies
+}
+
+func newStubServer(match, fallback string) *stubServer {
+	return &stubServer{
+		match:         match,
+		fallback:      fallback,
+		services:      make(map[string]map[string]bool),
+		replies:       make(map[string]*stubReplies),
+		methodReplies: make(map[string]*stubReplies),
+	}
+}
+
+func stubMethodKey(service, ident, method string) string {
+	return service + "[" + ident + "]." + method
+}
+
+// key returns the key of a request according to the match rule
+func (s *stubServer) key(service, ident, method string, data []byte) string {
+	key := stubMethodKey(service, ident, method)
+	switch s.match {
+	case "data":
+		key += " " + string(data)
+	case "json":
+		// Numbers are kept as written, float64 would confuse the IDs above 2^53
+		var v interface{}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if json.Valid(data) && dec.Decode(&v) == nil {
+			// Maps are marshalled with sorted keys
+			data, _ = json.Marshal(v)
+		}
+		key += " " + string(data)
+	}
+	return key
+}
+
+func stubAdd(m map[string]*stubReplies, key string, rep *cellaserv.Reply) {
+	s, ok := m[key]
+	if !ok {
+		s = &stubReplies{}
+		m[key] = s
+	}
+	s.replies = append(s.replies, rep)
+}
+
+// load reads the replies of the services in the dump
+func (s *stubServer) load(filename string, only map[string]bool) error {
+	dec := newDumpDecoder()
+	return dumpReadFile(filename, func(rec *dumpRecord) error {
+		frame, err := dec.decode(rec)
+		if err != nil {
+			return err
+		}
+		// Replies sent by the services to cellaserv, they have their request in the dump
+		if frame.Type != "Reply" || !rec.Incoming || frame.Method == "" {
+			return nil
+		}
+		if len(only) > 0 && !only[frame.Service] {
+			return nil
+		}
+		req := dec.requests[frame.id()]
+
+		rep := &cellaserv.Reply{}
+		msg := &cellaserv.Message{}
+		if err := proto.Unmarshal(rec.Msg, msg); err != nil {
+			return err
+		}
+		if err := proto.Unmarshal(msg.Content, rep); err != nil {
+			return err
+		}
+
+		idents, ok := s.services[req.Service]
+		if !ok {
+			idents = make(map[string]bool)
+			s.services[req.Service] = idents
+		}
+		idents[req.Identification] = true
+
+		data := []byte(req.Data)
+		if req.Data == nil {
+			data = req.DataBase64
+		}
+		stubAdd(s.replies, s.key(req.Service, req.Identification, req.Method, data), rep)
+		methodKey := stubMethodKey(req.Service, req.Identification, req.Method)
+		stubAdd(s.methodReplies, methodKey, rep)
+		return nil
+	})
+}
+
+// answer returns the reply to the request, or nil if it must not be answered
+func (s *stubServer) answer(req *cellaserv.Request) (*cellaserv.Reply, string) {
+	service, ident, method := req.GetServiceName(), req.GetServiceIdentification(),
+		req.GetMethod()
+
+	if replies, ok := s.replies[s.key(service, ident, method, req.Data)]; ok {
+		return replies.reply(), "recorded"
+	}
+
+	switch s.fallback {
+	case "method":
+		if replies, ok := s.methodReplies[stubMethodKey(service, ident, method)]; ok {
+			return replies.reply(), "fallback"
+		}
+	case "ignore":
+		return nil, "ignored"
+	}
+
+	errType := cellaserv.Reply_Error_Custom
+	what := "no recorded reply"
+	return &cellaserv.Reply{Error: &cellaserv.Reply_Error{Type: &errType, What: &what}}, "error"
+}
+
+// serve registers the services and answers their requests until the connection is closed
+func (s *stubServer) serve(conn net.Conn) error {
+	for name, idents := range s.services {
+		for ident := range idents {
+			register := &cellaserv.Register{Name: proto.String(name)}
+			if ident != "" {
+				register.Identification = proto.String(ident)
+			}
+			content, err := proto.Marshal(register)
+			if err != nil {
+				return err
+			}
+			msg, err := messageWithContent(cellaserv.Message_Register, content)
+			if err != nil {
+				return err
+			}
+			if err := writeRawMessage(conn, msg); err != nil {
+				return err
+			}
+			if ident != "" {
+				fmt.Printf("Registered %s[%s]\n", name, ident)
+			} else {
+				fmt.Println("Registered", name)
+			}
+		}
+	}
+
+	for {
+		msgBytes, err := readRawMessage(conn)
+		if err != nil {
+			return err
+		}
+		msg := &cellaserv.Message{}
+		if err := proto.Unmarshal(msgBytes, msg); err != nil {
+			return err
+		}
+		if msg.GetType() != cellaserv.Message_Request {
+			continue
+		}
+		req := &cellaserv.Request{}
+		if err := proto.Unmarshal(msg.Content, req); err != nil {
+			return err
+		}
+
+		rep, how := s.answer(req)
+		fmt.Printf("%s.%s id:%d %s\n", requestServiceName(req), req.GetMethod(),
+			req.GetId(), how)
+		if rep == nil {
+			continue
+		}
+
+		content, err := proto.Marshal(&cellaserv.Reply{Id: req.Id, Data: rep.Data,
+			Error: rep.Error})
+		if err != nil {
+			return err
+		}
+		repMsg, err := messageWithContent(cellaserv.Message_Reply, content)
+		if err != nil {
+			return err
+		}
+		if err := writeRawMessage(conn, repMsg); err != nil {
+			return err
+		}
+	}
+}
+
+// stubCommand registers stub services answering with the replies of a dump
+func stubCommand(args []string) int {
+	flags := flag.NewFlagSet("stub", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cellaserv2 stub [flags] FILE")
+		flags.PrintDefaults()
+	}
+	addrFlag := flags.String("addr", "", "address of the broker, default to the client "+
+		"configuration, CS_HOST and CS_PORT")
+	servicesFlag := flags.String("services", "", "comma separated services to stub, default "+
+		"to all the services of the dump")
+	matchFlag := flags.String("match", "data", "requests with the same reply: method, data or "+
+		"json")
+	fallbackFlag := flags.String("fallback", "error", "reply to unknown requests: error, "+
+		"method or ignore")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	switch *matchFlag {
+	case "method", "data", "json":
+	default:
+		fmt.Fprintln(os.Stderr, "Invalid match rule:", *matchFlag)
+		return 2
+	}
+	switch *fallbackFlag {
+	case "error", "method", "ignore":
+	default:
+		fmt.Fprintln(os.Stderr, "Invalid fallback:", *fallbackFlag)
+		return 2
+	}
+
+	only := make(map[string]bool)
+	if *servicesFlag != "" {
+		for _, name := range strings.Split(*servicesFlag, ",") {
+			only[strings.TrimSpace(name)] = true
+		}
+	}
+
+	s := newStubServer(*matchFlag, *fallbackFlag)
+	if err := s.load(flags.Arg(0), only); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(s.services) == 0 {
+		fmt.Fprintln(os.Stderr, "No service replies in the dump")
+		return 1
+	}
+
+	addr := *addrFlag
+	if addr == "" {
+		addr = clientAddr()
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer conn.Close()
+
+	if err := s.serve(conn); err != nil && err != io.EOF {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// vim: set nowrap tw=100 noet sw=8:
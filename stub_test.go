@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStubKey(t *testing.T) {
+	tests := []struct {
+		match string
+		a, b  string
+		same  bool
+	}{
+		{"method", `{"x": 1}`, `{"x": 2}`, true},
+		{"data", `{"x": 1}`, `{"x": 1}`, true},
+		{"data", `{"x": 1, "y": 2}`, `{"y":2,"x":1}`, false},
+		{"json", `{"x": 1, "y": 2}`, `{"y":2,"x":1}`, true},
+		{"json", `[1, 2]`, `[2, 1]`, false},
+		// Equal as float64
+		{"json", `{"id": 9007199254740993}`, `{"id": 9007199254740992}`, false},
+		// Invalid JSON is compared as is
+		{"json", `{"x": 1`, `{"x":1`, false},
+		{"json", `{"x": 1} {"y": 2}`, `{"x": 1} {"y": 3}`, false},
+	}
+	for _, test := range tests {
+		s := newStubServer(test.match, "error")
+		a := s.key("date", "", "time", []byte(test.a))
+		b := s.key("date", "", "time", []byte(test.b))
+		if (a == b) != test.same {
+			t.Errorf("Match %s: keys %q and %q, want same %t", test.match, a, b,
+				test.same)
+		}
+	}
+}
+
+/*
+testStubMessages returns a dump of the date service answering date.time with a, b then c, the
+first two for the same data, and the other service answering other.time with d. The replies
+forwarded to the client are not recorded.
+*/
+func testStubMessages(t *testing.T) []testInspectMessage {
+	client, date, other := "127.0.0.1:40001", "127.0.0.1:40002", "127.0.0.1:40004"
+	method := "time"
+	request := func(name string, id uint64, data string) []byte {
+		return testMessage(t, cellaserv.Message_Request, &cellaserv.Request{
+			ServiceName: &name, Method: &method, Id: &id, Data: []byte(data)})
+	}
+	reply := func(id uint64, data string) []byte {
+		return testMessage(t, cellaserv.Message_Reply,
+			&cellaserv.Reply{Id: &id, Data: []byte(data)})
+	}
+	ms := time.Millisecond
+
+	return []testInspectMessage{
+		{date, 0, request("date", 1, "1"), false},
+		{date, 1 * ms, reply(1, "a"), true},
+		{client, 2 * ms, reply(1, "a"), false},
+		{date, 3 * ms, request("date", 2, "1"), false},
+		{date, 4 * ms, reply(2, "b"), true},
+		{date, 5 * ms, request("date", 3, `{"x": 1, "y": 2}`), false},
+		{date, 6 * ms, reply(3, "c"), true},
+		{other, 7 * ms, request("other", 4, ""), false},
+		{other, 8 * ms, reply(4, "d"), true},
+	}
+}
+
+// testStubAnswer returns the data of a reply, error if it is an error, or - if there is no reply
+func testStubAnswer(rep *cellaserv.Reply) string {
+	switch {
+	case rep == nil:
+		return "-"
+	case rep.Error != nil:
+		return "error"
+	}
+	return string(rep.Data)
+}
+
+func TestStubAnswer(t *testing.T) {
+	filename := testWritePcapng(t, testStubMessages(t))
+
+	tests := []struct {
+		match, fallback string
+		// Service and data of the requests
+		requests []string
+		want     string
+	}{
+		// The replies are given in sequence, then the last one is repeated
+		{"data", "error", []string{"date 1", "date 1", "date 1", "other "},
+			"[a b b d]"},
+		{"data", "error", []string{`date {"x": 1, "y": 2}`, `date {"y":2,"x":1}`, "date 2"},
+			"[c error error]"},
+		{"json", "error", []string{`date {"y":2,"x":1}`, "date 1"}, "[c a]"},
+		{"method", "error", []string{"date 3", "date 3", "date 3", "date 3", "other 3"},
+			"[a b c c d]"},
+		// The replies of the method are a sequence of their own
+		{"data", "method", []string{"date 3", "date 1", "date 3", "none 1"},
+			"[a a b error]"},
+		{"data", "ignore", []string{"date 3", "date 1", "none 1"}, "[- a -]"},
+	}
+	for _, test := range tests {
+		s := newStubServer(test.match, test.fallback)
+		if err := s.load(filename, nil); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for i, r := range test.requests {
+			fields := strings.SplitN(r, " ", 2)
+			id := uint64(i)
+			method := "time"
+			rep, _ := s.answer(&cellaserv.Request{ServiceName: &fields[0],
+				Method: &method, Id: &id, Data: []byte(fields[1])})
+			got = append(got, testStubAnswer(rep))
+		}
+		if fmt.Sprint(got) != test.want {
+			t.Errorf("Match %s, fallback %s: replies %v to %q, want %s", test.match,
+				test.fallback, got, test.requests, test.want)
+		}
+	}
+}
+
+func TestStubLoadServices(t *testing.T) {
+	filename := testWritePcapng(t, testStubMessages(t))
+	s := newStubServer("data", "error")
+	if err := s.load(filename, map[string]bool{"other": true}); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.services) != 1 || !s.services["other"][""] {
+		t.Errorf("Services %v, want other", s.services)
+	}
+	if len(s.methodReplies) != 1 || s.methodReplies["other[].time"] == nil {
+		t.Errorf("Methods %v, want other.time", s.methodReplies)
+	}
+}
+
+// The stub registers the services, and replies with the ID of the request
+func TestStubServe(t *testing.T) {
+	filename := testWritePcapng(t, testStubMessages(t))
+	s := newStubServer("data", "error")
+	if err := s.load(filename, map[string]bool{"date": true}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	done := make(chan error, 1)
+	go func() { done <- s.serve(conn) }()
+
+	msg := testRead(t, peer)
+	register := &cellaserv.Register{}
+	proto.Unmarshal(msg.Content, register)
+	if msg.GetType() != cellaserv.Message_Register || register.GetName() != "date" {
+		t.Fatalf("Received %v, want the registration of date", msg)
+	}
+
+	name, method, id := "date", "time", uint64(42)
+	writeRawMessage(peer, testMessage(t, cellaserv.Message_Request,
+		&cellaserv.Request{ServiceName: &name, Method: &method, Id: &id,
+			Data: []byte("1")}))
+	msg = testRead(t, peer)
+	rep := &cellaserv.Reply{}
+	proto.Unmarshal(msg.Content, rep)
+	if msg.GetType() != cellaserv.Message_Reply || rep.GetId() != 42 ||
+		string(rep.Data) != "a" {
+		t.Errorf("Received %v, want the reply a to the request 42", rep)
+	}
+
+	peer.Close()
+	if err := <-done; err == nil {
+		t.Error("Served after the connection was closed")
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
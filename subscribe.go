@@ -4,24 +4,266 @@ import (
 	"bitbucket.org/evolutek/cellaserv2-protobuf"
 	"encoding/json"
 	"net"
-	"strings"
+	"sync"
+	"time"
 )
 
+// Protects the subscribers, the history and the sequence number of the publishes, so that a new
+// subscriber gets every publish exactly once, from the history or live. Messages are only queued
+// while holding it, see send_queue.go.
+var pubsubMtx sync.Mutex
+
+// Index of the patterns of subscriberMatchMap, protected by pubsubMtx
+var subscriberIndex = newTopicIndex()
+
+// A subscription of a connection to an event or a pattern
+type subscription struct {
+	conn  net.Conn
+	event string
+}
+
+// Filters of the subscriptions that have one, protected by pubsubMtx
+var subscriptionFilters = make(map[subscription]*subscriptionFilter)
+
 type LogSubscriberJSON struct {
 	Event   string
 	SubAddr string
 }
 
-func handleSubscribe(conn net.Conn, sub *cellaserv.Subscribe) {
-	log.Info("[Subscribe] %s subscribes to %s", conn.RemoteAddr(), *sub.Event)
-	if strings.Contains(*sub.Event, "*") {
-		subscriberMatchMap[*sub.Event] = append(subscriberMatchMap[*sub.Event], conn)
+// Sent with logSubscribeError when a Subscribe message is refused, it has no reply to carry the
+// error
+type logSubscribeErrorJSON struct {
+	Event   string
+	SubAddr string
+	Error   string
+}
+
+// subscribeError logs and publishes the error of a Subscribe message of conn
+func subscribeError(conn net.Conn, event string, err error) {
+	log.Warning("[Subscribe] %s not subscribed to %s: %s", connDescribe(conn), event, err)
+	pub_json, _ := json.Marshal(logSubscribeErrorJSON{event, conn.RemoteAddr().String(),
+		err.Error()})
+	cellaservPublish(logSubscribeError, pub_json)
+}
+
+// setFilter sets the filter of the subscription, nil to remove it, pubsubMtx must be held
+func setFilter(sub subscription, filter *subscriptionFilter) {
+	if filter != nil {
+		subscriptionFilters[sub] = filter
 	} else {
-		subscriberMap[*sub.Event] = append(subscriberMap[*sub.Event], conn)
+		delete(subscriptionFilters, sub)
+	}
+}
+
+// filtersMatch returns whether the publish passes one of the filters of the subscriptions of a
+// connection, a nil filter lets every publish pass
+func filtersMatch(filters []*subscriptionFilter, payload *filterPayload) bool {
+	for _, filter := range filters {
+		if filter == nil || filter.match(payload) {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribe adds conn to the subscribers of event, an event name or a pattern, see topic.go, with
+// an optional filter. It returns false if conn is already subscribed to event, in which case the
+// filter replaces the previous one, pubsubMtx must be held
+func subscribe(conn net.Conn, event string, filter *subscriptionFilter) (bool, error) {
+	subMap := subscriberMap
+	if topicIsPattern(event) {
+		subMap = subscriberMatchMap
+	}
+	for _, subConn := range subMap[event] {
+		if subConn == conn {
+			setFilter(subscription{conn, event}, filter)
+			return false, nil
+		}
+	}
+
+	if topicIsPattern(event) && len(subMap[event]) == 0 {
+		pattern, err := compileTopic(event)
+		if err != nil {
+			return false, err
+		}
+		subscriberIndex.add(pattern)
+	}
+	subMap[event] = append(subMap[event], conn)
+	setFilter(subscription{conn, event}, filter)
+	return true, nil
+}
+
+// unsubscribeAll removes conn from all the subscribers, and returns the events it was subscribed
+// to, pubsubMtx must be held
+func unsubscribeAll(conn net.Conn) []string {
+	var events []string
+	removeConnFromMap := func(subMap map[string][]net.Conn) {
+		for key, subs := range subMap {
+			for i, subConn := range subs {
+				if conn != subConn {
+					continue
+				}
+				// Remove from list of subscribers
+				subs[i] = subs[len(subs)-1]
+				subMap[key] = subs[:len(subs)-1]
+				delete(subscriptionFilters, subscription{conn, key})
+				events = append(events, key)
+
+				if len(subMap[key]) == 0 {
+					delete(subMap, key)
+					if topicIsPattern(key) {
+						subscriberIndex.remove(key)
+					}
+				}
+				break
+			}
+		}
+	}
+	removeConnFromMap(subscriberMap)
+	removeConnFromMap(subscriberMatchMap)
+	delete(stampedConns, conn)
+	return events
+}
+
+func handleSubscribe(conn net.Conn, msgBytes []byte, sub *cellaserv.Subscribe) {
+	log.Info("[Subscribe] %s subscribes to %s", conn.RemoteAddr(), *sub.Event)
+
+	var filter *subscriptionFilter
+	if expr, ok := extValue(msgBytes, extFilter); ok {
+		var err error
+		filter, err = compileFilter(string(expr))
+		if err != nil {
+			subscribeError(conn, *sub.Event, err)
+			return
+		}
 	}
 
+	pubsubMtx.Lock()
+	if extFlag(msgBytes, extStamp) {
+		stampedConns[conn] = true
+	}
+	added, err := subscribe(conn, *sub.Event, filter)
+	if err != nil {
+		pubsubMtx.Unlock()
+		subscribeError(conn, *sub.Event, err)
+		return
+	}
+	if added {
+		// Send the current value of the retained events
+		retainSendTo(conn, *sub.Event, filter, nil)
+	}
+	pubsubMtx.Unlock()
+	flushMessages(conn)
+
+	if !added {
+		log.Debug("[Subscribe] %s already subscribed to %s", connDescribe(conn), *sub.Event)
+		return
+	}
 	pub_json, _ := json.Marshal(LogSubscriberJSON{*sub.Event, conn.RemoteAddr().String()})
 	cellaservPublish(logNewSubscriber, pub_json)
 }
 
+type subscribeReplyJSON struct {
+	// Sequence number of the last publish at the time of the subscription
+	Seq uint64
+	// Number of publishes sent from the history
+	Replayed int
+}
+
+/*
+handleSubscribeRequest subscribes the connection of the request to an event, and sends the history
+of the event before the live publishes. The reply is sent after the history. With Stamp, the
+connection receives stamped publishes, see stamp.go. With Filter, only the publishes whose data
+matches the filter are sent, see filter.go. If the connection is already subscribed to the event,
+the filter replaces the previous one and only the history is sent.
+
+Request format, Since in nanoseconds since the epoch, Last a duration, eg. "10s":
+
+	{"Event": "pattern", "Since": 1500000000000000000, "SinceSeq": 42, "Last": "10s", "Stamp": true,
+		"Filter": "distance < 300"}
+*/
+func handleSubscribeRequest(conn net.Conn, req *cellaserv.Request) {
+	var query struct {
+		Event    string
+		Since    int64
+		SinceSeq uint64
+		Last     string
+		Stamp    bool
+		Filter   string
+	}
+	if err := json.Unmarshal(req.Data, &query); err != nil {
+		log.Warning("[Cellaserv] Could not unmarshal subscribe query: %s", err)
+		sendReplyError(conn, req, cellaserv.Reply_Error_BadArguments)
+		return
+	}
+	pattern, err := compileTopic(query.Event)
+	if err != nil {
+		log.Warning("[Cellaserv] Invalid event: %s", err)
+		sendReplyError(conn, req, cellaserv.Reply_Error_BadArguments)
+		return
+	}
+
+	var filter *subscriptionFilter
+	if query.Filter != "" {
+		filter, err = compileFilter(query.Filter)
+		if err != nil {
+			log.Warning("[Cellaserv] %s", err)
+			what := err.Error()
+			sendReplyErrorWhat(conn, req, cellaserv.Reply_Error_BadArguments, &what)
+			return
+		}
+	}
+
+	replay := query.Since != 0 || query.SinceSeq != 0 || query.Last != ""
+	var since time.Time
+	if query.Since != 0 {
+		since = time.Unix(0, query.Since)
+	}
+	if query.Last != "" {
+		last, err := time.ParseDuration(query.Last)
+		if err != nil || last < 0 || query.Since != 0 {
+			log.Warning("[Cellaserv] Invalid subscribe duration: %s", query.Last)
+			sendReplyError(conn, req, cellaserv.Reply_Error_BadArguments)
+			return
+		}
+		since = time.Now().Add(-last)
+	}
+
+	log.Info("[Subscribe] %s subscribes to %s with history", connDescribe(conn), query.Event)
+
+	pubsubMtx.Lock()
+	if query.Stamp {
+		stampedConns[conn] = true
+	}
+	// The pattern is valid
+	added, _ := subscribe(conn, query.Event, filter)
+	var history []*historyEntry
+	if replay {
+		history = historySince(pattern, filter, since, query.SinceSeq)
+	}
+	// The last value of the events in the history is already in the history
+	replayed := make(map[string]bool)
+	for _, e := range history {
+		replayed[e.event] = true
+	}
+	if added {
+		retainSendTo(conn, query.Event, filter, replayed)
+	}
+	// The live publishes are queued after the history, once pubsubMtx is released
+	for _, e := range history {
+		queuePublish(conn, e.msgBytes, &e.publishStamp)
+	}
+	reply := subscribeReplyJSON{Seq: publishSeq, Replayed: len(history)}
+	pubsubMtx.Unlock()
+	flushMessages(conn)
+
+	if added {
+		pub_json, _ := json.Marshal(LogSubscriberJSON{query.Event, conn.RemoteAddr().String()})
+		cellaservPublish(logNewSubscriber, pub_json)
+	}
+
+	data, _ := json.Marshal(reply)
+	sendReply(conn, req, data)
+}
+
 // vim: set nowrap tw=100 noet sw=8:
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPublish publishes the event from the test
+func testPublish(t *testing.T, event string, data string) {
+	pub := &cellaserv.Publish{Event: &event, Data: []byte(data)}
+	doPublish("test", testMessage(t, cellaserv.Message_Publish, pub), pub)
+}
+
+// testRead reads the next message sent to the peer of a connection
+func testRead(t *testing.T, peer net.Conn) *cellaserv.Message {
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msgBytes, err := readRawMessage(peer)
+	if err != nil {
+		t.Fatalf("Could not read message: %s", err)
+	}
+	msg := &cellaserv.Message{}
+	if err := proto.Unmarshal(msgBytes, msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// A subscriber replaying a long history without reading it does not block the publishes, and
+// receives the history, then the live publishes, without gap nor duplicate
+func TestSubscribeSlowSubscriber(t *testing.T) {
+	testHistory(t, "slow.#=100/0")
+	for i := 0; i < 50; i++ {
+		testPublish(t, "slow.history", fmt.Sprint(i))
+	}
+
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	sendQueueAdd(conn)
+	defer sendQueueRemove(conn)
+	defer func() {
+		pubsubMtx.Lock()
+		unsubscribeAll(conn)
+		pubsubMtx.Unlock()
+	}()
+
+	// net.Pipe blocks the writes until the peer reads them
+	service, method, id := "cellaserv", "subscribe", uint64(1)
+	req := &cellaserv.Request{ServiceName: &service, Method: &method, Id: &id,
+		Data: []byte(`{"Event": "slow.#", "Last": "1h"}`)}
+	go handleSubscribeRequest(conn, req)
+
+	for subscribed := false; !subscribed; {
+		time.Sleep(time.Millisecond)
+		pubsubMtx.Lock()
+		subscribed = len(subscriberMatchMap["slow.#"]) > 0
+		pubsubMtx.Unlock()
+	}
+
+	published := make(chan bool)
+	go func() {
+		testPublish(t, "slow.live", "50")
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(2 * time.Second):
+		t.Fatal("The publish is blocked by the slow subscriber")
+	}
+
+	for i := 0; i < 51; i++ {
+		msg := testRead(t, peer)
+		if msg.GetType() != cellaserv.Message_Publish {
+			t.Fatalf("Message %d: %s, want a publish", i, msg.GetType())
+		}
+		pub := &cellaserv.Publish{}
+		proto.Unmarshal(msg.Content, pub)
+		if string(pub.Data) != fmt.Sprint(i) {
+			t.Fatalf("Message %d: %s %s, want data %d", i, pub.GetEvent(), pub.Data, i)
+		}
+	}
+
+	msg := testRead(t, peer)
+	rep := &cellaserv.Reply{}
+	proto.Unmarshal(msg.Content, rep)
+	var reply subscribeReplyJSON
+	if msg.GetType() != cellaserv.Message_Reply || json.Unmarshal(rep.Data, &reply) != nil {
+		t.Fatalf("Got %s %s, want the subscribe reply", msg.GetType(), rep.Data)
+	}
+	if reply.Replayed != 50 {
+		t.Errorf("Replayed %d publishes, want 50", reply.Replayed)
+	}
+}
+
+// testSubscriber returns a connection subscribed to event, and its peer to read the publishes
+func testSubscriber(t *testing.T, event string) (net.Conn, net.Conn) {
+	conn, peer := net.Pipe()
+	sendQueueAdd(conn)
+	pubsubMtx.Lock()
+	subscribe(conn, event, nil)
+	pubsubMtx.Unlock()
+	t.Cleanup(func() {
+		pubsubMtx.Lock()
+		unsubscribeAll(conn)
+		pubsubMtx.Unlock()
+		sendQueueRemove(conn)
+		conn.Close()
+		peer.Close()
+	})
+	return conn, peer
+}
+
+// A connection with overlapping subscriptions receives each publish once
+func TestSubscribeOverlapping(t *testing.T) {
+	conn, peer := testSubscriber(t, "robot.#")
+	pubsubMtx.Lock()
+	first, _ := subscribe(conn, "robot.position", nil)
+	again, _ := subscribe(conn, "robot.position", nil)
+	subs := len(subscriberMap["robot.position"])
+	pubsubMtx.Unlock()
+	if !first || again || subs != 1 {
+		t.Errorf("Subscribed %t then %t, %d subscribers, want a single subscription", first,
+			again, subs)
+	}
+
+	published := make(chan bool)
+	go func() {
+		testPublish(t, "robot.position", "1")
+		testPublish(t, "robot.position", "2")
+		close(published)
+	}()
+	// A second copy of the first publish would be read before the second one
+	for _, want := range []string{"1", "2"} {
+		msg := testRead(t, peer)
+		pub := &cellaserv.Publish{}
+		proto.Unmarshal(msg.Content, pub)
+		if string(pub.Data) != want {
+			t.Fatalf("Received %s %s, want data %s", pub.GetEvent(), pub.Data, want)
+		}
+	}
+	<-published
+}
+
+// A Subscribe message has no reply, its errors are published
+func TestSubscribeErrors(t *testing.T) {
+	_, listener := testSubscriber(t, logSubscribeError)
+
+	tests := []struct {
+		event   string
+		filter  string
+		wantErr string
+	}{
+		{"a.#.b", "", "'#' is not the last segment"},
+		{"re:(", "", "Invalid regexp"},
+		{"robot.position", "x <", "Invalid filter"},
+		{"robot.position", "(x == 1", "Invalid filter"},
+	}
+	for _, test := range tests {
+		conn, peer := net.Pipe()
+		defer peer.Close()
+		defer conn.Close()
+
+		event := test.event
+		sub := &cellaserv.Subscribe{Event: &event}
+		content, _ := proto.Marshal(sub)
+		if test.filter != "" {
+			content = extAppendBytes(content, extFilter, []byte(test.filter))
+		}
+		msgBytes, _ := messageWithContent(cellaserv.Message_Subscribe, content)
+		go handleSubscribe(conn, msgBytes, sub)
+
+		msg := testRead(t, listener)
+		pub := &cellaserv.Publish{}
+		proto.Unmarshal(msg.Content, pub)
+		var data logSubscribeErrorJSON
+		if err := json.Unmarshal(pub.Data, &data); err != nil {
+			t.Fatalf("%s: %s %s: %s", test.event, pub.GetEvent(), pub.Data, err)
+		}
+		if data.Event != test.event || !strings.Contains(data.Error, test.wantErr) {
+			t.Errorf("%s: published %+v, want error %q", test.event, data, test.wantErr)
+		}
+
+		pubsubMtx.Lock()
+		subscribed := len(unsubscribeAll(conn)) > 0
+		pubsubMtx.Unlock()
+		if subscribed {
+			t.Errorf("%s: subscribed", test.event)
+		}
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
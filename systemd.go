@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// First file descriptor passed by systemd socket activation
+const sdListenFdsStart = 3
+
+/*
+sdNotify sends a state notification to systemd.
+
+It is a noop if cellaserv was not started by systemd with Type=notify. See sd_notify(3).
+*/
+func sdNotify(state string) error {
+	socketAddr := os.Getenv("NOTIFY_SOCKET")
+	if socketAddr == "" {
+		return nil
+	}
+
+	// Names starting with @ are in the abstract namespace, the net package handles them
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketAddr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns the watchdog timeout requested by systemd, or 0 if disabled
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	// The watchdog may be meant for another process
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+/*
+sdAlive checks that the serving path of cellaserv is still able to make progress.
+
+It takes, one after the other, the locks used when handling messages. If a handler deadlocked or
+is stuck while holding one of them, sdAlive blocks, the watchdog is not pinged anymore and systemd
+restarts cellaserv.
+*/
+func sdAlive() bool {
+	for _, mtx := range []*sync.Mutex{&metricsMtx, &pubsubMtx, &retainMtx, &statsMtx, &dumpMtx,
+		&reqIdsMtx, &traceMtx, &logMtx} {
+		mtx.Lock()
+		mtx.Unlock()
+	}
+	return !isShuttingDown()
+}
+
+// A listener whose Accept can be interrupted, as the TCP and unix listeners
+type sdDeadlineListener interface {
+	net.Listener
+	SetDeadline(t time.Time) error
+}
+
+/*
+sdWatchdog returns the period of the watchdog pings sent by the accept loop of ln, or 0 if the
+watchdog is disabled.
+
+The accept loop pings the watchdog twice per timeout, after checking the locks of the serving path
+with sdAlive. The watchdog thus detects an accept loop that stopped or is stuck, and a handler
+deadlocked or stuck with one of the locks. It does not detect a connection stuck on a read or a
+write, as its messages are read and written outside the locks: a client that stops reading only
+blocks its own connection.
+*/
+func sdWatchdog(ln net.Listener) time.Duration {
+	interval := sdWatchdogInterval()
+	if interval == 0 {
+		return 0
+	}
+	if _, ok := ln.(sdDeadlineListener); !ok {
+		log.Error("[Systemd] Watchdog disabled, cannot interrupt the accept loop of %s", ln.Addr())
+		return 0
+	}
+	log.Debug("[Systemd] Watchdog enabled, timeout: %s", interval)
+	return interval / 2
+}
+
+// sdWatchdogPing pings the watchdog if the serving path is alive
+func sdWatchdogPing() {
+	if !sdAlive() {
+		return
+	}
+	if err := sdNotify("WATCHDOG=1"); err != nil {
+		log.Error("[Systemd] Could not ping watchdog: %s", err)
+	}
+}
+
+/*
+sdListeners returns the listeners passed by systemd socket activation.
+
+See sd_listen_fds(3). The environment variables are cleared so that they are not inherited by
+child processes.
+*/
+func sdListeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil, nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	var lns []net.Listener
+	for i := 0; i < nfds; i++ {
+		fd := sdListenFdsStart + i
+		syscall.CloseOnExec(fd)
+
+		name := fmt.Sprintf("LISTEN_FD_%d", fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(file)
+		// FileListener dups the file descriptor
+		file.Close()
+		if err != nil {
+			return lns, fmt.Errorf("Could not use socket %s: %s", name, err)
+		}
+		lns = append(lns, ln)
+	}
+
+	return lns, nil
+}
+
+// vim: set nowrap tw=100 noet sw=8:
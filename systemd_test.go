@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// sdListenNotify creates a stand-in for the systemd notification socket and points NOTIFY_SOCKET
+// to it
+func sdListenNotify(t *testing.T) *net.UnixConn {
+	addr := &net.UnixAddr{Name: filepath.Join(t.TempDir(), "notify"), Net: "unixgram"}
+	conn, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", addr.Name)
+	return conn
+}
+
+// sdReadNotify returns the next notification received on conn, or "" after timeout
+func sdReadNotify(t *testing.T, conn *net.UnixConn, timeout time.Duration) string {
+	buf := make([]byte, 256)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := conn.Read(buf)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return ""
+		}
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	conn := sdListenNotify(t)
+
+	for _, state := range []string{"READY=1", "STOPPING=1"} {
+		if err := sdNotify(state); err != nil {
+			t.Fatalf("sdNotify(%q): %s", state, err)
+		}
+		if got := sdReadNotify(t, conn, time.Second); got != state {
+			t.Errorf("sdNotify(%q): received %q", state, got)
+		}
+	}
+}
+
+func TestSdNotifyNoSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("sdNotify without NOTIFY_SOCKET: %s", err)
+	}
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		usec, pid string
+		want      time.Duration
+	}{
+		{"", "", 0},
+		{"0", "", 0},
+		{"invalid", "", 0},
+		{"3000000", "", 3 * time.Second},
+		{"3000000", pid, 3 * time.Second},
+		{"3000000", "1", 0},
+	}
+	for _, test := range tests {
+		t.Setenv("WATCHDOG_USEC", test.usec)
+		t.Setenv("WATCHDOG_PID", test.pid)
+		if got := sdWatchdogInterval(); got != test.want {
+			t.Errorf("sdWatchdogInterval() with USEC=%q PID=%q = %s, want %s",
+				test.usec, test.pid, got, test.want)
+		}
+	}
+}
+
+// testWatchdogLoop runs an accept loop pinging the watchdog every period, and returns its listener
+func testWatchdogLoop(t *testing.T, period time.Duration) (net.Listener, chan struct{}) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		acceptLoop(ln, period)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		<-done
+	})
+	return ln, done
+}
+
+func TestSdWatchdog(t *testing.T) {
+	conn := sdListenNotify(t)
+	t.Setenv("WATCHDOG_USEC", "80000")
+	t.Setenv("WATCHDOG_PID", "")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if period := sdWatchdog(ln); period != 40*time.Millisecond {
+		t.Fatalf("sdWatchdog() = %s, want 40ms", period)
+	}
+	testWatchdogLoop(t, 40*time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		if got := sdReadNotify(t, conn, time.Second); got != "WATCHDOG=1" {
+			t.Fatalf("received %q, want WATCHDOG=1", got)
+		}
+	}
+
+	// A handler stuck with a lock of the serving path stops the pings
+	pubsubMtx.Lock()
+	sdReadNotify(t, conn, 50*time.Millisecond)
+	if got := sdReadNotify(t, conn, 100*time.Millisecond); got != "" {
+		pubsubMtx.Unlock()
+		t.Fatalf("received %q while the serving path is blocked", got)
+	}
+	pubsubMtx.Unlock()
+
+	if got := sdReadNotify(t, conn, time.Second); got != "WATCHDOG=1" {
+		t.Fatalf("received %q after unblocking, want WATCHDOG=1", got)
+	}
+}
+
+// The pings stop with the accept loop
+func TestSdWatchdogAcceptLoopStopped(t *testing.T) {
+	conn := sdListenNotify(t)
+	ln, done := testWatchdogLoop(t, 20*time.Millisecond)
+
+	if got := sdReadNotify(t, conn, time.Second); got != "WATCHDOG=1" {
+		t.Fatalf("received %q, want WATCHDOG=1", got)
+	}
+	ln.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("The accept loop did not return when its listener was closed")
+	}
+
+	sdReadNotify(t, conn, 20*time.Millisecond)
+	if got := sdReadNotify(t, conn, 100*time.Millisecond); got != "" {
+		t.Errorf("received %q after the accept loop stopped", got)
+	}
+}
+
+// The watchdog is disabled when systemd does not ask for it
+func TestSdWatchdogDisabled(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if period := sdWatchdog(ln); period != 0 {
+		t.Errorf("sdWatchdog() = %s, want 0", period)
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
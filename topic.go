@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+/*
+Event patterns of the subscriptions.
+
+Events are made of segments separated by dots. In a pattern:
+
+	+       matches exactly one segment, eg. "robot.+.position"
+	#       as the last segment, matches any number of segments, even none, eg. "robot.#"
+	*       matches any characters, dots included, eg. "log.*" or "*.position"
+	re:EXPR matches the events matching the regular expression EXPR, eg. "re:^robot\.(pal|pmi)\."
+
+'+' and '#' are wildcards only as whole segments, and cannot follow a segment with '*'. Other
+characters, '?' and '[' included, are literal.
+
+The patterns of the subscribers are indexed in a trie of their segments, so that a publish only
+visits the patterns that can match its event. The part of a pattern from its first segment with '*'
+is matched by a regexp, tried for each event reaching its node.
+
+The index does not help the regexp patterns, nor the patterns with '*' in their first segment, eg.
+"*.position", which are stored at the root: each publish tries all of them, and costs linear time in
+their number. Prefer "+" and "#" to '*' in the first segment.
+*/
+
+// Prefix of the regexp patterns
+const topicRegexpPrefix = "re:"
+
+// A compiled event pattern
+type topicPattern struct {
+	pattern string
+	// Regexp of the "re:" patterns
+	re *regexp.Regexp
+	// Segments before the first one with '*', each literal, "+" or a final "#"
+	segments []string
+	// Regexp matching the rest of the event from the first segment with '*'
+	tail *regexp.Regexp
+}
+
+// topicIsPattern returns whether event is a pattern rather than the name of an event
+func topicIsPattern(event string) bool {
+	if strings.HasPrefix(event, topicRegexpPrefix) || strings.Contains(event, "*") {
+		return true
+	}
+	for _, seg := range strings.Split(event, ".") {
+		if seg == "+" || seg == "#" {
+			return true
+		}
+	}
+	return false
+}
+
+// compileTopic compiles the pattern, or the name of an event which then only matches itself
+func compileTopic(pattern string) (*topicPattern, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("Empty event pattern")
+	}
+	p := &topicPattern{pattern: pattern}
+
+	if strings.HasPrefix(pattern, topicRegexpPrefix) {
+		re, err := regexp.Compile(pattern[len(topicRegexpPrefix):])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regexp in %s: %s", pattern, err)
+		}
+		p.re = re
+		return p, nil
+	}
+
+	segs := strings.Split(pattern, ".")
+	for i, seg := range segs {
+		if seg == "#" && i != len(segs)-1 {
+			return nil, fmt.Errorf("'#' is not the last segment of %s", pattern)
+		}
+		if !strings.Contains(seg, "*") {
+			p.segments = append(p.segments, seg)
+			continue
+		}
+
+		rest := segs[i:]
+		for _, seg := range rest {
+			if seg == "+" || seg == "#" {
+				return nil, fmt.Errorf("'%s' follows '*' in %s", seg, pattern)
+			}
+		}
+		expr := regexp.QuoteMeta(strings.Join(rest, "."))
+		expr = strings.Replace(expr, regexp.QuoteMeta("*"), ".*", -1)
+		p.tail = regexp.MustCompile("^" + expr + "$")
+		break
+	}
+	return p, nil
+}
+
+// match returns whether the event matches the pattern
+func (p *topicPattern) match(event string) bool {
+	if p.re != nil {
+		return p.re.MatchString(event)
+	}
+
+	segs := strings.Split(event, ".")
+	for i, seg := range p.segments {
+		if seg == "#" {
+			return true
+		}
+		if i >= len(segs) || (seg != "+" && seg != segs[i]) {
+			return false
+		}
+	}
+	n := len(p.segments)
+	if p.tail != nil {
+		return n < len(segs) && p.tail.MatchString(strings.Join(segs[n:], "."))
+	}
+	return n == len(segs)
+}
+
+// Node of the trie of the patterns, for the segments from the root to the node
+type topicNode struct {
+	// Children by segment, "+" for the single segment wildcard
+	children map[string]*topicNode
+	// Patterns ending at this node, ending with "#", and with a '*' tail after this node
+	patterns []*topicPattern
+	multi    []*topicPattern
+	tails    []*topicPattern
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{children: make(map[string]*topicNode)}
+}
+
+func (n *topicNode) empty() bool {
+	return len(n.children) == 0 && len(n.patterns) == 0 && len(n.multi) == 0 &&
+		len(n.tails) == 0
+}
+
+// Index of the patterns
+type topicIndex struct {
+	root    *topicNode
+	regexps map[string]*topicPattern
+}
+
+func newTopicIndex() *topicIndex {
+	return &topicIndex{root: newTopicNode(), regexps: make(map[string]*topicPattern)}
+}
+
+// list returns the list of the node where p is stored
+func (n *topicNode) list(p *topicPattern) *[]*topicPattern {
+	switch {
+	case p.tail != nil:
+		return &n.tails
+	case len(p.segments) > 0 && p.segments[len(p.segments)-1] == "#":
+		return &n.multi
+	default:
+		return &n.patterns
+	}
+}
+
+// path returns the segments of the nodes from the root to the node where p is stored
+func (p *topicPattern) path() []string {
+	if len(p.segments) > 0 && p.segments[len(p.segments)-1] == "#" {
+		return p.segments[:len(p.segments)-1]
+	}
+	return p.segments
+}
+
+func (idx *topicIndex) add(p *topicPattern) {
+	if p.re != nil {
+		idx.regexps[p.pattern] = p
+		return
+	}
+	node := idx.root
+	for _, seg := range p.path() {
+		child, ok := node.children[seg]
+		if !ok {
+			child = newTopicNode()
+			node.children[seg] = child
+		}
+		node = child
+	}
+	list := node.list(p)
+	*list = append(*list, p)
+}
+
+func (idx *topicIndex) remove(pattern string) {
+	if _, ok := idx.regexps[pattern]; ok {
+		delete(idx.regexps, pattern)
+		return
+	}
+	p, err := compileTopic(pattern)
+	if err != nil {
+		return
+	}
+
+	nodes := []*topicNode{idx.root}
+	for _, seg := range p.path() {
+		child, ok := nodes[len(nodes)-1].children[seg]
+		if !ok {
+			return
+		}
+		nodes = append(nodes, child)
+	}
+
+	list := nodes[len(nodes)-1].list(p)
+	for i, item := range *list {
+		if item.pattern == pattern {
+			*list = append((*list)[:i], (*list)[i+1:]...)
+			break
+		}
+	}
+
+	// Prune the nodes left empty
+	path := p.path()
+	for i := len(nodes) - 1; i > 0 && nodes[i].empty(); i-- {
+		delete(nodes[i-1].children, path[i-1])
+	}
+}
+
+// match returns the patterns matching event. The regexp patterns and the tails of the root are all
+// tried, see the cost above.
+func (idx *topicIndex) match(event string) []*topicPattern {
+	var matches []*topicPattern
+	segs := strings.Split(event, ".")
+
+	var walk func(node *topicNode, i int)
+	walk = func(node *topicNode, i int) {
+		matches = append(matches, node.multi...)
+		if i < len(segs) {
+			rest := strings.Join(segs[i:], ".")
+			for _, p := range node.tails {
+				if p.tail.MatchString(rest) {
+					matches = append(matches, p)
+				}
+			}
+		}
+		if i == len(segs) {
+			matches = append(matches, node.patterns...)
+			return
+		}
+		// An event with a "+" segment only goes once to the wildcard child
+		if child, ok := node.children[segs[i]]; ok && segs[i] != "+" {
+			walk(child, i+1)
+		}
+		if child, ok := node.children["+"]; ok {
+			walk(child, i+1)
+		}
+	}
+	walk(idx.root, 0)
+
+	for _, p := range idx.regexps {
+		if p.re.MatchString(event) {
+			matches = append(matches, p)
+		}
+	}
+	return matches
+}
+
+// vim: set nowrap tw=100 noet sw=8:
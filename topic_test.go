@@ -0,0 +1,167 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestTopicIsPattern(t *testing.T) {
+	tests := []struct {
+		event string
+		want  bool
+	}{
+		{"robot.position", false},
+		{"robot", false},
+		{"robot.[x]", false},
+		{"robot.pos?", false},
+		{"robot+.x", false},
+		{"robot.+", true},
+		{"+", true},
+		{"robot.#", true},
+		{"log.*", true},
+		{"*", true},
+		{"re:^robot", true},
+	}
+	for _, test := range tests {
+		if got := topicIsPattern(test.event); got != test.want {
+			t.Errorf("topicIsPattern(%q) = %t, want %t", test.event, got, test.want)
+		}
+	}
+}
+
+func TestCompileTopicErrors(t *testing.T) {
+	tests := []struct {
+		pattern string
+		wantErr string
+	}{
+		{"", "Empty"},
+		{"a.#.b", "'#' is not the last segment"},
+		{"#.a", "'#' is not the last segment"},
+		{"a.*.+", "'+' follows '*'"},
+		{"*.#", "'#' follows '*'"},
+		{"re:(", "Invalid regexp"},
+	}
+	for _, test := range tests {
+		_, err := compileTopic(test.pattern)
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("compileTopic(%q): error %v, want %q", test.pattern, err, test.wantErr)
+		}
+	}
+}
+
+// Events and the patterns matching them, used for the pattern and the index tests
+var topicTests = []struct {
+	pattern string
+	match   []string
+	noMatch []string
+}{
+	{"robot.position", []string{"robot.position"},
+		[]string{"robot", "robot.position.x", "robot.speed", "xrobot.position"}},
+	{"robot.+.position", []string{"robot.pal.position", "robot.+.position"},
+		[]string{"robot.position", "robot.pal.pmi.position", "robot.pal.speed"}},
+	{"+", []string{"robot", "+", ""}, []string{"robot.position"}},
+	{"+.+", []string{"a.b", "a."}, []string{"a", "a.b.c"}},
+	{"robot.#", []string{"robot", "robot.position", "robot.pal.position"},
+		[]string{"robots", "robotx.position", "pal.robot"}},
+	{"#", []string{"robot", "robot.position", "a.b.c.d"}, nil},
+	{"robot.+.#", []string{"robot.pal", "robot.pal.position"}, []string{"robot"}},
+	{"log.*", []string{"log.robot", "log.robot.position", "log."}, []string{"log", "robot.log"}},
+	{"*.position", []string{"robot.position", "a.b.position"},
+		[]string{"position", "robot.positions", "robot.position.x"}},
+	{"*", []string{"robot", "robot.position"}, nil},
+	{"robot.pos*", []string{"robot.position", "robot.pos", "robot.pos.x"},
+		[]string{"robot.speed", "robot"}},
+	{"robot.+.pos*x", []string{"robot.pal.posx", "robot.pal.pos.x"},
+		[]string{"robot.posx", "robot.pal.pos"}},
+	{"robot.[x]", []string{"robot.[x]"}, []string{"robot.x"}},
+	{"robot.pos?", []string{"robot.pos?"}, []string{"robot.posx"}},
+	{"re:^robot\\.(pal|pmi)\\.", []string{"robot.pal.position", "robot.pmi.x"},
+		[]string{"robot.position", "xrobot.pal.x"}},
+	{"re:speed$", []string{"robot.speed", "speed"}, []string{"robot.speeds"}},
+}
+
+func TestTopicPatternMatch(t *testing.T) {
+	for _, test := range topicTests {
+		p, err := compileTopic(test.pattern)
+		if err != nil {
+			t.Fatalf("compileTopic(%q): %s", test.pattern, err)
+		}
+		for _, event := range test.match {
+			if !p.match(event) {
+				t.Errorf("%q does not match %q", test.pattern, event)
+			}
+		}
+		for _, event := range test.noMatch {
+			if p.match(event) {
+				t.Errorf("%q matches %q", test.pattern, event)
+			}
+		}
+	}
+}
+
+// topicIndexMatches returns the sorted patterns of the index matching event
+func topicIndexMatches(idx *topicIndex, event string) []string {
+	var matches []string
+	for _, p := range idx.match(event) {
+		matches = append(matches, p.pattern)
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// The index returns exactly the patterns matching the events, each once
+func TestTopicIndex(t *testing.T) {
+	idx := newTopicIndex()
+	var patterns []*topicPattern
+	for _, test := range topicTests {
+		p, err := compileTopic(test.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx.add(p)
+		patterns = append(patterns, p)
+	}
+
+	check := func(when string) {
+		for _, test := range topicTests {
+			for _, event := range append(append([]string{}, test.match...), test.noMatch...) {
+				var want []string
+				for _, p := range patterns {
+					if p.match(event) {
+						want = append(want, p.pattern)
+					}
+				}
+				sort.Strings(want)
+				got := topicIndexMatches(idx, event)
+				if strings.Join(got, " ") != strings.Join(want, " ") {
+					t.Errorf("%s: index matches %q with %q, want %q", when, event, got, want)
+				}
+			}
+		}
+	}
+	check("all patterns")
+
+	// Remove every other pattern
+	var kept []*topicPattern
+	for i, p := range patterns {
+		if i%2 == 0 {
+			idx.remove(p.pattern)
+		} else {
+			kept = append(kept, p)
+		}
+	}
+	patterns = kept
+	check("half removed")
+
+	for _, p := range patterns {
+		idx.remove(p.pattern)
+	}
+	patterns = nil
+	check("all removed")
+	if !idx.root.empty() || len(idx.regexps) != 0 {
+		t.Errorf("index not empty after removing all the patterns")
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Tracing of the requests going through cellaserv.
+
+The trace context travels in the extTraceId and extSpanId extension fields of the requests and
+replies. For each forwarded request, cellaserv records a span covering the whole request, and two
+child spans: "queue", the time spent in cellaserv before forwarding, and "service", the time spent
+waiting for the reply of the service. The spans are exported in the OTLP/JSON format.
+*/
+
+var (
+	traceFileFlag = flag.String("trace-file", "",
+		"export request spans to FILE as OTLP/JSON lines")
+	traceEndpointFlag = flag.String("trace-endpoint", "",
+		"export request spans to the OTLP/HTTP collector at URL, eg. http://localhost:4318/v1/traces")
+
+	traceFile *os.File
+	// Spans waiting to be exported, nil if tracing is disabled or stopped
+	traceSpans chan *otlpSpan
+	traceMtx   sync.Mutex
+	traceDone  chan struct{}
+)
+
+const (
+	// Maximum number of spans exported at once
+	traceBatchSize = 256
+	// Maximum time a span waits before being exported
+	traceBatchDelay = time.Second
+)
+
+// OTLP/JSON structures, see opentelemetry-proto/opentelemetry/proto/trace/v1/trace.proto
+const (
+	otlpSpanKindInternal = 1
+	otlpSpanKindServer   = 2
+	otlpSpanKindClient   = 3
+
+	otlpStatusOk    = 1
+	otlpStatusError = 2
+)
+
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           string         `json:"traceId"`
+	SpanId            string         `json:"spanId"`
+	ParentSpanId      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope   `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTracesData struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpString(key, value string) otlpKeyValue {
+	return otlpKeyValue{key, otlpAnyValue{StringValue: &value}}
+}
+
+func otlpInt(key string, value uint64) otlpKeyValue {
+	s := strconv.FormatUint(value, 10)
+	return otlpKeyValue{key, otlpAnyValue{IntValue: &s}}
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// requestTrace is the trace context of a request forwarded by cellaserv
+type requestTrace struct {
+	traceId []byte
+	// Span of the client that sent the request, if given
+	parentSpanId []byte
+	// Span covering the whole request
+	spanId []byte
+	// Span of the time at the service, sent to the service as its parent span
+	serviceSpanId []byte
+
+	received  time.Time
+	forwarded time.Time
+
+	name       string
+	attributes []otlpKeyValue
+
+	// Set to 1 once the spans are exported, a request is finished only once
+	finished int32
+}
+
+func tracingEnabled() bool {
+	return *traceFileFlag != "" || *traceEndpointFlag != ""
+}
+
+func traceNewId(size int) []byte {
+	id := make([]byte, size)
+	rand.Read(id)
+	return id
+}
+
+/*
+traceRequest starts the trace of a request received at time received.
+
+It returns the trace and the message to forward to the service, carrying the trace context.
+*/
+func traceRequest(conn net.Conn, srvc *Service, req *cellaserv.Request, msgRaw []byte,
+	received time.Time) (*requestTrace, []byte) {
+	trace := &requestTrace{
+		spanId:        traceNewId(8),
+		serviceSpanId: traceNewId(8),
+		received:      received,
+		name:          srvc.Name + "." + *req.Method,
+		attributes: []otlpKeyValue{
+			otlpString("cellaserv.service", srvc.Name),
+			otlpString("cellaserv.identification", srvc.Identification),
+			otlpString("cellaserv.method", *req.Method),
+			otlpString("cellaserv.sender", connDescribe(conn)),
+			otlpInt("cellaserv.request_id", *req.Id),
+		},
+	}
+
+	msg := &cellaserv.Message{}
+	if err := proto.Unmarshal(msgRaw, msg); err != nil {
+		log.Error("[Trace] Could not unmarshal request: %s", err)
+		trace.traceId = traceNewId(16)
+		return trace, msgRaw
+	}
+	exts, _, err := extSplit(msg.Content)
+	if err != nil {
+		log.Error("[Trace] Could not read request fields: %s", err)
+		trace.traceId = traceNewId(16)
+		return trace, msgRaw
+	}
+	// The other fields, extensions included, are forwarded as they are
+	content, _ := extRemove(msg.Content, extTraceId, extSpanId)
+
+	// Propagate the trace context of the sender
+	if traceId, ok := exts[extTraceId]; ok && len(traceId) == 16 {
+		trace.traceId = traceId
+		if spanId, ok := exts[extSpanId]; ok && len(spanId) == 8 {
+			trace.parentSpanId = spanId
+		}
+	} else {
+		trace.traceId = traceNewId(16)
+	}
+
+	content = extAppendBytes(content, extTraceId, trace.traceId)
+	content = extAppendBytes(content, extSpanId, trace.serviceSpanId)
+	tracedMsg, err := messageWithContent(cellaserv.Message_Request, content)
+	if err != nil {
+		log.Error("[Trace] Could not marshal request: %s", err)
+		return trace, msgRaw
+	}
+	return trace, tracedMsg
+}
+
+// traceReply ends the trace of a request and returns the reply to forward, carrying the context
+func traceReply(trace *requestTrace, rep *cellaserv.Reply, msgRaw []byte) []byte {
+	status := otlpStatus{Code: otlpStatusOk}
+	if rep.Error != nil {
+		status = otlpStatus{otlpStatusError, rep.Error.GetType().String()}
+	}
+	traceFinish(trace, time.Now(), status)
+
+	msg := &cellaserv.Message{}
+	if err := proto.Unmarshal(msgRaw, msg); err != nil {
+		log.Error("[Trace] Could not unmarshal reply: %s", err)
+		return msgRaw
+	}
+	content, err := extRemove(msg.Content, extTraceId, extSpanId)
+	if err != nil {
+		log.Error("[Trace] Could not read reply fields: %s", err)
+		return msgRaw
+	}
+
+	content = extAppendBytes(content, extTraceId, trace.traceId)
+	content = extAppendBytes(content, extSpanId, trace.spanId)
+	tracedMsg, err := messageWithContent(cellaserv.Message_Reply, content)
+	if err != nil {
+		log.Error("[Trace] Could not marshal reply: %s", err)
+		return msgRaw
+	}
+	return tracedMsg
+}
+
+// traceFail ends the trace of a request that did not get a reply from the service
+func traceFail(trace *requestTrace, what string) {
+	traceFinish(trace, time.Now(), otlpStatus{otlpStatusError, what})
+}
+
+// traceFinish exports the spans of a request that ended at time end, it does nothing if the request
+// was already finished
+func traceFinish(trace *requestTrace, end time.Time, status otlpStatus) {
+	if !atomic.CompareAndSwapInt32(&trace.finished, 0, 1) {
+		log.Debug("[Trace] Request %s already finished", trace.name)
+		return
+	}
+
+	traceId := hex.EncodeToString(trace.traceId)
+	spanId := hex.EncodeToString(trace.spanId)
+
+	requestSpan := &otlpSpan{
+		TraceId:           traceId,
+		SpanId:            spanId,
+		Name:              trace.name,
+		Kind:              otlpSpanKindServer,
+		StartTimeUnixNano: otlpTime(trace.received),
+		EndTimeUnixNano:   otlpTime(end),
+		Attributes:        trace.attributes,
+		Status:            status,
+	}
+	if trace.parentSpanId != nil {
+		requestSpan.ParentSpanId = hex.EncodeToString(trace.parentSpanId)
+	}
+
+	queueSpan := &otlpSpan{
+		TraceId:           traceId,
+		SpanId:            hex.EncodeToString(traceNewId(8)),
+		ParentSpanId:      spanId,
+		Name:              "queue",
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: otlpTime(trace.received),
+		EndTimeUnixNano:   otlpTime(trace.forwarded),
+		Status:            otlpStatus{Code: otlpStatusOk},
+	}
+
+	serviceSpan := &otlpSpan{
+		TraceId:           traceId,
+		SpanId:            hex.EncodeToString(trace.serviceSpanId),
+		ParentSpanId:      spanId,
+		Name:              "service",
+		Kind:              otlpSpanKindClient,
+		StartTimeUnixNano: otlpTime(trace.forwarded),
+		EndTimeUnixNano:   otlpTime(end),
+		Status:            status,
+	}
+
+	traceMtx.Lock()
+	defer traceMtx.Unlock()
+	if traceSpans == nil {
+		return
+	}
+	for _, span := range []*otlpSpan{requestSpan, queueSpan, serviceSpan} {
+		select {
+		case traceSpans <- span:
+		default:
+			log.Warning("[Trace] Export queue is full, dropping span")
+		}
+	}
+}
+
+func traceExportBatch(spans []*otlpSpan) {
+	data, err := json.Marshal(otlpTracesData{[]otlpResourceSpans{{
+		Resource: otlpResource{[]otlpKeyValue{otlpString("service.name", "cellaserv")}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{"cellaserv", csVersion},
+			Spans: spans,
+		}},
+	}}})
+	if err != nil {
+		log.Error("[Trace] Could not marshal spans: %s", err)
+		return
+	}
+
+	if traceFile != nil {
+		if _, err := traceFile.Write(append(data, '\n')); err != nil {
+			log.Error("[Trace] Could not write spans: %s", err)
+		}
+	}
+
+	if *traceEndpointFlag != "" {
+		client := http.Client{Timeout: 2 * time.Second}
+		resp, err := client.Post(*traceEndpointFlag, "application/json", bytes.NewReader(data))
+		if err != nil {
+			log.Error("[Trace] Could not export spans: %s", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			log.Error("[Trace] Collector refused spans: %s", resp.Status)
+		}
+	}
+}
+
+// traceExport exports the spans by batches, until traceSpans is closed
+func traceExport(spans chan *otlpSpan) {
+	ticker := time.NewTicker(traceBatchDelay)
+	defer ticker.Stop()
+
+	var batch []*otlpSpan
+	for {
+		select {
+		case span, ok := <-spans:
+			if !ok {
+				if len(batch) > 0 {
+					traceExportBatch(batch)
+				}
+				close(traceDone)
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) >= traceBatchSize {
+				traceExportBatch(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				traceExportBatch(batch)
+				batch = nil
+			}
+		}
+	}
+}
+
+// traceSetup opens the trace file and starts the exporter
+func traceSetup() error {
+	if !tracingEnabled() {
+		return nil
+	}
+
+	if *traceFileFlag != "" {
+		file, err := os.OpenFile(*traceFileFlag, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+		if err != nil {
+			return fmt.Errorf("Could not open trace file: %s", err)
+		}
+		traceFile = file
+	}
+
+	traceSpans = make(chan *otlpSpan, 4*traceBatchSize)
+	traceDone = make(chan struct{})
+	go traceExport(traceSpans)
+
+	return nil
+}
+
+// traceClose exports the remaining spans and closes the trace file
+func traceClose() {
+	traceMtx.Lock()
+	spans := traceSpans
+	traceSpans = nil
+	traceMtx.Unlock()
+
+	if spans == nil {
+		return
+	}
+	close(spans)
+
+	select {
+	case <-traceDone:
+	case <-time.After(*shutdownTimeout):
+		log.Warning("[Trace] Timeout while exporting the last spans")
+	}
+
+	if traceFile != nil {
+		traceFile.Close()
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bitbucket.org/evolutek/cellaserv2-protobuf"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/golang/protobuf/proto"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Extension field unknown to cellaserv, forwarded as is
+const testExtField = 1500
+
+// testTracedMessage returns the message of type msgType holding m, followed by the extension
+// fields exts, in order
+func testTracedMessage(t *testing.T, msgType cellaserv.Message_MessageType, m proto.Message,
+	exts ...[]byte) []byte {
+	content, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range exts {
+		content = append(content, ext...)
+	}
+	msgBytes, err := messageWithContent(msgType, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msgBytes
+}
+
+// testMessageExts returns the message content without its extension fields, and the extensions
+func testMessageExts(t *testing.T, msgBytes []byte) ([]byte, map[int][]byte) {
+	msg := &cellaserv.Message{}
+	if err := proto.Unmarshal(msgBytes, msg); err != nil {
+		t.Fatal(err)
+	}
+	exts, content, err := extSplit(msg.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content, exts
+}
+
+func TestTraceRequestContext(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	srvc := newService(conn, "robot", "pal")
+
+	traceId := bytes.Repeat([]byte{0xab}, 16)
+	spanId := bytes.Repeat([]byte{0xcd}, 8)
+	tests := []struct {
+		name       string
+		exts       [][]byte
+		wantTrace  []byte
+		wantParent []byte
+	}{
+		{"no context", nil, nil, nil},
+		{"trace and span", [][]byte{
+			extAppendBytes(nil, extTraceId, traceId),
+			extAppendBytes(nil, extSpanId, spanId)}, traceId, spanId},
+		{"span first", [][]byte{
+			extAppendBytes(nil, extSpanId, spanId),
+			extAppendBytes(nil, extTraceId, traceId)}, traceId, spanId},
+		{"trace only", [][]byte{extAppendBytes(nil, extTraceId, traceId)}, traceId, nil},
+		{"span only", [][]byte{extAppendBytes(nil, extSpanId, spanId)}, nil, nil},
+		{"short trace", [][]byte{
+			extAppendBytes(nil, extTraceId, traceId[:8]),
+			extAppendBytes(nil, extSpanId, spanId)}, nil, nil},
+		{"short span", [][]byte{
+			extAppendBytes(nil, extTraceId, traceId),
+			extAppendBytes(nil, extSpanId, spanId[:4])}, traceId, nil},
+	}
+	for _, test := range tests {
+		service, method, id := "robot", "move", uint64(42)
+		ident := "pal"
+		req := &cellaserv.Request{ServiceName: &service, ServiceIdentification: &ident,
+			Method: &method, Id: &id, Data: []byte(`{"x": 1}`)}
+		exts := append(test.exts, extAppendBytes(nil, testExtField, []byte("kept")))
+		msgRaw := testTracedMessage(t, cellaserv.Message_Request, req, exts...)
+
+		trace, forwarded := traceRequest(conn, srvc, req, msgRaw, time.Now())
+
+		if len(trace.traceId) != 16 || len(trace.spanId) != 8 || len(trace.serviceSpanId) != 8 {
+			t.Fatalf("%s: IDs of %d, %d and %d bytes", test.name,
+				len(trace.traceId), len(trace.spanId), len(trace.serviceSpanId))
+		}
+		if test.wantTrace != nil && !bytes.Equal(trace.traceId, test.wantTrace) {
+			t.Errorf("%s: trace %x, want the trace of the sender", test.name, trace.traceId)
+		}
+		if test.wantTrace == nil && bytes.Equal(trace.traceId, traceId) {
+			t.Errorf("%s: trace of the sender reused", test.name)
+		}
+		if !bytes.Equal(trace.parentSpanId, test.wantParent) {
+			t.Errorf("%s: parent span %x, want %x", test.name, trace.parentSpanId,
+				test.wantParent)
+		}
+
+		// The service receives the trace and the span it works for, and the original fields
+		content, fwdExts := testMessageExts(t, forwarded)
+		if !bytes.Equal(fwdExts[extTraceId], trace.traceId) ||
+			!bytes.Equal(fwdExts[extSpanId], trace.serviceSpanId) {
+			t.Errorf("%s: forwarded trace %x span %x, want %x %x", test.name,
+				fwdExts[extTraceId], fwdExts[extSpanId], trace.traceId, trace.serviceSpanId)
+		}
+		if string(fwdExts[testExtField]) != "kept" {
+			t.Errorf("%s: extension field %d lost", test.name, testExtField)
+		}
+		fwdReq := &cellaserv.Request{}
+		if err := proto.Unmarshal(content, fwdReq); err != nil {
+			t.Fatal(err)
+		}
+		if fwdReq.GetServiceName() != "robot" || fwdReq.GetServiceIdentification() != "pal" ||
+			fwdReq.GetMethod() != "move" || fwdReq.GetId() != 42 ||
+			string(fwdReq.Data) != `{"x": 1}` {
+			t.Errorf("%s: forwarded %v", test.name, fwdReq)
+		}
+	}
+}
+
+func TestTraceReply(t *testing.T) {
+	saved := traceSpans
+	traceSpans = make(chan *otlpSpan, 10)
+	defer func() { traceSpans = saved }()
+
+	trace := &requestTrace{traceId: traceNewId(16), spanId: traceNewId(8),
+		serviceSpanId: traceNewId(8), received: time.Now(), forwarded: time.Now(),
+		name: "robot.move"}
+
+	// The service replies with the context it received, and its own fields
+	id := uint64(42)
+	rep := &cellaserv.Reply{Id: &id, Data: []byte(`"done"`)}
+	msgRaw := testTracedMessage(t, cellaserv.Message_Reply, rep,
+		extAppendBytes(nil, extTraceId, trace.traceId),
+		extAppendBytes(nil, extSpanId, trace.serviceSpanId),
+		extAppendVarint(nil, testExtField, 7))
+
+	forwarded := traceReply(trace, rep, msgRaw)
+
+	// The sender receives the span of the whole request
+	content, exts := testMessageExts(t, forwarded)
+	if !bytes.Equal(exts[extTraceId], trace.traceId) || !bytes.Equal(exts[extSpanId], trace.spanId) {
+		t.Errorf("Forwarded trace %x span %x, want %x %x", exts[extTraceId], exts[extSpanId],
+			trace.traceId, trace.spanId)
+	}
+	if !bytes.Equal(exts[testExtField], []byte{7}) {
+		t.Errorf("Extension field %d lost", testExtField)
+	}
+	fwdRep := &cellaserv.Reply{}
+	if err := proto.Unmarshal(content, fwdRep); err != nil {
+		t.Fatal(err)
+	}
+	if fwdRep.GetId() != 42 || string(fwdRep.Data) != `"done"` || fwdRep.Error != nil {
+		t.Errorf("Forwarded %v", fwdRep)
+	}
+	if n := len(traceSpans); n != 3 {
+		t.Errorf("Exported %d spans, want 3", n)
+	}
+}
+
+// The request, queue and service spans share the trace, and the queue and service spans are
+// children of the request span, which is a child of the span of the sender
+func TestTraceSpans(t *testing.T) {
+	saved := traceSpans
+	traceSpans = make(chan *otlpSpan, 10)
+	defer func() { traceSpans = saved }()
+
+	received := time.Unix(1000, 0)
+	forwarded := received.Add(time.Millisecond)
+	end := received.Add(5 * time.Millisecond)
+	trace := &requestTrace{traceId: traceNewId(16), parentSpanId: traceNewId(8),
+		spanId: traceNewId(8), serviceSpanId: traceNewId(8), received: received,
+		forwarded: forwarded, name: "robot.move",
+		attributes: []otlpKeyValue{otlpString("cellaserv.service", "robot")}}
+	traceFinish(trace, end, otlpStatus{otlpStatusError, "Timeout"})
+
+	spans := make(map[string]*otlpSpan)
+	for len(traceSpans) > 0 {
+		span := <-traceSpans
+		spans[span.Name] = span
+	}
+	request, queue, service := spans["robot.move"], spans["queue"], spans["service"]
+	if request == nil || queue == nil || service == nil || len(spans) != 3 {
+		t.Fatalf("Exported spans %v", spans)
+	}
+
+	traceId := hex.EncodeToString(trace.traceId)
+	requestId := hex.EncodeToString(trace.spanId)
+	tests := []struct {
+		span           *otlpSpan
+		spanId, parent string
+		kind           int
+		start, end     time.Time
+		status         int
+	}{
+		{request, requestId, hex.EncodeToString(trace.parentSpanId), otlpSpanKindServer,
+			received, end, otlpStatusError},
+		{queue, queue.SpanId, requestId, otlpSpanKindInternal, received, forwarded, otlpStatusOk},
+		{service, hex.EncodeToString(trace.serviceSpanId), requestId, otlpSpanKindClient,
+			forwarded, end, otlpStatusError},
+	}
+	for _, test := range tests {
+		span := test.span
+		if span.TraceId != traceId {
+			t.Errorf("%s: trace %s, want %s", span.Name, span.TraceId, traceId)
+		}
+		if span.SpanId != test.spanId || len(span.SpanId) != 16 {
+			t.Errorf("%s: span %s, want %s", span.Name, span.SpanId, test.spanId)
+		}
+		if span.ParentSpanId != test.parent {
+			t.Errorf("%s: parent %s, want %s", span.Name, span.ParentSpanId, test.parent)
+		}
+		if span.Kind != test.kind || span.Status.Code != test.status {
+			t.Errorf("%s: kind %d status %d, want %d %d", span.Name, span.Kind,
+				span.Status.Code, test.kind, test.status)
+		}
+		if span.StartTimeUnixNano != otlpTime(test.start) ||
+			span.EndTimeUnixNano != otlpTime(test.end) {
+			t.Errorf("%s: from %s to %s, want %s to %s", span.Name, span.StartTimeUnixNano,
+				span.EndTimeUnixNano, otlpTime(test.start), otlpTime(test.end))
+		}
+	}
+	if queue.SpanId == requestId || queue.SpanId == service.SpanId {
+		t.Errorf("The queue span reuses the ID %s", queue.SpanId)
+	}
+	if request.Status.Message != "Timeout" || len(request.Attributes) != 1 {
+		t.Errorf("Request span status %+v attributes %+v", request.Status, request.Attributes)
+	}
+}
+
+// A request without the context of the sender starts a trace
+func TestTraceSpansRoot(t *testing.T) {
+	saved := traceSpans
+	traceSpans = make(chan *otlpSpan, 10)
+	defer func() { traceSpans = saved }()
+
+	trace := &requestTrace{traceId: traceNewId(16), spanId: traceNewId(8),
+		serviceSpanId: traceNewId(8), received: time.Now(), forwarded: time.Now(),
+		name: "robot.move"}
+	traceFinish(trace, time.Now(), otlpStatus{Code: otlpStatusOk})
+
+	for len(traceSpans) > 0 {
+		span := <-traceSpans
+		if span.Name == "robot.move" && span.ParentSpanId != "" {
+			t.Errorf("Request span has the parent %s", span.ParentSpanId)
+		}
+	}
+}
+
+func TestTraceFinishOnce(t *testing.T) {
+	saved := traceSpans
+	traceSpans = make(chan *otlpSpan, 10)
+	defer func() { traceSpans = saved }()
+
+	trace := &requestTrace{traceId: traceNewId(16), spanId: traceNewId(8),
+		serviceSpanId: traceNewId(8), received: time.Now(), forwarded: time.Now(),
+		name: "svc.method"}
+
+	// A late reply after a timeout must not export the spans a second time
+	traceFail(trace, "Timeout")
+	traceFinish(trace, time.Now(), otlpStatus{Code: otlpStatusOk})
+
+	if n := len(traceSpans); n != 3 {
+		t.Fatalf("exported %d spans, want 3", n)
+	}
+	for i := 0; i < 3; i++ {
+		span := <-traceSpans
+		if span.Status.Code == otlpStatusOk && span.Name != "queue" {
+			t.Errorf("span %s has the status of the second finish", span.Name)
+		}
+	}
+}
+
+// The file exporter writes a line of OTLP/JSON per batch
+func TestTraceExportFile(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "spans.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	saved := traceFile
+	traceFile = file
+	defer func() { traceFile = saved }()
+
+	span := &otlpSpan{
+		TraceId:           "0123456789abcdef0123456789abcdef",
+		SpanId:            "0123456789abcdef",
+		Name:              "robot.move",
+		Kind:              otlpSpanKindServer,
+		StartTimeUnixNano: "1000",
+		EndTimeUnixNano:   "2000",
+		Attributes: []otlpKeyValue{otlpString("cellaserv.service", "robot"),
+			otlpInt("cellaserv.request_id", 42)},
+		Status: otlpStatus{Code: otlpStatusOk},
+	}
+	traceExportBatch([]*otlpSpan{span})
+	traceExportBatch([]*otlpSpan{span, span})
+
+	data, err := os.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("Wrote %d lines, want 2:\n%s", len(lines), data)
+	}
+
+	want := `{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":` +
+		`{"stringValue":"cellaserv"}}]},"scopeSpans":[{"scope":{"name":"cellaserv","version":"` +
+		csVersion + `"},"spans":[{"traceId":"0123456789abcdef0123456789abcdef",` +
+		`"spanId":"0123456789abcdef","name":"robot.move","kind":2,` +
+		`"startTimeUnixNano":"1000","endTimeUnixNano":"2000","attributes":[` +
+		`{"key":"cellaserv.service","value":{"stringValue":"robot"}},` +
+		`{"key":"cellaserv.request_id","value":{"intValue":"42"}}],"status":{"code":1}}]}]}]}`
+	if string(lines[0]) != want {
+		t.Errorf("Wrote:\n%s\nwant:\n%s", lines[0], want)
+	}
+
+	var batch otlpTracesData
+	if err := json.Unmarshal(lines[1], &batch); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(batch.ResourceSpans[0].ScopeSpans[0].Spans); n != 2 {
+		t.Errorf("Second batch has %d spans, want 2", n)
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8:
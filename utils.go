@@ -6,6 +6,8 @@ import (
 	"github.com/golang/protobuf/proto"
 	"encoding/binary"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net"
 	"strings"
 )
@@ -40,9 +42,22 @@ func connDescribe(conn net.Conn) string {
 	return strings.Join(servcs, ", ")
 }
 
+// jsonOrBytes returns data as JSON if it is valid JSON, as bytes otherwise
+func jsonOrBytes(data []byte) (json.RawMessage, []byte) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if json.Valid(data) {
+		return json.RawMessage(data), nil
+	}
+	return nil, data
+}
+
 // Send utils
 
 func sendReply(conn net.Conn, req *cellaserv.Request, data []byte) {
+	statsReplyReceived(conn)
+
 	rep := &cellaserv.Reply{Id: req.Id, Data: data}
 	repBytes, err := proto.Marshal(rep)
 	if err != nil {
@@ -56,7 +71,20 @@ func sendReply(conn net.Conn, req *cellaserv.Request, data []byte) {
 }
 
 func sendReplyError(conn net.Conn, req *cellaserv.Request, err_t cellaserv.Reply_Error_Type) {
-	err := &cellaserv.Reply_Error{Type: &err_t}
+	sendReplyErrorWhat(conn, req, err_t, nil)
+}
+
+// sendReplyCustomError replies with a custom error described by what
+func sendReplyCustomError(conn net.Conn, req *cellaserv.Request, what string) {
+	sendReplyErrorWhat(conn, req, cellaserv.Reply_Error_Custom, &what)
+}
+
+func sendReplyErrorWhat(conn net.Conn, req *cellaserv.Request, err_t cellaserv.Reply_Error_Type,
+	what *string) {
+	metricsRequestError(req, err_t)
+	statsReplyReceived(conn)
+
+	err := &cellaserv.Reply_Error{Type: &err_t, What: what}
 
 	reply := &cellaserv.Reply{Error: err, Id: req.Id}
 	replyBytes, _ := proto.Marshal(reply)
@@ -76,12 +104,45 @@ func sendMessage(conn net.Conn, msg *cellaserv.Message) {
 	if err != nil {
 		log.Error("[Message] Could not marshal outgoing message")
 	}
-	dumpOutgoing(conn, msgBytes)
-
 	sendRawMessage(conn, msgBytes)
 }
 
+// sendRawMessage sends the message to conn after the messages already queued, see send_queue.go
 func sendRawMessage(conn net.Conn, msg []byte) {
+	queueMessage(conn, msg, nil)
+	flushMessages(conn)
+}
+
+// Messages bigger than this are refused
+const maxMessageSize = 8 * 1024 * 1024
+
+// readRawMessage reads a message prefixed by its length, it returns io.EOF if the stream ended
+// before the message
+func readRawMessage(r io.Reader) ([]byte, error) {
+	// Read message length as uint32
+	var msgLen uint32
+	err := binary.Read(r, binary.BigEndian, &msgLen)
+	if err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Could not read message length: %s", err)
+	}
+
+	if msgLen > maxMessageSize {
+		return nil, fmt.Errorf("Request too big: %d", msgLen)
+	}
+
+	msgBytes := make([]byte, msgLen)
+	_, err = io.ReadFull(r, msgBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read message: %s", err)
+	}
+	return msgBytes, nil
+}
+
+// writeRawMessage writes a message prefixed by its length
+func writeRawMessage(w io.Writer, msg []byte) error {
 	// Create temporary buffer
 	var buf bytes.Buffer
 	// Write the size of the message...
@@ -89,8 +150,8 @@ func sendRawMessage(conn net.Conn, msg []byte) {
 	// ...concatenate with message content
 	buf.Write(msg)
 	// Send the whole message at once (avoid race condition)
-	// Any IO error will be detected by the main loop trying to read from the conn
-	conn.Write(buf.Bytes())
+	_, err := w.Write(buf.Bytes())
+	return err
 }
 
 // vim: set nowrap tw=100 noet sw=8:
@@ -0,0 +1,404 @@
+-- Wireshark dissector of the cellaserv dumps
+--
+-- Install it in the Wireshark plugin directory, eg. ~/.local/lib/wireshark/plugins/, or load it
+-- with: wireshark -X lua_script:cellaserv.lua dump.pcap
+--
+-- Dumps in the pcap format hold a LogMessage wrapping the Message under the USER1 link type, dumps
+-- in the pcapng format hold the Message under the USER0 link type, see dump_pcap.go and
+-- dump_pcapng.go. The field numbers follow cellaserv.proto and proto_ext.go.
+--
+-- Pcap dumps written by older versions use the link type 4200, which Wireshark cannot open, convert
+-- them with: cellaserv2 dump relink dump.pcap
+
+local cellaserv = Proto("cellaserv", "cellaserv")
+local cellaserv_log = Proto("cellaserv_log", "cellaserv LogMessage")
+
+local message_types = {
+	[0] = "Register",
+	[1] = "Request",
+	[2] = "Reply",
+	[3] = "Subscribe",
+	[4] = "Publish",
+}
+
+local error_types = {
+	[0] = "Custom",
+	[1] = "NoSuchService",
+	[2] = "InvalidIdentification",
+	[3] = "NoSuchMethod",
+	[4] = "BadArguments",
+	[5] = "Timeout",
+}
+
+local f = {
+	log_sender = ProtoField.string("cellaserv.log.sender", "Sender"),
+	log_destination = ProtoField.string("cellaserv.log.destination", "Destination"),
+
+	type = ProtoField.uint32("cellaserv.type", "Type", base.DEC, message_types),
+
+	register_name = ProtoField.string("cellaserv.register.name", "Name"),
+	register_ident = ProtoField.string("cellaserv.register.identification", "Identification"),
+
+	request_service = ProtoField.string("cellaserv.request.service", "Service"),
+	request_ident = ProtoField.string("cellaserv.request.identification", "Identification"),
+	request_method = ProtoField.string("cellaserv.request.method", "Method"),
+	request_data = ProtoField.bytes("cellaserv.request.data", "Data"),
+	request_id = ProtoField.uint64("cellaserv.request.id", "Id"),
+
+	reply_id = ProtoField.uint64("cellaserv.reply.id", "Id"),
+	reply_data = ProtoField.bytes("cellaserv.reply.data", "Data"),
+	reply_error_type = ProtoField.uint32("cellaserv.reply.error.type", "Error type", base.DEC,
+		error_types),
+	reply_error_what = ProtoField.string("cellaserv.reply.error.what", "Error"),
+
+	subscribe_event = ProtoField.string("cellaserv.subscribe.event", "Event"),
+
+	publish_event = ProtoField.string("cellaserv.publish.event", "Event"),
+	publish_data = ProtoField.bytes("cellaserv.publish.data", "Data"),
+
+	data_text = ProtoField.string("cellaserv.data.text", "Data (text)"),
+
+	trace_id = ProtoField.bytes("cellaserv.trace_id", "Trace ID"),
+	span_id = ProtoField.bytes("cellaserv.span_id", "Span ID"),
+	retain = ProtoField.uint64("cellaserv.publish.retain", "Retain"),
+	seq = ProtoField.uint64("cellaserv.publish.seq", "Sequence number"),
+	timestamp = ProtoField.uint64("cellaserv.publish.timestamp", "Received (ns since epoch)"),
+	publisher = ProtoField.string("cellaserv.publish.publisher", "Publisher"),
+	stamp = ProtoField.uint64("cellaserv.subscribe.stamp", "Stamp"),
+	filter = ProtoField.string("cellaserv.subscribe.filter", "Filter"),
+
+	unknown = ProtoField.bytes("cellaserv.unknown", "Unknown field"),
+}
+
+cellaserv.fields = f
+
+local ef_malformed = ProtoExpert.new("cellaserv.malformed", "Malformed protobuf message",
+	expert.group.MALFORMED, expert.severity.ERROR)
+cellaserv.experts = { ef_malformed }
+
+-- Minimal protobuf decoder
+
+-- read_varint returns the varint at offset in tvb and its size, or nil
+local function read_varint(tvb, offset)
+	local value = UInt64(0)
+	local shift = 0
+	local pos = offset
+	while pos < tvb:len() and shift < 64 do
+		local b = tvb(pos, 1):uint()
+		value = value:bor(UInt64(bit.band(b, 0x7f)):lshift(shift))
+		pos = pos + 1
+		if b < 0x80 then
+			return value, pos - offset
+		end
+		shift = shift + 7
+	end
+	return nil, 0
+end
+
+-- read_fields returns the fields of the protobuf message in tvb, in order and indexed by number,
+-- or nil
+--
+-- Each field has the range of the whole field, and either the value of a varint or the range of
+-- the value of a length-delimited field, nil if it is empty.
+local function read_fields(tvb)
+	local fields = {}
+	local by_num = {}
+	local pos = 0
+	while pos < tvb:len() do
+		local key, n = read_varint(tvb, pos)
+		if key == nil then
+			return nil
+		end
+		local field = { num = key:rshift(3):tonumber(), wire = key:band(7):tonumber() }
+		local start = pos
+		pos = pos + n
+
+		if field.wire == 0 then
+			field.value, n = read_varint(tvb, pos)
+			if field.value == nil then
+				return nil
+			end
+			pos = pos + n
+		elseif field.wire == 2 then
+			local length
+			length, n = read_varint(tvb, pos)
+			if length == nil then
+				return nil
+			end
+			pos = pos + n
+			length = length:tonumber()
+			if pos + length > tvb:len() then
+				return nil
+			end
+			if length > 0 then
+				field.value_range = tvb(pos, length)
+			end
+			pos = pos + length
+		elseif field.wire == 1 then
+			pos = pos + 8
+		elseif field.wire == 5 then
+			pos = pos + 4
+		else
+			return nil
+		end
+		if pos > tvb:len() then
+			return nil
+		end
+
+		field.range = tvb(start, pos - start)
+		fields[#fields + 1] = field
+		by_num[field.num] = by_num[field.num] or field
+	end
+	return fields, by_num
+end
+
+local function field_string(field)
+	if field == nil or field.value_range == nil then
+		return ""
+	end
+	return field.value_range:string()
+end
+
+-- is_text returns true if the range only holds printable characters
+local function is_text(range)
+	local s = range:string()
+	if #s ~= range:len() then
+		return false
+	end
+	return s:match("^[%g%s]*$") ~= nil
+end
+
+-- add_fields adds the fields of a message to tree, known maps field numbers to their ProtoField
+-- and the kind of their value
+local function add_fields(fields, tree, known)
+	for _, field in ipairs(fields) do
+		local desc = known[field.num]
+		if desc == nil then
+			tree:add(f.unknown, field.range):append_text(" (" .. field.num .. ")")
+		elseif desc.kind == "string" then
+			tree:add(desc.field, field.range, field_string(field))
+		elseif desc.kind == "uint" then
+			if field.value ~= nil then
+				tree:add(desc.field, field.range, field.value)
+			end
+		elseif desc.kind == "uint32" then
+			if field.value ~= nil then
+				tree:add(desc.field, field.range, field.value:tonumber())
+			end
+		elseif desc.kind == "bytes" then
+			if field.value_range ~= nil then
+				tree:add(desc.field, field.value_range)
+				if is_text(field.value_range) then
+					tree:add(f.data_text, field.value_range)
+				end
+			else
+				tree:add(desc.field, field.range, ByteArray.new())
+			end
+		elseif desc.kind == "message" then
+			desc.dissect(field, tree)
+		end
+	end
+end
+
+-- Extension fields of the requests and replies
+local ext_fields = {
+	[1000] = { field = f.trace_id, kind = "bytes" },
+	[1001] = { field = f.span_id, kind = "bytes" },
+}
+
+local function with_ext(known)
+	for num, desc in pairs(ext_fields) do
+		known[num] = desc
+	end
+	return known
+end
+
+local function dissect_error(field, tree)
+	if field.value_range == nil then
+		return
+	end
+	local fields = read_fields(field.value_range:tvb())
+	if fields == nil then
+		tree:add_proto_expert_info(ef_malformed)
+		return
+	end
+	add_fields(fields, tree, {
+		[1] = { field = f.reply_error_type, kind = "uint32" },
+		[2] = { field = f.reply_error_what, kind = "string" },
+	})
+end
+
+local contents = {
+	-- Register
+	[0] = {
+		known = {
+			[1] = { field = f.register_name, kind = "string" },
+			[2] = { field = f.register_ident, kind = "string" },
+		},
+		info = function(by_num)
+			local info = field_string(by_num[1])
+			if by_num[2] ~= nil then
+				info = info .. "[" .. field_string(by_num[2]) .. "]"
+			end
+			return info
+		end,
+	},
+	-- Request
+	[1] = {
+		known = with_ext({
+			[1] = { field = f.request_service, kind = "string" },
+			[2] = { field = f.request_ident, kind = "string" },
+			[3] = { field = f.request_method, kind = "string" },
+			[4] = { field = f.request_data, kind = "bytes" },
+			[5] = { field = f.request_id, kind = "uint" },
+		}),
+		info = function(by_num)
+			local info = field_string(by_num[1])
+			if by_num[2] ~= nil then
+				info = info .. "[" .. field_string(by_num[2]) .. "]"
+			end
+			info = info .. "." .. field_string(by_num[3])
+			if by_num[5] ~= nil and by_num[5].value ~= nil then
+				info = info .. " id=" .. tostring(by_num[5].value)
+			end
+			return info
+		end,
+	},
+	-- Reply
+	[2] = {
+		known = with_ext({
+			[1] = { field = f.reply_id, kind = "uint" },
+			[2] = { field = f.reply_data, kind = "bytes" },
+			[3] = { kind = "message", dissect = dissect_error },
+		}),
+		info = function(by_num)
+			local info = ""
+			if by_num[1] ~= nil and by_num[1].value ~= nil then
+				info = "id=" .. tostring(by_num[1].value)
+			end
+			if by_num[3] ~= nil then
+				info = info .. " error"
+			end
+			return info
+		end,
+	},
+	-- Subscribe
+	[3] = {
+		known = {
+			[1] = { field = f.subscribe_event, kind = "string" },
+			[1006] = { field = f.stamp, kind = "uint" },
+			[1007] = { field = f.filter, kind = "string" },
+		},
+		info = function(by_num)
+			return field_string(by_num[1])
+		end,
+	},
+	-- Publish
+	[4] = {
+		known = {
+			[1] = { field = f.publish_event, kind = "string" },
+			[2] = { field = f.publish_data, kind = "bytes" },
+			[1002] = { field = f.retain, kind = "uint" },
+			[1003] = { field = f.seq, kind = "uint" },
+			[1004] = { field = f.timestamp, kind = "uint" },
+			[1005] = { field = f.publisher, kind = "string" },
+		},
+		info = function(by_num)
+			local info = field_string(by_num[1])
+			if by_num[1003] ~= nil and by_num[1003].value ~= nil then
+				info = info .. " seq=" .. tostring(by_num[1003].value)
+			end
+			return info
+		end,
+	},
+}
+
+-- dissect_message dissects a cellaserv.Message
+local function dissect_message(tvb, pinfo, tree)
+	pinfo.cols.protocol = "cellaserv"
+	local subtree = tree:add(cellaserv, tvb())
+
+	local _, fields = read_fields(tvb)
+	if fields == nil or fields[1] == nil or fields[1].value == nil then
+		subtree:add_proto_expert_info(ef_malformed)
+		return
+	end
+
+	local msg_type = fields[1].value:tonumber()
+	subtree:add(f.type, fields[1].range, msg_type)
+	local type_name = message_types[msg_type] or ("Unknown type " .. msg_type)
+	subtree:append_text(", " .. type_name)
+	pinfo.cols.info = type_name
+
+	local content = contents[msg_type]
+	if content == nil or fields[2] == nil or fields[2].value_range == nil then
+		return
+	end
+
+	local content_fields, content_by_num = read_fields(fields[2].value_range:tvb())
+	if content_fields == nil then
+		subtree:add_proto_expert_info(ef_malformed)
+		return
+	end
+	local content_tree = subtree:add(fields[2].value_range, type_name)
+	add_fields(content_fields, content_tree, content.known)
+	pinfo.cols.info:append(" " .. content.info(content_by_num))
+end
+
+-- Direction of the pcapng packets
+local packet_direction = Field.new("frame.packet_flags_direction")
+local interface_name = Field.new("frame.interface_name")
+
+function cellaserv.dissector(tvb, pinfo, tree)
+	local direction = packet_direction()
+	local iface = interface_name()
+	if direction ~= nil and iface ~= nil then
+		if direction.value == 1 then
+			pinfo.cols.src = tostring(iface.value)
+			pinfo.cols.dst = "cellaserv"
+		elseif direction.value == 2 then
+			pinfo.cols.src = "cellaserv"
+			pinfo.cols.dst = tostring(iface.value)
+		end
+	end
+
+	dissect_message(tvb, pinfo, tree)
+	return tvb:len()
+end
+
+function cellaserv_log.dissector(tvb, pinfo, tree)
+	local subtree = tree:add(cellaserv_log, tvb())
+
+	local fields = read_fields(tvb)
+	if fields == nil then
+		subtree:add_proto_expert_info(ef_malformed)
+		return tvb:len()
+	end
+
+	local content
+	for _, field in ipairs(fields) do
+		if field.num == 1 then
+			subtree:add(f.log_sender, field.range, field_string(field))
+			pinfo.cols.src = field_string(field)
+		elseif field.num == 2 then
+			subtree:add(f.log_destination, field.range, field_string(field))
+			pinfo.cols.dst = field_string(field)
+		elseif field.num == 3 then
+			content = field.value_range
+		else
+			subtree:add(f.unknown, field.range):append_text(" (" .. field.num .. ")")
+		end
+	end
+
+	if content ~= nil then
+		dissect_message(content:tvb(), pinfo, tree)
+	end
+	return tvb:len()
+end
+
+local encaps = wtap_encaps or wtap
+local wtap_encap_table = DissectorTable.get("wtap_encap")
+wtap_encap_table:add(encaps.USER0, cellaserv)
+wtap_encap_table:add(encaps.USER1, cellaserv_log)
+
+-- vim: set nowrap tw=100 noet sw=8:
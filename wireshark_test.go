@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestWiresharkDissector decodes dumps written by dumpSetup with tshark and wireshark/cellaserv.lua
+func TestWiresharkDissector(t *testing.T) {
+	tshark, err := exec.LookPath("tshark")
+	if err != nil {
+		t.Skip("tshark is not installed")
+	}
+	script, err := filepath.Abs(filepath.Join("wireshark", "cellaserv.lua"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := strings.Join([]string{
+		"1,date,time,42,,",
+		"1,date,time,42,,",
+		"2,,,,42,",
+		"2,,,,42,",
+		"4,,,,,match.start",
+	}, "\n")
+
+	for _, format := range []string{"pcap", "pcapng"} {
+		filename := testWriteDump(t, format, testDumpMessages(t))
+		out, err := exec.Command(tshark, "-X", "lua_script:"+script, "-r", filename,
+			"-T", "fields", "-E", "separator=,",
+			"-e", "cellaserv.type",
+			"-e", "cellaserv.request.service",
+			"-e", "cellaserv.request.method",
+			"-e", "cellaserv.request.id",
+			"-e", "cellaserv.reply.id",
+			"-e", "cellaserv.publish.event").CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s: tshark: %s\n%s", format, err, out)
+		}
+		if got := strings.TrimSpace(string(out)); got != want {
+			t.Errorf("%s: tshark decoded:\n%s\nwant:\n%s", format, got, want)
+		}
+	}
+}
+
+// vim: set nowrap tw=100 noet sw=8: